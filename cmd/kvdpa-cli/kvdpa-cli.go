@@ -11,43 +11,58 @@ import (
 )
 
 const deviceTemplate = ` - Name: {{ .Name }}
-   Management Device: {{ .MgmtDev.Name }}
+   Management Device: {{ with .MgmtDev }}{{ .Name }}{{ end }}
    Driver: {{ .Driver }}
+{{- with .Labels }}
+   Labels: {{ range $k, $v := . }}{{ $k }}={{ $v }} {{ end }}
+{{- end }}
+{{- with .UnavailableFields }}
+   Unavailable Information: {{ join . ", " }}
+{{- end }}
 {{- if eq .Driver "virtio_vdpa" }}
    Virtio Net Device:
       Name: {{ .VirtioNet.Name }}
       NetDev: {{ .VirtioNet.NetDev }}
+{{- with .VirtioNet }}
+{{- if .NetDev }}
+      MAC: {{ .MAC }}
+      MTU: {{ .MTU }}
+      State: {{ .OperState }}{{ if .Carrier }} (carrier){{ end }}
+{{- end }}
+{{- with .FeatureNames }}
+      Features: {{ join . " " }}
+{{- end }}
+{{- end }}
 {{ else if eq .Driver "vhost_vdpa" }}
    Vhost Vdpa Device:
       Name: {{ .VhostVdpa.Name }}
       Path: {{ .VhostVdpa.Path }}
 {{ end }}`
 
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
 func listAction(c *cli.Context) error {
-	var devs []vdpa.VdpaDevice
-	var err error
+	filter := vdpa.VdpaDeviceFilter{
+		Driver: c.String("driver"),
+	}
 	if c.String("mgmtdev") != "" {
-		var bus, name string
 		nameParts := strings.Split(c.String("mgmtdev"), "/")
 		if len(nameParts) == 1 {
-			name = nameParts[0]
+			filter.MgmtDevName = nameParts[0]
 		} else if len(nameParts) == 2 {
-			bus = nameParts[0]
-			name = nameParts[1]
+			filter.MgmtBusName = nameParts[0]
+			filter.MgmtDevName = nameParts[1]
 		} else {
 			return fmt.Errorf("Invalid management device name %s", c.String("mgmtdev"))
 		}
-		devs, err = vdpa.GetVdpaDevicesByMgmtDev(bus, name)
-		if err != nil {
-			return err
-		}
-	} else {
-		devs, err = vdpa.ListVdpaDevices()
-		if err != nil {
-			fmt.Println(err)
-		}
 	}
-	tmpl := template.Must(template.New("device").Parse(deviceTemplate))
+	devs, err := vdpa.ListVdpaDevices(filter)
+	if err != nil {
+		return err
+	}
+	tmpl := template.Must(template.New("device").Funcs(templateFuncs).Parse(deviceTemplate))
 
 	for _, dev := range devs {
 		if err := tmpl.Execute(os.Stdout, dev); err != nil {
@@ -58,7 +73,7 @@ func listAction(c *cli.Context) error {
 }
 
 func getAction(c *cli.Context) error {
-	tmpl := template.Must(template.New("device").Parse(deviceTemplate))
+	tmpl := template.Must(template.New("device").Funcs(templateFuncs).Parse(deviceTemplate))
 	for i := 0; i < c.Args().Len(); i++ {
 		name := c.Args().Get(i)
 		dev, err := vdpa.GetVdpaDevice(name)
@@ -72,10 +87,223 @@ func getAction(c *cli.Context) error {
 	return nil
 }
 
+func usersAction(c *cli.Context) error {
+	for i := 0; i < c.Args().Len(); i++ {
+		name := c.Args().Get(i)
+		users, err := vdpa.GetVdpaDeviceUsers(name)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			fmt.Printf("%s: %d %s\n", name, user.PID, user.Command)
+		}
+	}
+	return nil
+}
+
+const localityTemplate = `{{ .Name }}:
+   PCI Address: {{ .PCIAddress }}
+   NUMA Node: {{ .NumaNode }}
+   Local CPUs: {{ .LocalCPUs }}
+{{- range .IRQs }}
+   IRQ {{ .Number }}: {{ join .Actions " " }} affinity {{ .Affinity }}
+{{- end }}
+`
+
+func localityAction(c *cli.Context) error {
+	if c.String("cpus") != "" {
+		cpus, err := vdpa.ParseCPUList(c.String("cpus"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < c.Args().Len(); i++ {
+			if err := vdpa.SetVdpaDeviceIRQAffinity(c.Args().Get(i), cpus, c.IntSlice("irq")...); err != nil {
+				return err
+			}
+		}
+	}
+	tmpl := template.Must(template.New("locality").Funcs(templateFuncs).Parse(localityTemplate))
+	for i := 0; i < c.Args().Len(); i++ {
+		name := c.Args().Get(i)
+		locality, err := vdpa.GetVdpaDeviceLocality(name)
+		if err != nil {
+			return err
+		}
+		if err := tmpl.Execute(os.Stdout, struct {
+			Name string
+			*vdpa.DeviceLocality
+		}{name, locality}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func gcAction(c *cli.Context) error {
+	if c.String("registry") != "" {
+		vdpa.SetOwnerRegistry(c.String("registry"))
+	}
+	report, err := vdpa.CollectGarbage(vdpa.GCOptions{
+		GracePeriod: c.Duration("grace-period"),
+		DryRun:      c.Bool("dry-run"),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	for name, users := range report.InUse {
+		fmt.Printf("%s is in use by %v\n", name, users)
+	}
+	for name, err := range report.Failures {
+		fmt.Printf("%s: %v\n", name, err)
+	}
+	return nil
+}
+
+const capabilitiesTemplate = `Version: {{ .Version }}
+Max Attribute: {{ .MaxAttr }}
+Commands: {{ range $i, $c := .Commands }}{{ if $i }}, {{ end }}{{ $c }}{{ end }}
+Features:
+   Create: {{ .Create }}
+   Config Get: {{ .ConfigGet }}
+   Vendor Stats: {{ .VStats }}
+   Attribute Set: {{ .AttrSet }}
+   Feature Provisioning: {{ .FeatureProvisioning }}
+`
+
+func capabilitiesAction(c *cli.Context) error {
+	caps, err := vdpa.Capabilities()
+	if err != nil {
+		return err
+	}
+	tmpl := template.Must(template.New("capabilities").Parse(capabilitiesTemplate))
+	return tmpl.Execute(os.Stdout, caps)
+}
+
+func exportAction(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("exactly one topology file is required")
+	}
+	topology, err := vdpa.ExportTopology()
+	if err != nil {
+		return err
+	}
+	return topology.Save(c.Args().Get(0))
+}
+
+func restoreAction(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("exactly one topology file is required")
+	}
+	topology, err := vdpa.LoadTopology(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	report, err := vdpa.RestoreTopology(topology)
+	if err != nil {
+		return err
+	}
+	for _, result := range report.Steps {
+		if result.Err == nil && result.Changed {
+			fmt.Println(result.Step)
+		}
+	}
+	for name, err := range report.Failures {
+		fmt.Printf("cannot restore %s: %v\n", name, err)
+	}
+	if len(report.Failures) > 0 {
+		return fmt.Errorf("%d devices could not be restored", len(report.Failures))
+	}
+	return nil
+}
+
+func snapshotAction(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("exactly one snapshot file is required")
+	}
+	snapshot, err := vdpa.TakeSnapshot()
+	if err != nil {
+		return err
+	}
+	return snapshot.Save(c.Args().Get(0))
+}
+
+func diffAction(c *cli.Context) error {
+	if c.Args().Len() < 1 || c.Args().Len() > 2 {
+		return fmt.Errorf("a snapshot file and, optionally, a second one are required")
+	}
+	before, err := vdpa.LoadSnapshot(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	var after *vdpa.Snapshot
+	if c.Args().Len() == 2 {
+		after, err = vdpa.LoadSnapshot(c.Args().Get(1))
+	} else {
+		after, err = vdpa.TakeSnapshot()
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Print(vdpa.DiffSnapshots(before, after))
+	return nil
+}
+
+// recorder records the netlink session if --record is set
+var recorder *vdpa.RecordingNetlinkOps
+
+// stopPcap stops the pcap export if --pcap is set
+var stopPcap func() error
+
+func startRecording(c *cli.Context) error {
+	var err error
+	if c.String("pcap") != "" {
+		stopPcap, err = vdpa.EnablePcap(c.String("pcap"))
+	} else {
+		stopPcap, err = vdpa.EnablePcapFromEnv()
+	}
+	if err != nil {
+		return err
+	}
+	if c.String("record") != "" {
+		recorder = vdpa.NewRecordingNetlinkOps(vdpa.GetNetlinkOps(), c.String("description"))
+		vdpa.SetNetlinkOps(recorder)
+	}
+	return nil
+}
+
+func saveRecording(c *cli.Context) error {
+	if stopPcap != nil {
+		if err := stopPcap(); err != nil {
+			return err
+		}
+	}
+	if recorder == nil {
+		return nil
+	}
+	return recorder.Fixture().Save(c.String("record"))
+}
+
 func main() {
 	app := &cli.App{
 		Name:  "kvdpa-cli",
 		Usage: "Interact with Kernel vDPA devices",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "record",
+				Usage: "Record the netlink session to a fixture file that unit tests can replay",
+			},
+			&cli.StringFlag{
+				Name:  "description",
+				Usage: "Description of the recorded host (e.g: hardware and driver)",
+			},
+			&cli.StringFlag{
+				Name:  "pcap",
+				Usage: "Write the netlink traffic to a pcap file (also enabled by setting " + vdpa.PcapEnvVar + ")",
+			},
+		},
+		Before: startRecording,
+		After:  saveRecording,
 		Commands: []*cli.Command{
 			{Name: "list",
 				Usage:  "List vdpa devices",
@@ -85,6 +313,10 @@ func main() {
 						Name:  "mgmtdev",
 						Usage: "Name of the management device: [busName/]devName",
 					},
+					&cli.StringFlag{
+						Name:  "driver",
+						Usage: "Name of the driver the devices are bound to",
+					},
 				},
 			},
 			{Name: "get",
@@ -92,6 +324,69 @@ func main() {
 				Action:    getAction,
 				ArgsUsage: "[name]",
 			},
+			{Name: "users",
+				Usage:     "Show the processes that hold vdpa devices open",
+				Action:    usersAction,
+				ArgsUsage: "name [name...]",
+			},
+			{Name: "locality",
+				Usage:     "Show the NUMA node, local CPUs and interrupts of vdpa devices",
+				Action:    localityAction,
+				ArgsUsage: "name [name...]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "cpus",
+						Usage: "Set the affinity of the devices' interrupts (or the ones given with --irq) to a CPU list (e.g: 0-3,8)",
+					},
+					&cli.IntSliceFlag{
+						Name:  "irq",
+						Usage: "Interrupt of each device whose affinity is set with --cpus, all if none",
+					},
+				},
+			},
+			{Name: "gc",
+				Usage:  "Delete the vdpa devices without owner that no process holds open",
+				Action: gcAction,
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "grace-period",
+						Usage: "How long a device stays orphaned before it is deleted",
+						Value: vdpa.DefaultGCGracePeriod,
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only report the devices that would be deleted",
+					},
+					&cli.StringFlag{
+						Name:  "registry",
+						Usage: "Owner registry file (default " + vdpa.DefaultOwnerRegistry + ")",
+					},
+				},
+			},
+			{Name: "export",
+				Usage:     "Export the vdpa topology to a file",
+				Action:    exportAction,
+				ArgsUsage: "file",
+			},
+			{Name: "restore",
+				Usage:     "Restore the vdpa topology from a file",
+				Action:    restoreAction,
+				ArgsUsage: "file",
+			},
+			{Name: "snapshot",
+				Usage:     "Save a snapshot of the vdpa state to a file",
+				Action:    snapshotAction,
+				ArgsUsage: "file",
+			},
+			{Name: "diff",
+				Usage:     "Compare a snapshot with another one or with the current state",
+				Action:    diffAction,
+				ArgsUsage: "before [after]",
+			},
+			{Name: "capabilities",
+				Usage:  "Show the vdpa capabilities of the running kernel",
+				Action: capabilitiesAction,
+			},
 		},
 	}
 	err := app.Run(os.Args)
@@ -1,6 +1,6 @@
 module github.com/k8snetworkplumbingwg/govdpa
 
-go 1.17
+go 1.18
 
 require (
 	github.com/stretchr/testify v1.7.0
@@ -0,0 +1,141 @@
+package kvdpa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// DeviceSpec describes a device created by CreateVdpaDevices
+type DeviceSpec struct {
+	Name string
+	// MgmtDev is the management device name: [busName/]devName
+	MgmtDev string
+	// Config is the virtio net configuration, if any
+	Config *VdpaNetConfig
+	// Driver is the vdpa bus driver to bind the device to, if any
+	Driver string
+}
+
+// BatchError is returned when a batch creation fails. It wraps the error of
+// the failed step and holds the errors of the rollback, if any
+type BatchError struct {
+	// Device is the device whose creation or binding failed
+	Device string
+	Err    error
+	// RollbackErrors are the errors deleting the devices already created
+	RollbackErrors []error
+}
+
+func (e *BatchError) Error() string {
+	msg := fmt.Sprintf("vdpa device %s: %v", e.Device, e.Err)
+	if len(e.RollbackErrors) > 0 {
+		errs := make([]string, 0, len(e.RollbackErrors))
+		for _, err := range e.RollbackErrors {
+			errs = append(errs, err.Error())
+		}
+		msg += fmt.Sprintf(" (rollback failed: %s)", strings.Join(errs, "; "))
+	}
+	return msg
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// validateSpecs checks the specs before anything is created
+func validateSpecs(specs []DeviceSpec) error {
+	names := map[string]bool{}
+	for _, spec := range specs {
+		if !validName(spec.Name) {
+			return fmt.Errorf("invalid vdpa device name %q: %w", spec.Name, syscall.EINVAL)
+		}
+		if names[spec.Name] {
+			return fmt.Errorf("duplicate vdpa device %s: %w", spec.Name, syscall.EINVAL)
+		}
+		names[spec.Name] = true
+		if _, _, err := splitMgmtDevName(spec.MgmtDev); err != nil {
+			return fmt.Errorf("device %s: %w", spec.Name, err)
+		}
+		if spec.Driver != "" && spec.Driver != VhostVdpaDriver && spec.Driver != VirtioVdpaDriver {
+			return fmt.Errorf("device %s: unknown driver %s: %w", spec.Name, spec.Driver, syscall.EINVAL)
+		}
+	}
+	return nil
+}
+
+// CreateVdpaDevices creates and binds several devices as one transaction:
+// if any step fails, the devices already created are deleted in reverse
+// order and a *BatchError is returned
+func CreateVdpaDevices(specs []DeviceSpec) error {
+	return CreateVdpaDevicesContext(context.Background(), specs)
+}
+
+// CreateVdpaDevicesContext is CreateVdpaDevices with a context. Once the
+// context is done, the devices already created are deleted regardless,
+// including the one whose creation was interrupted if the kernel created it
+func CreateVdpaDevicesContext(ctx context.Context, specs []DeviceSpec) error {
+	if err := validateSpecs(specs); err != nil {
+		return err
+	}
+	created := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		existed := vdpaDeviceExists(spec.Name)
+		err := AddVdpaDeviceWithConfigContext(ctx, spec.MgmtDev, spec.Name, spec.Config)
+		if err == nil {
+			created = append(created, spec.Name)
+			if spec.Driver != "" {
+				err = bindCreatedDevice(ctx, spec.Name, spec.Driver)
+			}
+		} else if isContextErr(err) && getDryRun(ctx) == nil && !existed && vdpaDeviceExists(spec.Name) {
+			// The request reached the kernel but its answer was not awaited
+			created = append(created, spec.Name)
+		}
+		if err != nil {
+			return &BatchError{Device: spec.Name, Err: err, RollbackErrors: rollback(ctx, created)}
+		}
+	}
+	return nil
+}
+
+// isContextErr returns whether an error comes from a context that is done
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// vdpaDeviceExists returns whether a vdpa device exists in sysfs
+func vdpaDeviceExists(name string) bool {
+	_, err := os.Stat(filepath.Join(vdpaBusDevDir, name))
+	return err == nil
+}
+
+// bindCreatedDevice binds a device that was just created. It may have been
+// bound to another driver by the kernel (driver autoprobing)
+func bindCreatedDevice(ctx context.Context, name, driver string) error {
+	dev, err := GetVdpaDeviceContext(ctx, name)
+	if err != nil {
+		return err
+	}
+	_, err = rebindVdpaDevice(ctx, dev, driver)
+	return err
+}
+
+// rollback deletes the created devices in reverse order. They are deleted
+// even if the context is done or processes already opened them
+func rollback(ctx context.Context, created []string) []error {
+	detached := context.Background()
+	if d := getDryRun(ctx); d != nil {
+		detached = WithDryRun(detached, d)
+	}
+	var errs []error
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := deleteVdpaDevice(detached, created[i], true); err != nil {
+			errs = append(errs, fmt.Errorf("deleting %s: %w", created[i], err))
+		}
+	}
+	return errs
+}
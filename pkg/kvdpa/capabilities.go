@@ -0,0 +1,75 @@
+package kvdpa
+
+import "context"
+
+// KernelCapabilities describes the vdpa generic netlink family supported by
+// the running kernel
+type KernelCapabilities struct {
+	// Version is the vdpa family version
+	Version uint32
+	// MaxAttr is the highest attribute the kernel accepts
+	MaxAttr uint32
+	// Commands holds the supported commands (e.g: VdpaCmdDevNew)
+	Commands []uint8
+
+	// Create is whether vdpa devices can be created and deleted
+	Create bool
+	// ConfigGet is whether the device configuration can be retrieved
+	ConfigGet bool
+	// VStats is whether the device vendor statistics can be retrieved
+	VStats bool
+	// AttrSet is whether device attributes can be modified after creation
+	AttrSet bool
+	// FeatureProvisioning is whether virtio features can be provisioned on creation
+	FeatureProvisioning bool
+}
+
+// SupportsCommand returns whether the kernel supports the given vdpa command
+func (c *KernelCapabilities) SupportsCommand(command uint8) bool {
+	for _, cmd := range c.Commands {
+		if cmd == command {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsAttribute returns whether the kernel accepts the given vdpa attribute
+func (c *KernelCapabilities) SupportsAttribute(attrType int) bool {
+	return attrType > VdpaAttrUnspec && uint32(attrType) <= c.MaxAttr
+}
+
+// Capabilities queries the generic netlink controller for the vdpa family and
+// returns what the running kernel supports. If the kernel does not support
+// the vdpa family at all, ErrGenlFamilyNotFound is returned
+func Capabilities() (*KernelCapabilities, error) {
+	return CapabilitiesContext(context.Background())
+}
+
+// CapabilitiesContext is Capabilities with a context. The family is cached
+// once resolved, so the context is only checked before it is queried
+func CapabilitiesContext(ctx context.Context) (*KernelCapabilities, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	family, err := getVdpaFamily(GetNetlinkOps())
+	if err != nil {
+		return nil, err
+	}
+
+	caps := &KernelCapabilities{
+		Version:  family.Version,
+		MaxAttr:  family.MaxAttr,
+		Commands: make([]uint8, 0, len(family.Ops)),
+	}
+	for _, op := range family.Ops {
+		caps.Commands = append(caps.Commands, uint8(op.ID))
+	}
+
+	caps.Create = caps.SupportsCommand(VdpaCmdDevNew) && caps.SupportsCommand(VdpaCmdDevDel)
+	caps.ConfigGet = caps.SupportsCommand(VdpaCmdDevConfigGet)
+	caps.VStats = caps.SupportsCommand(VdpaCmdDevVstatsGet)
+	caps.AttrSet = caps.SupportsCommand(VdpaCmdDevAttrSet)
+	caps.FeatureProvisioning = caps.Create && caps.SupportsAttribute(VdpaAttrDevFeatures)
+	return caps, nil
+}
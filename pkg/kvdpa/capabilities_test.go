@@ -0,0 +1,157 @@
+package kvdpa
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/mocks"
+)
+
+// familyMock is a mocked NetlinkOps that also gives the vdpa family
+type familyMock struct {
+	*mocks.NetlinkOps
+}
+
+// GetVdpaFamily returns the mocked vdpa family
+func (m familyMock) GetVdpaFamily() (*netlink.GenlFamily, error) {
+	ret := m.Called()
+	family, _ := ret.Get(0).(*netlink.GenlFamily)
+	return family, ret.Error(1)
+}
+
+func genlOps(commands ...uint8) []netlink.GenlOp {
+	ops := make([]netlink.GenlOp, len(commands))
+	for i, cmd := range commands {
+		ops[i] = netlink.GenlOp{ID: uint32(cmd)}
+	}
+	return ops
+}
+
+func TestCapabilities(t *testing.T) {
+	tests := []struct {
+		name     string
+		family   *netlink.GenlFamily
+		err      error
+		expected *KernelCapabilities
+	}{
+		{
+			name: "Initial vdpa support",
+			family: &netlink.GenlFamily{
+				Name:    VdpaGenlName,
+				Version: 1,
+				MaxAttr: VdpaAttrDevMinVqSize,
+				Ops: genlOps(VdpaCmdMgmtDevGet, VdpaCmdDevNew,
+					VdpaCmdDevDel, VdpaCmdDevGet),
+			},
+			expected: &KernelCapabilities{
+				Version: 1,
+				MaxAttr: VdpaAttrDevMinVqSize,
+				Commands: []uint8{VdpaCmdMgmtDevGet, VdpaCmdDevNew,
+					VdpaCmdDevDel, VdpaCmdDevGet},
+				Create: true,
+			},
+		},
+		{
+			name: "Config and vstats",
+			family: &netlink.GenlFamily{
+				Name:    VdpaGenlName,
+				Version: 1,
+				MaxAttr: VdpaAttrDevVendorAttrValue,
+				Ops: genlOps(VdpaCmdMgmtDevGet, VdpaCmdDevNew, VdpaCmdDevDel,
+					VdpaCmdDevGet, VdpaCmdDevConfigGet, VdpaCmdDevVstatsGet),
+			},
+			expected: &KernelCapabilities{
+				Version: 1,
+				MaxAttr: VdpaAttrDevVendorAttrValue,
+				Commands: []uint8{VdpaCmdMgmtDevGet, VdpaCmdDevNew, VdpaCmdDevDel,
+					VdpaCmdDevGet, VdpaCmdDevConfigGet, VdpaCmdDevVstatsGet},
+				Create:    true,
+				ConfigGet: true,
+				VStats:    true,
+			},
+		},
+		{
+			name: "Full support",
+			family: &netlink.GenlFamily{
+				Name:    VdpaGenlName,
+				Version: 1,
+				MaxAttr: VdpaAttrMax + 10,
+				Ops: genlOps(VdpaCmdMgmtDevGet, VdpaCmdDevNew, VdpaCmdDevDel,
+					VdpaCmdDevGet, VdpaCmdDevConfigGet, VdpaCmdDevVstatsGet, VdpaCmdDevAttrSet),
+			},
+			expected: &KernelCapabilities{
+				Version: 1,
+				MaxAttr: VdpaAttrMax + 10,
+				Commands: []uint8{VdpaCmdMgmtDevGet, VdpaCmdDevNew, VdpaCmdDevDel,
+					VdpaCmdDevGet, VdpaCmdDevConfigGet, VdpaCmdDevVstatsGet, VdpaCmdDevAttrSet},
+				Create:              true,
+				ConfigGet:           true,
+				VStats:              true,
+				AttrSet:             true,
+				FeatureProvisioning: true,
+			},
+		},
+		{
+			name: "Read only",
+			family: &netlink.GenlFamily{
+				Name:    VdpaGenlName,
+				Version: 1,
+				MaxAttr: VdpaAttrDevFeatures,
+				Ops:     genlOps(VdpaCmdMgmtDevGet, VdpaCmdDevGet),
+			},
+			expected: &KernelCapabilities{
+				Version:  1,
+				MaxAttr:  VdpaAttrDevFeatures,
+				Commands: []uint8{VdpaCmdMgmtDevGet, VdpaCmdDevGet},
+			},
+		},
+		{
+			name: "No vdpa family",
+			err:  fmt.Errorf("%w: %v", ErrGenlFamilyNotFound, syscall.ENOENT),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s_%s", "TestCapabilities", tt.name), func(t *testing.T) {
+			netLinkMock := &mocks.NetlinkOps{}
+			SetNetlinkOps(familyMock{netLinkMock})
+			netLinkMock.On("GetVdpaFamily").Return(tt.family, tt.err)
+
+			caps, err := Capabilities()
+			if tt.err != nil {
+				assert.ErrorIs(t, err, ErrGenlFamilyNotFound)
+				assert.Nil(t, caps)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tt.expected, caps)
+				assert.True(t, caps.SupportsCommand(VdpaCmdDevGet))
+				assert.False(t, caps.SupportsCommand(VdpaCmdMgmtDevNew))
+				assert.True(t, caps.SupportsAttribute(VdpaAttrDevName))
+				assert.False(t, caps.SupportsAttribute(VdpaAttrUnspec))
+			}
+		})
+	}
+
+	t.Run("TestCapabilities_No family support", func(t *testing.T) {
+		// Only the methods of NetlinkOps are promoted
+		SetNetlinkOps(struct{ NetlinkOps }{&mocks.NetlinkOps{}})
+		caps, err := Capabilities()
+		assert.ErrorIs(t, err, errNoVdpaFamily)
+		assert.Nil(t, caps)
+	})
+}
+
+func TestIntegrationCapabilities(t *testing.T) {
+	// Should have modprobed vdpa
+	minKernelRequired(t, 5, 12)
+	SetNetlinkOps(&defaultNetlinkOps{})
+	caps, err := Capabilities()
+	assert.Nil(t, err)
+	t.Logf("%#+v\n", caps)
+	assert.True(t, caps.SupportsCommand(VdpaCmdDevGet))
+	assert.True(t, caps.SupportsCommand(VdpaCmdMgmtDevGet))
+}
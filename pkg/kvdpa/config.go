@@ -0,0 +1,117 @@
+package kvdpa
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// VdpaNetConfig is the virtio net configuration of a vdpa device. On
+// creation, the zero fields are left to the management device defaults
+type VdpaNetConfig struct {
+	MacAddr net.HardwareAddr
+	MTU     uint16
+	// MaxVqp is the maximum number of queue pairs
+	MaxVqp uint16
+	// Features are the virtio features provisioned to the device
+	Features uint64
+
+	// Status and NegotiatedFeatures are only retrieved, not provisioned
+	Status             uint8
+	NegotiatedFeatures uint64
+}
+
+// attributes returns the netlink attributes that provision the configuration
+func (c *VdpaNetConfig) attributes() ([]*nl.RtAttr, error) {
+	ops := GetNetlinkOps()
+	data := []*nl.RtAttr{}
+	add := func(attrType int, value interface{}) error {
+		attr, err := ops.NewAttribute(attrType, value)
+		if err != nil {
+			return err
+		}
+		data = append(data, attr)
+		return nil
+	}
+	if c.MacAddr != nil {
+		if len(c.MacAddr) != 6 {
+			return nil, fmt.Errorf("invalid MAC address %q: %w", c.MacAddr, syscall.EINVAL)
+		}
+		if err := add(VdpaAttrDevNetCfgMacAddr, []byte(c.MacAddr)); err != nil {
+			return nil, err
+		}
+	}
+	if c.MTU != 0 {
+		if err := add(VdpaAttrGetNetCfgMTU, c.MTU); err != nil {
+			return nil, err
+		}
+	}
+	if c.MaxVqp != 0 {
+		if err := add(VdpaAttrDevNetCfgMaxVqp, c.MaxVqp); err != nil {
+			return nil, err
+		}
+	}
+	if c.Features != 0 {
+		if err := add(VdpaAttrDevFeatures, c.Features); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// parseAttributes populates the configuration from netlink attributes
+func (c *VdpaNetConfig) parseAttributes(attrs []syscall.NetlinkRouteAttr) error {
+	var err error
+	for _, a := range attrs {
+		switch attrType(a) {
+		case VdpaAttrDevNetCfgMacAddr:
+			c.MacAddr = append(net.HardwareAddr{}, a.Value...)
+		case VdpaAttrGetNetCfgMTU:
+			c.MTU, err = attrUint16(a)
+		case VdpaAttrDevNetCfgMaxVqp:
+			c.MaxVqp, err = attrUint16(a)
+		case VdpaAttrDevFeatures:
+			c.Features, err = attrUint64(a)
+		case VdpaAttrDevNetStatus:
+			c.Status, err = attrUint8(a)
+		case VdpaAttrDevNegotiatedFeatures:
+			c.NegotiatedFeatures, err = attrUint64(a)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetVdpaDeviceConfig returns the virtio net configuration of a vdpa device
+func GetVdpaDeviceConfig(name string) (*VdpaNetConfig, error) {
+	return GetVdpaDeviceConfigContext(context.Background(), name)
+}
+
+// GetVdpaDeviceConfigContext is GetVdpaDeviceConfig with a context
+func GetVdpaDeviceConfigContext(ctx context.Context, name string) (*VdpaNetConfig, error) {
+	nameAttr, err := GetNetlinkOps().NewAttribute(VdpaAttrDevName, name)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := runVdpaNetlinkCmd(ctx, VdpaCmdDevConfigGet, 0, []*nl.RtAttr{nameAttr})
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("%w: empty response", ErrMalformedMessage)
+	}
+	attrs, err := parseGenlAttributes(msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	config := &VdpaNetConfig{}
+	if err := config.parseAttributes(attrs); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
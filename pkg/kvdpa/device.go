@@ -1,11 +1,22 @@
 package kvdpa
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/vishvananda/netlink/nl"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/internal/hooks"
 )
 
 // Exported constants
@@ -14,30 +25,78 @@ const (
 	VirtioVdpaDriver = "virtio_vdpa"
 )
 
-// Private constants
+// Virtio device IDs (device classes) as reported by VdpaAttrDevID
 const (
+	VirtioIDNet   uint32 = 1
+	VirtioIDBlock uint32 = 2
+)
+
+// Paths used to inspect the vdpa devices. They are variables so that
+// tests can run against a fake sysfs and devfs tree (see setRootDirs)
+var (
+	sysfsRoot       = "/sys"
 	vdpaBusDevDir   = "/sys/bus/vdpa/devices"
+	vdpaBusDrvDir   = "/sys/bus/vdpa/drivers"
 	vdpaVhostDevDir = "/dev"
 	rootDevDir      = "/sys/devices"
+	pciDevDir       = "/sys/bus/pci/devices"
 )
 
+func init() {
+	hooks.SetRootDirs = setRootDirs
+}
+
+// setRootDirs makes the library look for the sysfs and devfs trees under the
+// provided directories instead of /sys and /dev
+func setRootDirs(sysfs, devfs string) {
+	sysfsRoot = sysfs
+	vdpaBusDevDir = filepath.Join(sysfs, "bus/vdpa/devices")
+	vdpaBusDrvDir = filepath.Join(sysfs, "bus/vdpa/drivers")
+	vdpaVhostDevDir = devfs
+	rootDevDir = filepath.Join(sysfs, "devices")
+	pciDevDir = filepath.Join(sysfs, "bus/pci/devices")
+	virtioDevDir = filepath.Join(sysfs, "bus/virtio/devices")
+}
+
+// busInfoWorkers is the maximum number of devices whose sysfs information
+// is resolved concurrently when listing devices
+var busInfoWorkers = runtime.NumCPU()
+
+var pciAddressRe = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+
 // VdpaDevice contains information about a Vdpa Device
 type VdpaDevice interface {
 	Driver() string
 	Name() string
+	DeviceID() uint32
+	VendorID() uint32
 	MgmtDev() MgmtDev
 	VirtioNet() VirtioNet
 	VhostVdpa() VhostVdpa
 	ParentDevicePath() (string, error)
+	UnavailableFields() []string
+	// RawAttributes returns the netlink attributes that were not parsed,
+	// indexed by attribute type
+	RawAttributes() map[uint16][]byte
+	// Labels returns the labels stored in the owner registry, if any, or
+	// the error that prevented reading them
+	Labels() (map[string]string, error)
 }
 
 // vdpaDev implements VdpaDevice interface
 type vdpaDev struct {
 	name      string
 	driver    string
+	deviceID  uint32
+	vendorID  uint32
 	mgmtDev   *mgmtDev
 	virtioNet VirtioNet
 	vhostVdpa VhostVdpa
+	// unavailable holds the fields that could not be retrieved
+	unavailable []string
+	raw         map[uint16][]byte
+	labels      map[string]string
+	labelsErr   error
 }
 
 // Driver resturns de device's driver name
@@ -50,11 +109,41 @@ func (vd *vdpaDev) Name() string {
 	return vd.name
 }
 
+// DeviceID returns the device's virtio device ID (e.g: VirtioIDNet)
+func (vd *vdpaDev) DeviceID() uint32 {
+	return vd.deviceID
+}
+
+// VendorID returns the device's virtio vendor ID
+func (vd *vdpaDev) VendorID() uint32 {
+	return vd.vendorID
+}
+
 // MgmtDev returns the device's management device
 func (vd *vdpaDev) MgmtDev() MgmtDev {
+	if vd.mgmtDev == nil {
+		return nil
+	}
 	return vd.mgmtDev
 }
 
+// UnavailableFields returns the names of the fields (as named by their
+// accessors, e.g: "DeviceID") whose information could not be retrieved.
+// This only happens if the device was read using the sysfs fallback
+func (vd *vdpaDev) UnavailableFields() []string {
+	return vd.unavailable
+}
+
+// RawAttributes returns the netlink attributes that were not parsed
+func (vd *vdpaDev) RawAttributes() map[uint16][]byte {
+	return vd.raw
+}
+
+// Labels returns the device's labels (see SetVdpaDeviceLabels)
+func (vd *vdpaDev) Labels() (map[string]string, error) {
+	return vd.labels, vd.labelsErr
+}
+
 // VhostVdpa returns the VhostVdpa device information associated
 // or nil if the device is not bound to the vhost_vdpa driver
 func (vd *vdpaDev) VhostVdpa() VhostVdpa {
@@ -97,16 +186,30 @@ func (vd *vdpaDev) getBusInfo() error {
 // parseAttributes populates the vdpa device information from netlink attributes
 func (vd *vdpaDev) parseAttributes(attrs []syscall.NetlinkRouteAttr) error {
 	mgmtDev := &mgmtDev{}
+	var err error
 	for _, a := range attrs {
-		switch a.Attr.Type {
+		switch attrType(a) {
 		case VdpaAttrDevName:
-			vd.name = string(a.Value[:len(a.Value)-1])
+			vd.name = attrString(a.Value)
+		case VdpaAttrDevID:
+			vd.deviceID, err = attrUint32(a)
+		case VdpaAttrDevVendorID:
+			vd.vendorID, err = attrUint32(a)
 		case VdpaAttrMgmtDevBusName:
-			mgmtDev.busName = string(a.Value[:len(a.Value)-1])
+			mgmtDev.busName = attrString(a.Value)
 		case VdpaAttrMgmtDevDevName:
-			mgmtDev.devName = string(a.Value[:len(a.Value)-1])
+			mgmtDev.devName = attrString(a.Value)
+		default:
+			vd.raw = addRawAttribute(vd.raw, a)
+		}
+		if err != nil {
+			return err
 		}
 	}
+	// The name is used to look the device up in sysfs
+	if !validName(vd.name) {
+		return fmt.Errorf("%w: invalid device name %q", ErrMalformedMessage, vd.name)
+	}
 	vd.mgmtDev = mgmtDev
 	return nil
 }
@@ -144,6 +247,50 @@ func (vd *vdpaDev) ParentDevicePath() (string, error) {
 	return parent, nil
 }
 
+// parentPCIAddress returns the PCI address of the device the vdpa device
+// sits on, if any. SF-based devices have an intermediate auxiliary device
+// (e.g: .../0000:05:00.0/mlx5_core.sf.2/vdpa0) so the first PCI device up in
+// the hierarchy is returned. If there is no such
+// device (e.g: vdpasim), an empty string is returned.
+func (vd *vdpaDev) parentPCIAddress() (string, error) {
+	devicePath, err := filepath.EvalSymlinks(filepath.Join(vdpaBusDevDir, vd.name))
+	if err != nil {
+		return "", err
+	}
+	return pciAddressInPath(filepath.Dir(devicePath)), nil
+}
+
+// pciAddressInPath returns the address of the first PCI device found walking
+// up a sysfs device path, or an empty string if there is none
+func pciAddressInPath(devicePath string) string {
+	for path := devicePath; path != rootDevDir && path != "/" && path != "."; path = filepath.Dir(path) {
+		if pciAddressRe.MatchString(filepath.Base(path)) {
+			return filepath.Base(path)
+		}
+	}
+	return ""
+}
+
+// numaNode returns the NUMA node of the vdpa device's parent PCI device
+// or -1 if it is unknown
+func (vd *vdpaDev) numaNode() (int, error) {
+	pciAddress, err := vd.parentPCIAddress()
+	if err != nil {
+		return -1, err
+	}
+	if pciAddress == "" {
+		return -1, nil
+	}
+	content, err := ioutil.ReadFile(filepath.Join(pciDevDir, pciAddress, "numa_node"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return -1, nil
+		}
+		return -1, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
+
 /* Finds the virtio vdpa device of a vdpa device and returns its path
 Currently, PCI-based devices have the following sysfs structure:
 /sys/bus/vdpa/devices/
@@ -166,13 +313,20 @@ func (vd *vdpaDev) getVirtioVdpaDev() (VirtioNet, error) {
 
 /*GetVdpaDevice returns the vdpa device information by a vdpa device name */
 func GetVdpaDevice(name string) (VdpaDevice, error) {
+	return GetVdpaDeviceContext(context.Background(), name)
+}
+
+/*GetVdpaDeviceContext is GetVdpaDevice with a context */
+func GetVdpaDeviceContext(ctx context.Context, name string) (VdpaDevice, error) {
 	nameAttr, err := GetNetlinkOps().NewAttribute(VdpaAttrDevName, name)
 	if err != nil {
 		return nil, err
 	}
 
-	msgs, err := GetNetlinkOps().
-		RunVdpaNetlinkCmd(VdpaCmdDevGet, 0, []*nl.RtAttr{nameAttr})
+	msgs, err := runVdpaNetlinkCmd(ctx, VdpaCmdDevGet, 0, []*nl.RtAttr{nameAttr})
+	if errors.Is(err, ErrGenlFamilyNotFound) {
+		return getVdpaDeviceSysfs(name)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -181,6 +335,9 @@ func GetVdpaDevice(name string) (VdpaDevice, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(vdpaDevs) == 0 {
+		return nil, fmt.Errorf("%w: empty response", ErrMalformedMessage)
+	}
 	return vdpaDevs[0], nil
 }
 
@@ -188,43 +345,58 @@ func GetVdpaDevice(name string) (VdpaDevice, error) {
 has the given bus and device names.
 */
 func GetVdpaDevicesByMgmtDev(busName, devName string) ([]VdpaDevice, error) {
-	result := []VdpaDevice{}
-	devices, err := ListVdpaDevices()
+	return GetVdpaDevicesByMgmtDevContext(context.Background(), busName, devName)
+}
+
+/*GetVdpaDevicesByMgmtDevContext is GetVdpaDevicesByMgmtDev with a context */
+func GetVdpaDevicesByMgmtDevContext(ctx context.Context, busName, devName string) ([]VdpaDevice, error) {
+	result, err := ListVdpaDevicesContext(ctx, VdpaDeviceFilter{
+		MgmtBusName: busName,
+		MgmtDevName: devName,
+	})
 	if err != nil {
 		return nil, err
 	}
-	for _, device := range devices {
-		if device.MgmtDev() != nil &&
-			device.MgmtDev().BusName() == busName &&
-			device.MgmtDev().DevName() == devName {
-			result = append(result, device)
-		}
-	}
 	if len(result) == 0 {
 		return nil, syscall.ENODEV
 	}
 	return result, nil
 }
 
-/*ListVdpaDevices returns a list of all available vdpa devices */
-func ListVdpaDevices() ([]VdpaDevice, error) {
-	msgs, err := GetNetlinkOps().RunVdpaNetlinkCmd(VdpaCmdDevGet, syscall.NLM_F_DUMP, nil)
+/*ListVdpaDevices returns a list of all available vdpa devices.
+If filters are provided, only the devices that match all of them are returned
+*/
+func ListVdpaDevices(filters ...VdpaDeviceFilter) ([]VdpaDevice, error) {
+	return ListVdpaDevicesContext(context.Background(), filters...)
+}
+
+/*ListVdpaDevicesContext is ListVdpaDevices with a context */
+func ListVdpaDevicesContext(ctx context.Context, filters ...VdpaDeviceFilter) ([]VdpaDevice, error) {
+	data, err := mgmtDevFilterAttrs(filters)
 	if err != nil {
 		return nil, err
 	}
 
-	vdpaDevs, err := parseDevLinkVdpaDevList(msgs)
+	msgs, err := runVdpaNetlinkCmd(ctx, VdpaCmdDevGet, syscall.NLM_F_DUMP, data)
+	if errors.Is(err, ErrGenlFamilyNotFound) {
+		return listVdpaDevicesSysfs(filters...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	vdpaDevs, err := parseDevLinkVdpaDevList(msgs, filters...)
 	if err != nil {
 		return nil, err
 	}
 	return vdpaDevs, nil
 }
 
-func parseDevLinkVdpaDevList(msgs [][]byte) ([]VdpaDevice, error) {
-	devices := make([]VdpaDevice, 0, len(msgs))
+func parseDevLinkVdpaDevList(msgs [][]byte, filters ...VdpaDeviceFilter) ([]VdpaDevice, error) {
+	devices := make([]*vdpaDev, 0, len(msgs))
 
 	for _, m := range msgs {
-		attrs, err := nl.ParseRouteAttr(m[nl.SizeofGenlmsg:])
+		attrs, err := parseGenlAttributes(m)
 		if err != nil {
 			return nil, err
 		}
@@ -232,10 +404,68 @@ func parseDevLinkVdpaDevList(msgs [][]byte) ([]VdpaDevice, error) {
 		if err = dev.parseAttributes(attrs); err != nil {
 			return nil, err
 		}
-		if err = dev.getBusInfo(); err != nil {
-			return nil, err
+		// Avoid the costly sysfs lookups for devices we are going to discard anyway
+		if !matchAttributes(dev, filters) {
+			continue
 		}
 		devices = append(devices, dev)
 	}
-	return devices, nil
+	return resolveBusInfo(devices, filters)
+}
+
+// resolveBusInfo populates the bus information of the devices and returns the
+// ones that match the filters. Each device requires several sysfs lookups, so
+// up to busInfoWorkers devices are resolved concurrently
+func resolveBusInfo(devices []*vdpaDev, filters []VdpaDeviceFilter) ([]VdpaDevice, error) {
+	matches := make([]bool, len(devices))
+	errs := make([]error, len(devices))
+	resolve := func(i int) {
+		if errs[i] = devices[i].getBusInfo(); errs[i] != nil {
+			return
+		}
+		matches[i], errs[i] = matchBusInfo(devices[i], filters)
+	}
+
+	workers := busInfoWorkers
+	if workers > len(devices) {
+		workers = len(devices)
+	}
+	if workers <= 1 {
+		for i := range devices {
+			resolve(i)
+		}
+	} else {
+		indexes := make(chan int)
+		var wg sync.WaitGroup
+		wg.Add(workers)
+		for w := 0; w < workers; w++ {
+			go func() {
+				defer wg.Done()
+				for i := range indexes {
+					resolve(i)
+				}
+			}()
+		}
+		for i := range devices {
+			indexes <- i
+		}
+		close(indexes)
+		wg.Wait()
+	}
+
+	matched := make([]*vdpaDev, 0, len(devices))
+	for i, dev := range devices {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if matches[i] {
+			matched = append(matched, dev)
+		}
+	}
+	attachLabels(matched)
+	result := make([]VdpaDevice, 0, len(matched))
+	for _, dev := range matched {
+		result = append(result, dev)
+	}
+	return result, nil
 }
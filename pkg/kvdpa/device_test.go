@@ -14,7 +14,7 @@ import (
 
 // Helper function for testing. It returns the information of a vdpadevice
 // in netlink message (as would have been returned by netlink itself)
-func vdpaDevToNlMessage(t *testing.T, devs ...VdpaDevice) [][]byte {
+func vdpaDevToNlMessage(t testing.TB, devs ...VdpaDevice) [][]byte {
 	nlOps := defaultNetlinkOps{}
 	attrs := make([][]*nl.RtAttr, len(devs))
 	for i, dev := range devs {
@@ -23,6 +23,17 @@ func vdpaDevToNlMessage(t *testing.T, devs ...VdpaDevice) [][]byte {
 		assert.Nil(t, err)
 		attr = append(attr, name)
 
+		if id := dev.DeviceID(); id != 0 {
+			devID, err := nlOps.NewAttribute(VdpaAttrDevID, id)
+			assert.Nil(t, err)
+			attr = append(attr, devID)
+		}
+		if id := dev.VendorID(); id != 0 {
+			vendorID, err := nlOps.NewAttribute(VdpaAttrDevVendorID, id)
+			assert.Nil(t, err)
+			attr = append(attr, vendorID)
+		}
+
 		if mgmtDev := dev.MgmtDev(); mgmtDev != nil {
 			name, err := nlOps.NewAttribute(VdpaAttrMgmtDevDevName, mgmtDev.DevName())
 			assert.Nil(t, err)
@@ -313,6 +324,16 @@ func TestVdpaDevGetByMgmt(t *testing.T) {
 		t.Run(fmt.Sprintf("%s_%s", "TestDevGetByMgmt", tt.name), func(t *testing.T) {
 			netLinkMock := &mocks.NetlinkOps{}
 			SetNetlinkOps(netLinkMock)
+			netLinkMock.On("NewAttribute",
+				VdpaAttrMgmtDevDevName,
+				tt.mgmtDevName).
+				Return(&nl.RtAttr{}, nil)
+			if tt.mgmtBusName != "" {
+				netLinkMock.On("NewAttribute",
+					VdpaAttrMgmtDevBusName,
+					tt.mgmtBusName).
+					Return(&nl.RtAttr{}, nil)
+			}
 			netLinkMock.On("RunVdpaNetlinkCmd",
 				VdpaCmdDevGet,
 				mock.MatchedBy(func(flags int) bool {
@@ -331,3 +352,262 @@ func TestVdpaDevGetByMgmt(t *testing.T) {
 		})
 	}
 }
+
+func TestVdpaDevListFilter(t *testing.T) {
+	vendorSim := uint32(0)
+	vendorMlx := uint32(0x15b3)
+	listResult := []VdpaDevice{
+		&vdpaDev{
+			name:     "vdpa0",
+			deviceID: VirtioIDNet,
+			vendorID: vendorMlx,
+			mgmtDev: &mgmtDev{
+				busName: "pci",
+				devName: "0000:01:01",
+			},
+		},
+		&vdpaDev{
+			name:     "vdpa1",
+			deviceID: VirtioIDNet,
+			vendorID: vendorMlx,
+			mgmtDev: &mgmtDev{
+				busName: "pci",
+				devName: "0000:01:02",
+			},
+		},
+		&vdpaDev{
+			name:     "vdpa2",
+			deviceID: VirtioIDNet,
+			mgmtDev: &mgmtDev{
+				devName: "vdpasim_net",
+			},
+		},
+		&vdpaDev{
+			name:     "vdpa3",
+			deviceID: VirtioIDBlock,
+			mgmtDev: &mgmtDev{
+				devName: "vdpasim_blk",
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		filters  []VdpaDeviceFilter
+		response []string
+	}{
+		{
+			name:     "No filter",
+			response: []string{"vdpa0", "vdpa1", "vdpa2", "vdpa3"},
+		},
+		{
+			name: "Management device",
+			filters: []VdpaDeviceFilter{
+				{MgmtBusName: "pci", MgmtDevName: "0000:01:02"},
+			},
+			response: []string{"vdpa1"},
+		},
+		{
+			name: "Device class",
+			filters: []VdpaDeviceFilter{
+				{DeviceID: VirtioIDBlock},
+			},
+			response: []string{"vdpa3"},
+		},
+		{
+			name: "Vendor ID",
+			filters: []VdpaDeviceFilter{
+				{VendorID: &vendorMlx},
+			},
+			response: []string{"vdpa0", "vdpa1"},
+		},
+		{
+			name: "Zero vendor ID and device class",
+			filters: []VdpaDeviceFilter{
+				{VendorID: &vendorSim, DeviceID: VirtioIDNet},
+			},
+			response: []string{"vdpa2"},
+		},
+		{
+			name: "Multiple filters",
+			filters: []VdpaDeviceFilter{
+				{VendorID: &vendorMlx},
+				{MgmtBusName: "pci", MgmtDevName: "0000:01:01"},
+			},
+			response: []string{"vdpa0"},
+		},
+		{
+			name: "Unbound driver",
+			filters: []VdpaDeviceFilter{
+				{Driver: VhostVdpaDriver},
+			},
+			response: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s_%s", "TestVdpaDevListFilter", tt.name), func(t *testing.T) {
+			netLinkMock := &mocks.NetlinkOps{}
+			SetNetlinkOps(netLinkMock)
+			netLinkMock.On("NewAttribute",
+				mock.AnythingOfType("int"),
+				mock.AnythingOfType("string")).
+				Return(&nl.RtAttr{}, nil)
+			netLinkMock.On("RunVdpaNetlinkCmd",
+				VdpaCmdDevGet,
+				mock.MatchedBy(func(flags int) bool {
+					return (flags|syscall.NLM_F_DUMP != 0)
+				}),
+				mock.AnythingOfType("[]*nl.RtAttr")).
+				Return(vdpaDevToNlMessage(t, listResult...), nil)
+
+			devs, err := ListVdpaDevices(tt.filters...)
+			assert.Nil(t, err)
+			names := []string{}
+			for _, dev := range devs {
+				names = append(names, dev.Name())
+			}
+			assert.Equal(t, tt.response, names)
+		})
+	}
+}
+
+func TestVdpaDevListBusInfo(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	pf := sysfs.addPCIDevice(t, "0000:65:00.0", 1)
+	vf := sysfs.addPCIDevice(t, "0000:65:00.2", 0)
+	sf := sysfs.addAuxiliaryDevice(t, pf, "mlx5_core.sf.2")
+	sysfs.addVdpaDevice(t, vf, "vdpa0", VhostVdpaDriver, 0)
+	sysfs.addVdpaDevice(t, sf, "vdpa1", VirtioVdpaDriver, 1)
+	sysfs.addVdpaDevice(t, "", "vdpa2", "", 2)
+
+	listResult := []VdpaDevice{
+		&vdpaDev{
+			name:    "vdpa0",
+			mgmtDev: &mgmtDev{busName: "pci", devName: "0000:65:00.2"},
+		},
+		&vdpaDev{
+			name:    "vdpa1",
+			mgmtDev: &mgmtDev{busName: "auxiliary", devName: "mlx5_core.sf.2"},
+		},
+		&vdpaDev{
+			name:    "vdpa2",
+			mgmtDev: &mgmtDev{devName: "vdpasim_net"},
+		},
+	}
+
+	numaNode := 1
+	noNumaNode := -1
+	tests := []struct {
+		name     string
+		filter   VdpaDeviceFilter
+		response []string
+	}{
+		{
+			name:     "No filter",
+			response: []string{"vdpa0", "vdpa1", "vdpa2"},
+		},
+		{
+			name:     "Driver",
+			filter:   VdpaDeviceFilter{Driver: VirtioVdpaDriver},
+			response: []string{"vdpa1"},
+		},
+		{
+			name:     "Parent PCI address of VF",
+			filter:   VdpaDeviceFilter{ParentPCIAddress: "0000:65:00.2"},
+			response: []string{"vdpa0"},
+		},
+		{
+			name:     "Parent PCI address of SF",
+			filter:   VdpaDeviceFilter{ParentPCIAddress: "0000:65:00.0"},
+			response: []string{"vdpa1"},
+		},
+		{
+			name:     "NUMA node",
+			filter:   VdpaDeviceFilter{NumaNode: &numaNode},
+			response: []string{"vdpa1"},
+		},
+		{
+			name:     "No NUMA node",
+			filter:   VdpaDeviceFilter{NumaNode: &noNumaNode},
+			response: []string{"vdpa2"},
+		},
+	}
+
+	for _, workers := range []int{1, 4} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s_%s_%d", "TestVdpaDevListBusInfo", tt.name, workers), func(t *testing.T) {
+				defer func(old int) { busInfoWorkers = old }(busInfoWorkers)
+				busInfoWorkers = workers
+				netLinkMock := &mocks.NetlinkOps{}
+				SetNetlinkOps(netLinkMock)
+				netLinkMock.On("RunVdpaNetlinkCmd",
+					VdpaCmdDevGet,
+					mock.MatchedBy(func(flags int) bool {
+						return (flags|syscall.NLM_F_DUMP != 0)
+					}),
+					mock.AnythingOfType("[]*nl.RtAttr")).
+					Return(vdpaDevToNlMessage(t, listResult...), nil)
+
+				devs, err := ListVdpaDevices(tt.filter)
+				assert.Nil(t, err)
+				names := []string{}
+				for _, dev := range devs {
+					names = append(names, dev.Name())
+					switch dev.Name() {
+					case "vdpa0":
+						assert.Equal(t, VhostVdpaDriver, dev.Driver())
+						assert.Equal(t, "vhost-vdpa-0", dev.VhostVdpa().Name())
+						assert.Equal(t, sysfs.path("dev", "vhost-vdpa-0"), dev.VhostVdpa().Path())
+					case "vdpa1":
+						assert.Equal(t, VirtioVdpaDriver, dev.Driver())
+						assert.Equal(t, "virtio1", dev.VirtioNet().Name())
+						assert.Equal(t, "eth1", dev.VirtioNet().NetDev())
+					case "vdpa2":
+						assert.Equal(t, "", dev.Driver())
+					}
+				}
+				assert.Equal(t, tt.response, names)
+			})
+		}
+	}
+}
+
+// BenchmarkVdpaDevList lists 1000 SF-based devices from a fake sysfs tree
+// resolving their sysfs information with different levels of parallelism
+func BenchmarkVdpaDevList(b *testing.B) {
+	const numDevices = 1000
+	sysfs := newFakeSysfs(b)
+	pf := sysfs.addPCIDevice(b, "0000:65:00.0", 0)
+	devs := make([]VdpaDevice, numDevices)
+	for i := 0; i < numDevices; i++ {
+		sfName := fmt.Sprintf("mlx5_core.sf.%d", i)
+		name := fmt.Sprintf("vdpa%d", i)
+		driver := VhostVdpaDriver
+		if i%2 == 1 {
+			driver = VirtioVdpaDriver
+		}
+		sysfs.addVdpaDevice(b, sysfs.addAuxiliaryDevice(b, pf, sfName), name, driver, i)
+		devs[i] = &vdpaDev{
+			name:    name,
+			mgmtDev: &mgmtDev{busName: "auxiliary", devName: sfName},
+		}
+	}
+	msgs := vdpaDevToNlMessage(b, devs...)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			defer func(old int) { busInfoWorkers = old }(busInfoWorkers)
+			busInfoWorkers = workers
+			for i := 0; i < b.N; i++ {
+				devs, err := parseDevLinkVdpaDevList(msgs)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(devs) != numDevices {
+					b.Fatalf("expected %d devices, got %d", numDevices, len(devs))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package kvdpa
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// OperationKind is the kind of change a mutating call performs
+type OperationKind int
+
+const (
+	// OperationNetlink is a vdpa generic netlink command
+	OperationNetlink OperationKind = iota
+	// OperationSysfsWrite is a write to a sysfs file
+	OperationSysfsWrite
+)
+
+// vdpaCommandNames are the kernel names of the vdpa commands
+var vdpaCommandNames = map[uint8]string{
+	VdpaCmdMgmtDevNew:   "VDPA_CMD_MGMTDEV_NEW",
+	VdpaCmdMgmtDevGet:   "VDPA_CMD_MGMTDEV_GET",
+	VdpaCmdDevNew:       "VDPA_CMD_DEV_NEW",
+	VdpaCmdDevDel:       "VDPA_CMD_DEV_DEL",
+	VdpaCmdDevGet:       "VDPA_CMD_DEV_GET",
+	VdpaCmdDevConfigGet: "VDPA_CMD_DEV_CONFIG_GET",
+	VdpaCmdDevVstatsGet: "VDPA_CMD_DEV_VSTATS_GET",
+	VdpaCmdDevAttrSet:   "VDPA_CMD_DEV_ATTR_SET",
+}
+
+// vdpaAttrNames are the kernel names of the vdpa attributes
+var vdpaAttrNames = map[uint16]string{
+	VdpaAttrMgmtDevBusName:          "VDPA_ATTR_MGMTDEV_BUS_NAME",
+	VdpaAttrMgmtDevDevName:          "VDPA_ATTR_MGMTDEV_DEV_NAME",
+	VdpaAttrMgmtDevSupportedClasses: "VDPA_ATTR_MGMTDEV_SUPPORTED_CLASSES",
+	VdpaAttrDevName:                 "VDPA_ATTR_DEV_NAME",
+	VdpaAttrDevID:                   "VDPA_ATTR_DEV_ID",
+	VdpaAttrDevVendorID:             "VDPA_ATTR_DEV_VENDOR_ID",
+	VdpaAttrDevMaxVqs:               "VDPA_ATTR_DEV_MAX_VQS",
+	VdpaAttrDevMaxVqSize:            "VDPA_ATTR_DEV_MAX_VQ_SIZE",
+	VdpaAttrDevMinVqSize:            "VDPA_ATTR_DEV_MIN_VQ_SIZE",
+	VdpaAttrDevNetCfgMacAddr:        "VDPA_ATTR_DEV_NET_CFG_MACADDR",
+	VdpaAttrDevNetStatus:            "VDPA_ATTR_DEV_NET_STATUS",
+	VdpaAttrDevNetCfgMaxVqp:         "VDPA_ATTR_DEV_NET_CFG_MAX_VQP",
+	VdpaAttrGetNetCfgMTU:            "VDPA_ATTR_DEV_NET_CFG_MTU",
+	VdpaAttrDevNegotiatedFeatures:   "VDPA_ATTR_DEV_NEGOTIATED_FEATURES",
+	VdpaAttrDevMgmtDevMaxVqs:        "VDPA_ATTR_DEV_MGMTDEV_MAX_VQS",
+	VdpaAttrDevSupportedFeatures:    "VDPA_ATTR_DEV_SUPPORTED_FEATURES",
+	VdpaAttrDevQueueIndex:           "VDPA_ATTR_DEV_QUEUE_INDEX",
+	VdpaAttrDevVendorAttrName:       "VDPA_ATTR_DEV_VENDOR_ATTR_NAME",
+	VdpaAttrDevVendorAttrValue:      "VDPA_ATTR_DEV_VENDOR_ATTR_VALUE",
+	VdpaAttrDevFeatures:             "VDPA_ATTR_DEV_FEATURES",
+}
+
+// OperationAttr is a decoded netlink attribute of an Operation
+type OperationAttr struct {
+	Type uint16
+	// Name is the kernel name of the attribute (e.g: VDPA_ATTR_DEV_NAME)
+	Name string
+	// Value is the decoded value: a string, an unsigned integer,
+	// a net.HardwareAddr or the raw bytes of unknown attributes
+	Value interface{}
+}
+
+// Operation is a change that a mutating call performs: either a netlink
+// command or a sysfs write
+type Operation struct {
+	Kind OperationKind
+	// Command, Flags and Attributes are set for netlink commands
+	Command    uint8
+	Flags      int
+	Attributes []OperationAttr
+	// Path and Value are set for sysfs writes
+	Path  string
+	Value string
+}
+
+// String returns a printable form of the operation
+func (o Operation) String() string {
+	if o.Kind == OperationSysfsWrite {
+		return fmt.Sprintf("write %q to %s", o.Value, o.Path)
+	}
+	name, ok := vdpaCommandNames[o.Command]
+	if !ok {
+		name = fmt.Sprintf("command %d", o.Command)
+	}
+	parts := []string{"netlink " + name}
+	for _, attr := range o.Attributes {
+		if s, ok := attr.Value.(string); ok {
+			parts = append(parts, fmt.Sprintf("%s=%q", attr.Name, s))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s=%v", attr.Name, attr.Value))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// decodeAttr decodes a request attribute
+func decodeAttr(attr *nl.RtAttr) OperationAttr {
+	decoded := OperationAttr{Type: attr.Type, Name: vdpaAttrNames[attr.Type], Value: attr.Data}
+	if decoded.Name == "" {
+		decoded.Name = fmt.Sprintf("attr%d", attr.Type)
+	}
+	native := nl.NativeEndian()
+	switch attr.Type {
+	case VdpaAttrMgmtDevBusName, VdpaAttrMgmtDevDevName, VdpaAttrDevName, VdpaAttrDevVendorAttrName:
+		decoded.Value = attrString(attr.Data)
+	case VdpaAttrDevNetCfgMacAddr:
+		decoded.Value = net.HardwareAddr(attr.Data)
+	case VdpaAttrDevNetStatus:
+		if len(attr.Data) == 1 {
+			decoded.Value = attr.Data[0]
+		}
+	default:
+		switch len(attr.Data) {
+		case 2:
+			decoded.Value = native.Uint16(attr.Data)
+		case 4:
+			decoded.Value = native.Uint32(attr.Data)
+		case 8:
+			decoded.Value = native.Uint64(attr.Data)
+		}
+	}
+	return decoded
+}
+
+// DryRun collects the operations that the mutating calls (AddVdpaDevice,
+// DeleteVdpaDevice, SetVdpaDeviceMacAddr, BindVdpaDevice and
+// UnbindVdpaDevice) would have performed. The calls whose context carries a
+// DryRun (see WithDryRun) validate their inputs, record their operations and
+// return without performing them. Read-only calls are not affected
+type DryRun struct {
+	mu         sync.Mutex
+	operations []Operation
+}
+
+// NewDryRun returns an empty DryRun
+func NewDryRun() *DryRun {
+	return &DryRun{}
+}
+
+// Operations returns the operations recorded so far
+func (d *DryRun) Operations() []Operation {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Operation{}, d.operations...)
+}
+
+// String returns the recorded operations, one per line
+func (d *DryRun) String() string {
+	var b strings.Builder
+	for _, op := range d.Operations() {
+		b.WriteString(op.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func (d *DryRun) add(op Operation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.operations = append(d.operations, op)
+}
+
+type dryRunKey struct{}
+
+// WithDryRun returns a context that makes the mutating calls run with it
+// record their operations in d instead of performing them
+func WithDryRun(ctx context.Context, d *DryRun) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, d)
+}
+
+// getDryRun returns the DryRun of the context, if any
+func getDryRun(ctx context.Context) *DryRun {
+	d, _ := ctx.Value(dryRunKey{}).(*DryRun)
+	return d
+}
+
+// runMutatingCmd runs a vdpa netlink command that modifies devices, unless
+// the context carries a DryRun
+func runMutatingCmd(ctx context.Context, command uint8, flags int, data []*nl.RtAttr) error {
+	if d := getDryRun(ctx); d != nil {
+		op := Operation{Kind: OperationNetlink, Command: command, Flags: flags}
+		for _, attr := range data {
+			op.Attributes = append(op.Attributes, decodeAttr(attr))
+		}
+		d.add(op)
+		return nil
+	}
+	_, err := runVdpaNetlinkCmd(ctx, command, flags, data)
+	return err
+}
+
+// writeSysfs writes a sysfs file, unless the context carries a DryRun
+func writeSysfs(ctx context.Context, path, value string) error {
+	if d := getDryRun(ctx); d != nil {
+		d.add(Operation{Kind: OperationSysfsWrite, Path: path, Value: value})
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(value), 0200)
+}
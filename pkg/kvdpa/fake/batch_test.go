@@ -0,0 +1,100 @@
+package fake_test
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/fake"
+)
+
+var batchSpecs = []kvdpa.DeviceSpec{
+	{Name: "vdpa0", MgmtDev: "pci/0000:65:00.2", Driver: kvdpa.VhostVdpaDriver},
+	{Name: "vdpa1", MgmtDev: "pci/0000:65:00.2", Config: &kvdpa.VdpaNetConfig{MTU: 9000}},
+	{Name: "vdpa2", MgmtDev: "auxiliary/mlx5_core.sf.1", Driver: kvdpa.VirtioVdpaDriver},
+	{Name: "vdpa3", MgmtDev: "auxiliary/mlx5_core.sf.1", Driver: kvdpa.VhostVdpaDriver},
+}
+
+func TestCreateVdpaDevices(t *testing.T) {
+	k := newKernel(t)
+	k.AutoprobeDriver = kvdpa.VirtioVdpaDriver
+
+	require.NoError(t, kvdpa.CreateVdpaDevices(batchSpecs))
+	require.NoError(t, k.Sync())
+	devs := k.Devices()
+	require.Len(t, devs, 4)
+	assert.Equal(t, kvdpa.VhostVdpaDriver, devs[0].Driver)
+	assert.Equal(t, uint16(9000), devs[1].MTU)
+	assert.Equal(t, kvdpa.VirtioVdpaDriver, devs[1].Driver)
+	assert.Equal(t, kvdpa.VirtioVdpaDriver, devs[2].Driver)
+	assert.Equal(t, kvdpa.VhostVdpaDriver, devs[3].Driver)
+
+	// Invalid specs are rejected before anything is created
+	err := kvdpa.CreateVdpaDevices([]kvdpa.DeviceSpec{
+		{Name: "vdpa4", MgmtDev: "pci/0000:65:00.2"},
+		{Name: "vdpa4", MgmtDev: "pci/0000:65:00.2"},
+	})
+	assert.ErrorIs(t, err, syscall.EINVAL)
+	assert.Len(t, k.Devices(), 4)
+}
+
+func TestCreateVdpaDevicesRollback(t *testing.T) {
+	k := newKernel(t)
+	ops := fake.NewFaultyOps(k)
+	recorder := kvdpa.NewRecordingNetlinkOps(ops, "")
+	kvdpa.SetNetlinkOps(recorder)
+
+	// The third device cannot be created
+	ops.Inject(fake.Fault{Command: kvdpa.VdpaCmdDevNew, After: 2, Times: 1, Err: syscall.ENOSPC})
+	err := kvdpa.CreateVdpaDevices(batchSpecs)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	var batchErr *kvdpa.BatchError
+	require.True(t, errors.As(err, &batchErr))
+	assert.Equal(t, "vdpa2", batchErr.Device)
+	assert.Empty(t, batchErr.RollbackErrors)
+	assert.Empty(t, k.Devices())
+
+	// The devices were deleted in reverse order
+	deleted := []string{}
+	for _, exchange := range recorder.Fixture().Exchanges {
+		if exchange.Command == kvdpa.VdpaCmdDevDel {
+			deleted = append(deleted, string(exchange.Request[0].Data[:len(exchange.Request[0].Data)-1]))
+		}
+	}
+	assert.Equal(t, []string{"vdpa1", "vdpa0"}, deleted)
+
+	// The binding fails and so does the rollback of the first device
+	ops.Clear()
+	ops.Inject(fake.Fault{Command: kvdpa.VdpaCmdDevGet, Times: 1, Err: syscall.EIO})
+	ops.Inject(fake.Fault{Command: kvdpa.VdpaCmdDevDel, After: 1, Err: syscall.EBUSY})
+	err = kvdpa.CreateVdpaDevices([]kvdpa.DeviceSpec{
+		{Name: "vdpa0", MgmtDev: "pci/0000:65:00.2"},
+		{Name: "vdpa1", MgmtDev: "pci/0000:65:00.2", Driver: kvdpa.VhostVdpaDriver},
+	})
+	assert.ErrorIs(t, err, syscall.EIO)
+	require.True(t, errors.As(err, &batchErr))
+	assert.Equal(t, "vdpa1", batchErr.Device)
+	require.Len(t, batchErr.RollbackErrors, 1)
+	assert.ErrorIs(t, batchErr.RollbackErrors[0], syscall.EBUSY)
+	assert.Contains(t, err.Error(), "rollback failed: deleting vdpa0")
+	devs := k.Devices()
+	require.Len(t, devs, 1)
+	assert.Equal(t, "vdpa0", devs[0].Name)
+
+	// The creation is interrupted after the kernel created the device
+	ops.Clear()
+	require.NoError(t, kvdpa.ForceDeleteVdpaDevice("vdpa0"))
+	ops.Inject(fake.Fault{Command: kvdpa.VdpaCmdDevNew, After: 1, Times: 1, Err: context.DeadlineExceeded, Applied: true})
+	err = kvdpa.CreateVdpaDevices(batchSpecs[:3])
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	require.True(t, errors.As(err, &batchErr))
+	assert.Equal(t, "vdpa1", batchErr.Device)
+	assert.Empty(t, batchErr.RollbackErrors)
+	assert.Empty(t, k.Devices())
+}
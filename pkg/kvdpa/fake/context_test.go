@@ -0,0 +1,75 @@
+package fake_test
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/fake"
+)
+
+func TestContextCancellation(t *testing.T) {
+	k := newKernel(t)
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa0"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := kvdpa.ListVdpaDevicesContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = kvdpa.GetVdpaDeviceContext(ctx, "vdpa0")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = kvdpa.ListVdpaMgmtDevicesContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, kvdpa.AddVdpaDeviceContext(ctx, "pci/0000:65:00.2", "vdpa1"), context.Canceled)
+	assert.ErrorIs(t, kvdpa.DeleteVdpaDeviceContext(ctx, "vdpa0"), context.Canceled)
+	require.Len(t, k.Devices(), 1)
+
+	// Nothing is left behind by a cancelled batch
+	err = kvdpa.CreateVdpaDevicesContext(ctx, batchSpecs)
+	assert.ErrorIs(t, err, context.Canceled)
+	require.Len(t, k.Devices(), 1)
+
+	// The steps of a plan are not applied once the context is done
+	plan, err := kvdpa.PlanReconcile(&kvdpa.DesiredState{Devices: []kvdpa.DesiredDevice{
+		{Name: "vdpa1", MgmtDev: "pci/0000:65:00.2"},
+		{Name: "vdpa2", MgmtDev: "auxiliary/mlx5_core.sf.1"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, plan.Steps, 2)
+	for _, result := range kvdpa.ApplyPlanContext(ctx, plan) {
+		assert.ErrorIs(t, result.Err, context.Canceled)
+	}
+	require.Len(t, k.Devices(), 1)
+}
+
+func TestContextThroughNetlinkOps(t *testing.T) {
+	k := newKernel(t)
+	faulty := fake.NewFaultyOps(k)
+	faulty.Inject(fake.Fault{Command: kvdpa.VdpaCmdDevGet, Delay: time.Hour})
+	pcap, err := kvdpa.NewPcapNetlinkOps(faulty, ioutil.Discard)
+	require.NoError(t, err)
+	recorder := kvdpa.NewRecordingNetlinkOps(faulty, "")
+
+	// The commands are cut short by the context
+	for _, ops := range []kvdpa.NetlinkOps{faulty, pcap, recorder} {
+		kvdpa.SetNetlinkOps(ops)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		start := time.Now()
+		_, err := kvdpa.ListVdpaDevicesContext(ctx)
+		cancel()
+		assert.ErrorIs(t, err, context.DeadlineExceeded, "%T", ops)
+		assert.Less(t, time.Since(start), time.Second, "%T", ops)
+	}
+	assert.Empty(t, recorder.Fixture().Exchanges)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	kvdpa.SetNetlinkOps(kvdpa.NewReplayNetlinkOps(recorder.Fixture()))
+	_, err = kvdpa.ListVdpaDevicesContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,310 @@
+package fake_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/fake"
+)
+
+// newKernel returns an installed simulated kernel with a PCI management
+// device (a VF) and an auxiliary one (a SF)
+func newKernel(t *testing.T) *fake.Kernel {
+	k, err := fake.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, k.AddMgmtDev(fake.MgmtDev{
+		BusName:  "pci",
+		DevName:  "0000:65:00.2",
+		NumaNode: 1,
+		VendorID: 0x15b3,
+	}))
+	require.NoError(t, k.AddMgmtDev(fake.MgmtDev{
+		BusName:          "auxiliary",
+		DevName:          "mlx5_core.sf.1",
+		ParentPCIAddress: "0000:65:00.0",
+		VendorID:         0x15b3,
+	}))
+	t.Cleanup(k.Install())
+	return k
+}
+
+func TestDeviceLifecycle(t *testing.T) {
+	k := newKernel(t)
+
+	mgmtDevs, err := kvdpa.ListVdpaMgmtDevices()
+	require.NoError(t, err)
+	require.Len(t, mgmtDevs, 2)
+	assert.Equal(t, "pci/0000:65:00.2", mgmtDevs[0].Name())
+	assert.Equal(t, "auxiliary/mlx5_core.sf.1", mgmtDevs[1].Name())
+
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa0"))
+	require.NoError(t, kvdpa.AddVdpaDevice("auxiliary/mlx5_core.sf.1", "vdpa1"))
+
+	dev, err := kvdpa.GetVdpaDevice("vdpa0")
+	require.NoError(t, err)
+	assert.Equal(t, "", dev.Driver())
+	assert.Equal(t, "pci/0000:65:00.2", dev.MgmtDev().Name())
+	assert.Equal(t, kvdpa.VirtioIDNet, dev.DeviceID())
+	assert.Equal(t, uint32(0x15b3), dev.VendorID())
+
+	// vhost-vdpa
+	require.NoError(t, kvdpa.BindVdpaDevice("vdpa0", kvdpa.VhostVdpaDriver))
+	dev, err = kvdpa.GetVdpaDevice("vdpa0")
+	require.NoError(t, err)
+	assert.Equal(t, kvdpa.VhostVdpaDriver, dev.Driver())
+	require.NotNil(t, dev.VhostVdpa())
+	assert.Equal(t, "vhost-vdpa-0", dev.VhostVdpa().Name())
+	assert.Equal(t, filepath.Join(k.DevfsRoot(), "vhost-vdpa-0"), dev.VhostVdpa().Path())
+
+	// virtio
+	require.NoError(t, kvdpa.BindVdpaDevice("vdpa1", kvdpa.VirtioVdpaDriver))
+	dev, err = kvdpa.GetVdpaDevice("vdpa1")
+	require.NoError(t, err)
+	assert.Equal(t, kvdpa.VirtioVdpaDriver, dev.Driver())
+	require.NotNil(t, dev.VirtioNet())
+	assert.Equal(t, "virtio1", dev.VirtioNet().Name())
+	assert.Equal(t, "eth1", dev.VirtioNet().NetDev())
+
+	simDev, ok := k.Device("vdpa1")
+	require.True(t, ok)
+	assert.Equal(t, fake.VirtioNetStatusLinkUp, simDev.Status&fake.VirtioNetStatusLinkUp)
+
+	// Filters
+	devs, err := kvdpa.ListVdpaDevices(kvdpa.VdpaDeviceFilter{Driver: kvdpa.VirtioVdpaDriver})
+	require.NoError(t, err)
+	require.Len(t, devs, 1)
+	assert.Equal(t, "vdpa1", devs[0].Name())
+	devs, err = kvdpa.ListVdpaDevices(kvdpa.VdpaDeviceFilter{ParentPCIAddress: "0000:65:00.0"})
+	require.NoError(t, err)
+	require.Len(t, devs, 1)
+	assert.Equal(t, "vdpa1", devs[0].Name())
+	numaNode := 1
+	devs, err = kvdpa.ListVdpaDevices(kvdpa.VdpaDeviceFilter{NumaNode: &numaNode})
+	require.NoError(t, err)
+	require.Len(t, devs, 1)
+	assert.Equal(t, "vdpa0", devs[0].Name())
+
+	// Unbind and delete
+	require.NoError(t, kvdpa.UnbindVdpaDevice("vdpa0"))
+	dev, err = kvdpa.GetVdpaDevice("vdpa0")
+	require.NoError(t, err)
+	assert.Equal(t, "", dev.Driver())
+	assert.NoFileExists(t, filepath.Join(k.DevfsRoot(), "vhost-vdpa-0"))
+
+	require.NoError(t, kvdpa.DeleteVdpaDevice("vdpa0"))
+	require.NoError(t, kvdpa.DeleteVdpaDevice("vdpa1"))
+	_, err = kvdpa.GetVdpaDevice("vdpa1")
+	assert.ErrorIs(t, err, syscall.ENODEV)
+	devs, err = kvdpa.ListVdpaDevices()
+	require.NoError(t, err)
+	assert.Empty(t, devs)
+	assert.Empty(t, k.Devices())
+}
+
+func TestDeviceErrors(t *testing.T) {
+	k := newKernel(t)
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa0"))
+
+	tests := []struct {
+		name string
+		run  func() error
+		err  error
+	}{
+		{
+			name: "add on unknown mgmtdev",
+			run:  func() error { return kvdpa.AddVdpaDevice("pci/0000:66:00.2", "vdpa1") },
+			err:  syscall.ENODEV,
+		},
+		{
+			name: "add existing device",
+			run:  func() error { return kvdpa.AddVdpaDevice("auxiliary/mlx5_core.sf.1", "vdpa0") },
+			err:  syscall.EEXIST,
+		},
+		{
+			name: "delete unknown device",
+			run:  func() error { return kvdpa.DeleteVdpaDevice("vdpa1") },
+			err:  syscall.ENODEV,
+		},
+		{
+			name: "bind unknown device",
+			run:  func() error { return kvdpa.BindVdpaDevice("vdpa1", kvdpa.VhostVdpaDriver) },
+			err:  syscall.ENODEV,
+		},
+		{
+			name: "unbind unknown device",
+			run:  func() error { return kvdpa.UnbindVdpaDevice("vdpa1") },
+			err:  syscall.ENODEV,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, tt.run(), tt.err)
+		})
+	}
+	assert.Len(t, k.Devices(), 1)
+}
+
+func TestDryRun(t *testing.T) {
+	k := newKernel(t)
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa0"))
+	require.NoError(t, kvdpa.BindVdpaDevice("vdpa0", kvdpa.VhostVdpaDriver))
+
+	dryRun := kvdpa.NewDryRun()
+	ctx := kvdpa.WithDryRun(context.Background(), dryRun)
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	require.NoError(t, kvdpa.AddVdpaDeviceContext(ctx, "auxiliary/mlx5_core.sf.1", "vdpa1"))
+	require.NoError(t, kvdpa.SetVdpaDeviceMacAddrContext(ctx, "vdpa0", mac))
+	require.NoError(t, kvdpa.UnbindVdpaDeviceContext(ctx, "vdpa0"))
+	require.NoError(t, kvdpa.DeleteVdpaDeviceContext(ctx, "vdpa0"))
+
+	// Inputs are validated against the current state
+	assert.ErrorIs(t, kvdpa.AddVdpaDeviceContext(ctx, "pci/0000:65:00.2", "vdpa0"), syscall.EEXIST)
+	assert.ErrorIs(t, kvdpa.AddVdpaDeviceContext(ctx, "pci/0000:66:00.2", "vdpa2"), syscall.ENODEV)
+	assert.ErrorIs(t, kvdpa.AddVdpaDeviceContext(ctx, "pci/0000:65:00.2", "../vdpa2"), syscall.EINVAL)
+	assert.ErrorIs(t, kvdpa.DeleteVdpaDeviceContext(ctx, "vdpa2"), syscall.ENODEV)
+	assert.ErrorIs(t, kvdpa.SetVdpaDeviceMacAddrContext(ctx, "vdpa0", mac[:4]), syscall.EINVAL)
+	assert.ErrorIs(t, kvdpa.BindVdpaDeviceContext(ctx, "vdpa2", kvdpa.VirtioVdpaDriver), syscall.ENODEV)
+	assert.Error(t, kvdpa.BindVdpaDeviceContext(ctx, "vdpa0", "unknown_driver"))
+
+	ops := dryRun.Operations()
+	require.Len(t, ops, 4)
+	assert.Equal(t, kvdpa.OperationNetlink, ops[0].Kind)
+	assert.Equal(t, kvdpa.VdpaCmdDevNew, ops[0].Command)
+	assert.Equal(t, []kvdpa.OperationAttr{
+		{Type: kvdpa.VdpaAttrMgmtDevBusName, Name: "VDPA_ATTR_MGMTDEV_BUS_NAME", Value: "auxiliary"},
+		{Type: kvdpa.VdpaAttrMgmtDevDevName, Name: "VDPA_ATTR_MGMTDEV_DEV_NAME", Value: "mlx5_core.sf.1"},
+		{Type: kvdpa.VdpaAttrDevName, Name: "VDPA_ATTR_DEV_NAME", Value: "vdpa1"},
+	}, ops[0].Attributes)
+	assert.Equal(t, mac, ops[1].Attributes[1].Value)
+	assert.Equal(t, kvdpa.OperationSysfsWrite, ops[2].Kind)
+	assert.Equal(t, filepath.Join(k.SysfsRoot(), "bus/vdpa/drivers", kvdpa.VhostVdpaDriver, "unbind"), ops[2].Path)
+	assert.Equal(t, "vdpa0", ops[2].Value)
+	assert.Equal(t, `netlink VDPA_CMD_DEV_NEW VDPA_ATTR_MGMTDEV_BUS_NAME="auxiliary" `+
+		`VDPA_ATTR_MGMTDEV_DEV_NAME="mlx5_core.sf.1" VDPA_ATTR_DEV_NAME="vdpa1"
+netlink VDPA_CMD_DEV_ATTR_SET VDPA_ATTR_DEV_NAME="vdpa0" VDPA_ATTR_DEV_NET_CFG_MACADDR=02:00:00:00:00:01
+write "vdpa0" to `+ops[2].Path+`
+netlink VDPA_CMD_DEV_DEL VDPA_ATTR_DEV_NAME="vdpa0"
+`, dryRun.String())
+
+	// Nothing was performed
+	devs := k.Devices()
+	require.Len(t, devs, 1)
+	assert.Equal(t, kvdpa.VhostVdpaDriver, devs[0].Driver)
+	assert.Empty(t, devs[0].MAC)
+
+	// The calls without the context are performed
+	require.NoError(t, kvdpa.AddVdpaDevice("auxiliary/mlx5_core.sf.1", "vdpa1"))
+	assert.Len(t, k.Devices(), 2)
+	assert.Len(t, dryRun.Operations(), 4)
+}
+
+func TestAutoprobe(t *testing.T) {
+	k := newKernel(t)
+	k.AutoprobeDriver = kvdpa.VhostVdpaDriver
+
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa0"))
+	dev, err := kvdpa.GetVdpaDevice("vdpa0")
+	require.NoError(t, err)
+	assert.Equal(t, kvdpa.VhostVdpaDriver, dev.Driver())
+	require.NotNil(t, dev.VhostVdpa())
+}
+
+func TestSysfsFallback(t *testing.T) {
+	k := newKernel(t)
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa0"))
+	require.NoError(t, k.Bind("vdpa0", kvdpa.VirtioVdpaDriver))
+
+	// Older kernels without the vdpa family
+	kvdpa.SetNetlinkOps(noFamilyOps{k})
+	dev, err := kvdpa.GetVdpaDevice("vdpa0")
+	require.NoError(t, err)
+	assert.Equal(t, "pci/0000:65:00.2", dev.MgmtDev().Name())
+	assert.Equal(t, kvdpa.VirtioIDNet, dev.DeviceID())
+	assert.Equal(t, uint32(0x15b3), dev.VendorID())
+	assert.Equal(t, "eth0", dev.VirtioNet().NetDev())
+}
+
+// noFamilyOps simulates a kernel without the vdpa generic netlink family
+type noFamilyOps struct {
+	*fake.Kernel
+}
+
+func (noFamilyOps) RunVdpaNetlinkCmd(uint8, int, []*nl.RtAttr) ([][]byte, error) {
+	return nil, kvdpa.ErrGenlFamilyNotFound
+}
+
+func TestInventory(t *testing.T) {
+	newKernel(t)
+
+	inv := kvdpa.NewInventory(0)
+	var mu sync.Mutex
+	var events []kvdpa.InventoryEvent
+	inv.Subscribe(func(ev kvdpa.InventoryEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- inv.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor := func(eventType kvdpa.InventoryEventType, check func(kvdpa.VdpaDevice) bool) {
+		t.Helper()
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, ev := range events {
+				if ev.Type == eventType && ev.Device != nil && check(ev.Device) {
+					return true
+				}
+			}
+			return false
+		}, 5*time.Second, 10*time.Millisecond, "waiting for %s", eventType)
+	}
+
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa0"))
+	waitFor(kvdpa.DeviceAdded, func(dev kvdpa.VdpaDevice) bool { return dev.Name() == "vdpa0" })
+
+	require.NoError(t, kvdpa.BindVdpaDevice("vdpa0", kvdpa.VhostVdpaDriver))
+	// Bind requests are processed with the next netlink request
+	_, err := kvdpa.ListVdpaMgmtDevices()
+	require.NoError(t, err)
+	waitFor(kvdpa.DeviceUpdated, func(dev kvdpa.VdpaDevice) bool { return dev.VhostVdpa() != nil })
+
+	require.NoError(t, kvdpa.DeleteVdpaDevice("vdpa0"))
+	waitFor(kvdpa.DeviceRemoved, func(dev kvdpa.VdpaDevice) bool { return dev.Name() == "vdpa0" })
+}
+
+func TestCapabilities(t *testing.T) {
+	k := newKernel(t)
+
+	caps, err := kvdpa.Capabilities()
+	require.NoError(t, err)
+	assert.True(t, caps.Create)
+	assert.True(t, caps.VStats)
+	assert.True(t, caps.FeatureProvisioning)
+
+	// An older kernel
+	k.Commands = []uint8{kvdpa.VdpaCmdMgmtDevGet, kvdpa.VdpaCmdDevGet}
+	k.MaxAttr = kvdpa.VdpaAttrDevMaxVqSize
+	caps, err = kvdpa.Capabilities()
+	require.NoError(t, err)
+	assert.False(t, caps.Create)
+	assert.False(t, caps.FeatureProvisioning)
+	assert.ErrorIs(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa0"), syscall.EOPNOTSUPP)
+}
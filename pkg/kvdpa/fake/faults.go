@@ -0,0 +1,172 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+)
+
+// Fault is a failure injected into the netlink commands
+type Fault struct {
+	// Command is the command the fault applies to. Zero (VdpaCmdUnspec)
+	// matches every command
+	Command uint8
+	// After is the number of matching commands that run normally before
+	// the fault is injected
+	After int
+	// Times is the number of matching commands the fault is injected into.
+	// Zero means every matching command
+	Times int
+
+	// Err is returned instead of running the command, e.g: syscall.EBUSY,
+	// syscall.EAGAIN or kvdpa.ErrDumpInterrupted
+	Err error
+	// Truncate, if positive, truncates every response message to at most
+	// that many bytes
+	Truncate int
+	// Delay is how long the command takes to answer
+	Delay time.Duration
+	// Applied runs the command before returning Err, like a command whose
+	// answer is lost
+	Applied bool
+}
+
+// FaultyOps is a kvdpa.NetlinkOps decorator that injects the scripted faults
+// into the commands it forwards
+type FaultyOps struct {
+	ops kvdpa.NetlinkOps
+
+	mu     sync.Mutex
+	faults []*scriptedFault
+	calls  map[uint8]int
+}
+
+type scriptedFault struct {
+	Fault
+	seen     int
+	injected int
+}
+
+// NewFaultyOps returns a FaultyOps that forwards the commands to ops
+func NewFaultyOps(ops kvdpa.NetlinkOps) *FaultyOps {
+	return &FaultyOps{
+		ops:   ops,
+		calls: map[uint8]int{},
+	}
+}
+
+// Inject adds a fault. When several faults match a command, the first one
+// added that is still active is injected
+func (f *FaultyOps) Inject(fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &scriptedFault{Fault: fault})
+}
+
+// Clear removes all the faults
+func (f *FaultyOps) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = nil
+}
+
+// Calls returns how many times a command has been run
+func (f *FaultyOps) Calls(command uint8) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[command]
+}
+
+// GetVdpaFamily forwards the request if the NetlinkOps support it
+func (f *FaultyOps) GetVdpaFamily() (*netlink.GenlFamily, error) {
+	familyOps, ok := f.ops.(kvdpa.FamilyNetlinkOps)
+	if !ok {
+		return nil, errors.New("the netlink operations do not give the vdpa family")
+	}
+	return familyOps.GetVdpaFamily()
+}
+
+// NewAttribute forwards the request
+func (f *FaultyOps) NewAttribute(attrType int, data interface{}) (*nl.RtAttr, error) {
+	return f.ops.NewAttribute(attrType, data)
+}
+
+// RunVdpaNetlinkCmd runs the command, injecting the matching fault, if any
+func (f *FaultyOps) RunVdpaNetlinkCmd(command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	return f.RunVdpaNetlinkCmdContext(context.Background(), command, flags, data)
+}
+
+// RunVdpaNetlinkCmdContext is RunVdpaNetlinkCmd with a context, which also
+// cuts the injected delay short
+func (f *FaultyOps) RunVdpaNetlinkCmdContext(ctx context.Context, command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	fault := f.nextFault(command)
+	if fault == nil {
+		return runOpsCmd(ctx, f.ops, command, flags, data)
+	}
+
+	timer := time.NewTimer(fault.Delay)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		return nil, ctx.Err()
+	}
+	if fault.Err != nil {
+		if fault.Applied {
+			_, _ = runOpsCmd(context.Background(), f.ops, command, flags, data)
+		}
+		return nil, fault.Err
+	}
+	msgs, err := runOpsCmd(ctx, f.ops, command, flags, data)
+	if err != nil || fault.Truncate <= 0 {
+		return msgs, err
+	}
+	truncated := make([][]byte, 0, len(msgs))
+	for _, m := range msgs {
+		if len(m) > fault.Truncate {
+			m = m[:fault.Truncate]
+		}
+		truncated = append(truncated, m)
+	}
+	return truncated, nil
+}
+
+// runOpsCmd runs a command through ops with the context if they support it
+func runOpsCmd(ctx context.Context, ops kvdpa.NetlinkOps, command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctxOps, ok := ops.(kvdpa.ContextNetlinkOps); ok {
+		return ctxOps.RunVdpaNetlinkCmdContext(ctx, command, flags, data)
+	}
+	return ops.RunVdpaNetlinkCmd(command, flags, data)
+}
+
+// nextFault records a command call and returns the fault to inject, if any
+func (f *FaultyOps) nextFault(command uint8) *Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[command]++
+
+	var result *Fault
+	for _, fault := range f.faults {
+		if fault.Command != kvdpa.VdpaCmdUnspec && fault.Command != command {
+			continue
+		}
+		fault.seen++
+		if result != nil || fault.seen <= fault.After ||
+			(fault.Times > 0 && fault.injected >= fault.Times) {
+			continue
+		}
+		fault.injected++
+		injected := fault.Fault
+		result = &injected
+	}
+	return result
+}
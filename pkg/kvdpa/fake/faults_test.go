@@ -0,0 +1,131 @@
+package fake_test
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/fake"
+)
+
+// newFaultyKernel returns an installed simulated kernel with a device whose
+// netlink operations go through a FaultyOps
+func newFaultyKernel(t *testing.T) *fake.FaultyOps {
+	k := newKernel(t)
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa0"))
+	ops := fake.NewFaultyOps(k)
+	kvdpa.SetNetlinkOps(ops)
+	kvdpa.SetRetryPolicy(kvdpa.RetryPolicy{MaxAttempts: 3})
+	t.Cleanup(func() { kvdpa.SetRetryPolicy(kvdpa.DefaultRetryPolicy) })
+	return ops
+}
+
+func TestFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		faults []fake.Fault
+		run    func() error
+		// calls is the number of times the faulty command is run
+		calls int
+		err   error
+	}{
+		{
+			name:   "Transient errors are retried",
+			faults: []fake.Fault{{Command: kvdpa.VdpaCmdDevGet, Err: syscall.EBUSY, Times: 2}},
+			run:    listDevices,
+			calls:  3,
+		},
+		{
+			name:   "Interrupted dumps are retried",
+			faults: []fake.Fault{{Err: kvdpa.ErrDumpInterrupted, Times: 1}},
+			run:    listDevices,
+			calls:  2,
+		},
+		{
+			name:   "Persistent interrupted dumps",
+			faults: []fake.Fault{{Command: kvdpa.VdpaCmdDevGet, Err: kvdpa.ErrDumpInterrupted}},
+			run:    listDevices,
+			calls:  3,
+			err:    kvdpa.ErrDumpInterrupted,
+		},
+		{
+			name:   "Faults after some commands",
+			faults: []fake.Fault{{Command: kvdpa.VdpaCmdDevGet, Err: syscall.EPERM, After: 1}},
+			run: func() error {
+				if err := listDevices(); err != nil {
+					return err
+				}
+				return listDevices()
+			},
+			calls: 2,
+			err:   syscall.EPERM,
+		},
+		{
+			name:   "Truncated messages",
+			faults: []fake.Fault{{Command: kvdpa.VdpaCmdDevGet, Truncate: 10}},
+			run:    listDevices,
+			calls:  1,
+			err:    kvdpa.ErrMalformedMessage,
+		},
+		{
+			name:   "Truncated header",
+			faults: []fake.Fault{{Command: kvdpa.VdpaCmdDevGet, Truncate: 2}},
+			run: func() error {
+				_, err := kvdpa.GetVdpaDevice("vdpa0")
+				return err
+			},
+			calls: 1,
+			err:   kvdpa.ErrMalformedMessage,
+		},
+		{
+			name:   "Modifications are not retried",
+			faults: []fake.Fault{{Command: kvdpa.VdpaCmdDevDel, Err: syscall.EBUSY, Times: 1}},
+			run:    func() error { return kvdpa.DeleteVdpaDevice("vdpa0") },
+			calls:  1,
+			err:    syscall.EBUSY,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := newFaultyKernel(t)
+			for _, fault := range tt.faults {
+				ops.Inject(fault)
+			}
+			err := tt.run()
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			command := tt.faults[0].Command
+			if command == kvdpa.VdpaCmdUnspec {
+				command = kvdpa.VdpaCmdDevGet
+			}
+			assert.Equal(t, tt.calls, ops.Calls(command))
+		})
+	}
+}
+
+func TestFaultDelay(t *testing.T) {
+	ops := newFaultyKernel(t)
+	ops.Inject(fake.Fault{Command: kvdpa.VdpaCmdDevGet, Delay: 50 * time.Millisecond})
+
+	start := time.Now()
+	require.NoError(t, listDevices())
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	ops.Clear()
+	start = time.Now()
+	require.NoError(t, listDevices())
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+}
+
+func listDevices() error {
+	_, err := kvdpa.ListVdpaDevices()
+	return err
+}
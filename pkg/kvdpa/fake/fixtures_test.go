@@ -0,0 +1,126 @@
+package fake_test
+
+import (
+	"flag"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/fake"
+)
+
+var recordFixtures = flag.String("record-fixtures", "",
+	"directory the simulator netlink session fixtures are written to (e.g: ../testdata/simulator)")
+
+// fixtureTopology is a simulated host whose netlink session is recorded
+type fixtureTopology struct {
+	name        string
+	description string
+	commands    []uint8
+	maxAttr     uint32
+	mgmtDevs    []fake.MgmtDev
+	// devices maps vdpa device names to their management device
+	devices [][2]string
+}
+
+var fixtureTopologies = []fixtureTopology{
+	{
+		name: "sim-pci-auxiliary",
+		description: "Synthetic: recorded against the fake kernel with a PCI and an " +
+			"auxiliary management device",
+		mgmtDevs: []fake.MgmtDev{
+			{BusName: "pci", DevName: "0000:65:00.2", VendorID: 0x15b3, MaxVqs: 16, SupportedFeatures: 0x3008f0fa7},
+			{BusName: "auxiliary", DevName: "mlx5_core.sf.1", ParentPCIAddress: "0000:65:00.0",
+				VendorID: 0x15b3, MaxVqs: 16, SupportedFeatures: 0x3008f0fa7},
+		},
+		devices: [][2]string{
+			{"vdpa0", "pci/0000:65:00.2"},
+			{"vdpa1", "auxiliary/mlx5_core.sf.1"},
+			{"vdpa2", "auxiliary/mlx5_core.sf.1"},
+		},
+	},
+	{
+		name: "sim-old-kernel",
+		description: "Synthetic: recorded against the fake kernel with two PCI management " +
+			"devices, without vstats, attr-set and feature provisioning",
+		commands: []uint8{kvdpa.VdpaCmdMgmtDevGet, kvdpa.VdpaCmdDevNew, kvdpa.VdpaCmdDevDel,
+			kvdpa.VdpaCmdDevGet, kvdpa.VdpaCmdDevConfigGet},
+		maxAttr: kvdpa.VdpaAttrGetNetCfgMTU,
+		mgmtDevs: []fake.MgmtDev{
+			{BusName: "pci", DevName: "0000:3b:00.1", VendorID: 0x8086, MaxVqs: 4},
+			{BusName: "pci", DevName: "0000:3b:00.2", VendorID: 0x8086, MaxVqs: 4},
+		},
+		devices: [][2]string{
+			{"vdpa0", "pci/0000:3b:00.1"},
+		},
+	},
+	{
+		name:        "sim-vdpasim",
+		description: "Synthetic: recorded against the fake kernel simulating vdpa_sim_net",
+		mgmtDevs: []fake.MgmtDev{
+			{DevName: "vdpasim_net"},
+		},
+		devices: [][2]string{
+			{"vdpa0", "vdpasim_net"},
+		},
+	},
+}
+
+// TestRecordFixtures records the simulator netlink sessions the kvdpa parsers
+// are tested against
+func TestRecordFixtures(t *testing.T) {
+	if *recordFixtures == "" {
+		t.Skip("-record-fixtures not set")
+	}
+	for _, topology := range fixtureTopologies {
+		t.Run(topology.name, func(t *testing.T) {
+			k, err := fake.New(t.TempDir())
+			require.NoError(t, err)
+			for _, m := range topology.mgmtDevs {
+				require.NoError(t, k.AddMgmtDev(m))
+			}
+			t.Cleanup(k.Install())
+			for _, dev := range topology.devices {
+				require.NoError(t, kvdpa.AddVdpaDevice(dev[1], dev[0]))
+			}
+			k.Commands = topology.commands
+			k.MaxAttr = topology.maxAttr
+
+			recorder := kvdpa.NewRecordingNetlinkOps(k, topology.description)
+			kvdpa.SetNetlinkOps(recorder)
+			recordSession(t, topology)
+
+			fixture := recorder.Fixture()
+			// The fixtures must not depend on the host they were generated on
+			fixture.Kernel = "simulated"
+			require.NoError(t, fixture.Save(filepath.Join(*recordFixtures, topology.name+".json")))
+		})
+	}
+}
+
+// recordSession runs the kvdpa functions whose netlink commands are recorded
+func recordSession(t *testing.T, topology fixtureTopology) {
+	_, err := kvdpa.Capabilities()
+	require.NoError(t, err)
+	mgmtDevs, err := kvdpa.ListVdpaMgmtDevices()
+	require.NoError(t, err)
+	for _, m := range mgmtDevs {
+		_, err := kvdpa.GetVdpaMgmtDevices(m.BusName(), m.DevName())
+		require.NoError(t, err)
+		_, err = kvdpa.GetVdpaDevicesByMgmtDev(m.BusName(), m.DevName())
+		if err != nil {
+			require.ErrorIs(t, err, syscall.ENODEV)
+		}
+	}
+	_, err = kvdpa.ListVdpaDevices()
+	require.NoError(t, err)
+	for _, dev := range topology.devices {
+		_, err := kvdpa.GetVdpaDevice(dev[0])
+		require.NoError(t, err)
+	}
+	_, err = kvdpa.GetVdpaDevice("missing")
+	require.Error(t, err)
+}
@@ -0,0 +1,151 @@
+package fake_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	k := newKernel(t)
+	dir := t.TempDir()
+	kvdpa.SetLockDir(filepath.Join(dir, "locks"))
+	kvdpa.SetOwnerRegistry(filepath.Join(dir, "owners.json"))
+	t.Cleanup(func() {
+		kvdpa.SetLockDir(kvdpa.DefaultLockDir)
+		kvdpa.SetOwnerRegistry(kvdpa.DefaultOwnerRegistry)
+	})
+
+	for _, name := range []string{"vdpa0", "vdpa1", "vdpa2", "vdpa3"} {
+		require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", name))
+	}
+	require.NoError(t, kvdpa.SetVdpaDeviceOwner("vdpa0", "pod-a"))
+	require.NoError(t, kvdpa.SetVdpaDeviceOwner("vdpa1", "pod-b"))
+	require.NoError(t, kvdpa.SetVdpaDeviceOwner("vdpa9", "pod-c"))
+	require.NoError(t, kvdpa.SetVdpaDeviceLabels("vdpa1", map[string]string{"interface": "net1"}))
+	owners, err := kvdpa.GetVdpaDeviceOwners()
+	require.NoError(t, err)
+	assert.Len(t, owners, 3)
+	assert.Equal(t, "pod-a", owners["vdpa0"].Owner)
+	alive := func(owner string) bool { return owner != "pod-b" }
+
+	// The orphans are found but still in their grace period
+	report, err := kvdpa.CollectGarbage(kvdpa.GCOptions{GracePeriod: time.Hour, OwnerAlive: alive})
+	require.NoError(t, err)
+	assert.Empty(t, report.Deleted)
+	assert.Equal(t, []string{"vdpa1", "vdpa2", "vdpa3"}, report.Pending)
+	assert.Equal(t, []string{"vdpa9"}, report.PrunedOwners)
+	assert.Empty(t, report.Failures)
+
+	// Dry run
+	time.Sleep(20 * time.Millisecond)
+	report, err = kvdpa.CollectGarbage(kvdpa.GCOptions{GracePeriod: 10 * time.Millisecond, OwnerAlive: alive, DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vdpa1", "vdpa2", "vdpa3"}, report.Deleted)
+	assert.Len(t, k.Devices(), 4)
+
+	// An owner registered meanwhile keeps its device
+	require.NoError(t, kvdpa.SetVdpaDeviceOwner("vdpa3", "pod-d"))
+	report, err = kvdpa.CollectGarbage(kvdpa.GCOptions{GracePeriod: 10 * time.Millisecond, OwnerAlive: alive})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vdpa1", "vdpa2"}, report.Deleted)
+	assert.Empty(t, report.Pending)
+	devs := k.Devices()
+	require.Len(t, devs, 2)
+	assert.Equal(t, "vdpa0", devs[0].Name)
+	assert.Equal(t, "vdpa3", devs[1].Name)
+	owners, err = kvdpa.GetVdpaDeviceOwners()
+	require.NoError(t, err)
+	assert.Len(t, owners, 2)
+	assert.Contains(t, owners, "vdpa3")
+	// The labels of the deleted devices are removed with them
+	registry, err := ioutil.ReadFile(filepath.Join(dir, "owners.json"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(registry), "vdpa1")
+
+	// Filters
+	require.NoError(t, kvdpa.RemoveVdpaDeviceOwner("vdpa0"))
+	require.NoError(t, kvdpa.AddVdpaDevice("auxiliary/mlx5_core.sf.1", "vdpa4"))
+	filters := []kvdpa.VdpaDeviceFilter{{MgmtBusName: "auxiliary", MgmtDevName: "mlx5_core.sf.1"}}
+	// The default grace period keeps the devices found orphaned for the first time
+	report, err = kvdpa.CollectGarbage(kvdpa.GCOptions{Filters: filters})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vdpa4"}, report.Pending)
+	time.Sleep(20 * time.Millisecond)
+	report, err = kvdpa.CollectGarbage(kvdpa.GCOptions{GracePeriod: 10 * time.Millisecond, Filters: filters})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vdpa4"}, report.Deleted)
+	_, ok := k.Device("vdpa0")
+	assert.True(t, ok)
+
+	// A device created again with the same name is not taken as the orphan
+	// found before
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa5"))
+	report, err = kvdpa.CollectGarbage(kvdpa.GCOptions{GracePeriod: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vdpa0", "vdpa5"}, report.Pending)
+	require.NoError(t, kvdpa.DeleteVdpaDevice("vdpa5"))
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa5"))
+	time.Sleep(20 * time.Millisecond)
+	report, err = kvdpa.CollectGarbage(kvdpa.GCOptions{GracePeriod: 10 * time.Millisecond})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vdpa0"}, report.Deleted)
+	assert.Equal(t, []string{"vdpa5"}, report.Pending)
+
+	_, err = kvdpa.CollectGarbage(kvdpa.GCOptions{GracePeriod: -time.Second})
+	assert.ErrorIs(t, err, syscall.EINVAL)
+}
+
+func TestCollectGarbageRecreated(t *testing.T) {
+	k := newKernel(t)
+	dir := t.TempDir()
+	kvdpa.SetLockDir(filepath.Join(dir, "locks"))
+	kvdpa.SetOwnerRegistry(filepath.Join(dir, "owners.json"))
+	t.Cleanup(func() {
+		kvdpa.SetLockDir(kvdpa.DefaultLockDir)
+		kvdpa.SetOwnerRegistry(kvdpa.DefaultOwnerRegistry)
+	})
+
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa0"))
+	require.NoError(t, kvdpa.SetVdpaDeviceOwner("vdpa0", "pod-a"))
+	gone := func(owner string) bool { return false }
+	report, err := kvdpa.CollectGarbage(kvdpa.GCOptions{GracePeriod: time.Hour, OwnerAlive: gone})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vdpa0"}, report.Pending)
+
+	// The device is created again between its listing and its deletion:
+	// the owner check of the deletion is the last step before it
+	run := func(command uint8, attrs ...*nl.RtAttr) {
+		_, err := k.RunVdpaNetlinkCmd(command, 0, attrs)
+		require.NoError(t, err)
+	}
+	name, err := k.NewAttribute(kvdpa.VdpaAttrDevName, "vdpa0")
+	require.NoError(t, err)
+	bus, err := k.NewAttribute(kvdpa.VdpaAttrMgmtDevBusName, "pci")
+	require.NoError(t, err)
+	mgmtDev, err := k.NewAttribute(kvdpa.VdpaAttrMgmtDevDevName, "0000:65:00.2")
+	require.NoError(t, err)
+	checks := 0
+	alive := func(owner string) bool {
+		checks++
+		if checks == 2 {
+			run(kvdpa.VdpaCmdDevDel, name)
+			run(kvdpa.VdpaCmdDevNew, bus, mgmtDev, name)
+		}
+		return false
+	}
+	time.Sleep(20 * time.Millisecond)
+	report, err = kvdpa.CollectGarbage(kvdpa.GCOptions{GracePeriod: 10 * time.Millisecond, OwnerAlive: alive})
+	require.NoError(t, err)
+	assert.Empty(t, report.Deleted)
+	assert.Equal(t, []string{"vdpa0"}, report.Pending)
+	assert.Len(t, k.Devices(), 1)
+}
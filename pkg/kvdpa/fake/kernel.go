@@ -0,0 +1,440 @@
+// Package fake simulates the kernel vdpa subsystem, the way vdpa_sim does, so
+// that code using kvdpa can be tested end to end without root privileges or
+// vdpa capable hardware.
+//
+// A Kernel answers the generic netlink requests kvdpa sends through its
+// NetlinkOps interface and renders the matching sysfs and devfs trees on disk.
+// Since device nodes cannot be created without privileges, vhost-vdpa device
+// nodes are symlinks to /dev/null.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/internal/hooks"
+)
+
+// VdpaFamilyID is the generic netlink family ID of the simulated vdpa family
+const VdpaFamilyID = 0x1c
+
+// VirtioNetStatusLinkUp is the VIRTIO_NET_S_LINK_UP status bit
+const VirtioNetStatusLinkUp uint8 = 1
+
+// MgmtDev is a simulated management device
+type MgmtDev struct {
+	// BusName is "pci", "auxiliary" or empty (e.g: vdpasim_net)
+	BusName string
+	DevName string
+	// ParentPCIAddress is the PCI device an auxiliary management device sits on
+	ParentPCIAddress string
+	// NumaNode is the NUMA node of the (parent) PCI device
+	NumaNode int
+	// LocalCPUs is the CPU list of the NUMA node of the (parent) PCI device
+	// (e.g: "0-7,16-23")
+	LocalCPUs string
+	// MSIXVectors is the number of MSI-X interrupts of the (parent) PCI device
+	MSIXVectors int
+	// SupportedClasses is a bitmask of the virtio device IDs it can create
+	SupportedClasses  uint64
+	MaxVqs            uint32
+	SupportedFeatures uint64
+	// DeviceID and VendorID are the virtio IDs of the devices it creates
+	DeviceID uint32
+	VendorID uint32
+	// ConfigAttrs are the configuration attributes it can provision at
+	// creation, like the config_attr_mask of the kernel: all of them if nil.
+	// The kernel does not report them
+	ConfigAttrs []uint16
+}
+
+// Name returns the management device name: [BusName/]DevName
+func (m *MgmtDev) Name() string {
+	if m.BusName != "" {
+		return m.BusName + "/" + m.DevName
+	}
+	return m.DevName
+}
+
+// Device is a simulated vdpa device
+type Device struct {
+	Name      string
+	MgmtDev   string
+	DeviceID  uint32
+	VendorID  uint32
+	MaxVqs    uint32
+	MaxVqSize uint16
+	MinVqSize uint16
+
+	// Network configuration
+	MAC                net.HardwareAddr
+	MTU                uint16
+	MaxVqp             uint16
+	Status             uint8
+	Features           uint64
+	NegotiatedFeatures uint64
+
+	// Driver is the vdpa bus driver the device is bound to, if any
+	Driver string
+	// Stats holds the vendor statistics of each queue
+	Stats map[uint32]map[string]uint64
+
+	// index is used to name the vhost-vdpa, virtio and net devices
+	index int
+}
+
+func (d *Device) copy() Device {
+	c := *d
+	c.MAC = append(net.HardwareAddr{}, d.MAC...)
+	c.Stats = map[uint32]map[string]uint64{}
+	for q, stats := range d.Stats {
+		c.Stats[q] = map[string]uint64{}
+		for name, value := range stats {
+			c.Stats[q][name] = value
+		}
+	}
+	return c
+}
+
+// Kernel is a simulated kernel vdpa subsystem. It implements kvdpa.NetlinkOps
+type Kernel struct {
+	// AutoprobeDriver is the driver new devices are bound to, if any
+	AutoprobeDriver string
+	// Commands restricts the supported commands to simulate older kernels.
+	// If empty, all the commands are supported
+	Commands []uint8
+	// MaxAttr restricts the supported attributes to simulate older kernels.
+	// If zero, all the attributes are supported
+	MaxAttr uint32
+
+	root string
+
+	mu        sync.Mutex
+	mgmtDevs  []*MgmtDev
+	devices   map[string]*Device
+	nextIndex int
+	nextIRQ   int
+	watchers  []*watcher
+}
+
+type watcher struct {
+	events  chan hooks.UEvent
+	overrun bool
+}
+
+// New returns a Kernel without any management device whose sysfs and devfs
+// trees are rendered in the provided directory
+func New(root string) (*Kernel, error) {
+	k := &Kernel{
+		root:    root,
+		devices: map[string]*Device{},
+		nextIRQ: firstIRQ,
+	}
+	if err := k.renderBase(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// SysfsRoot returns the path of the simulated sysfs tree
+func (k *Kernel) SysfsRoot() string {
+	return filepath.Join(k.root, "sys")
+}
+
+// DevfsRoot returns the path of the simulated devfs tree
+func (k *Kernel) DevfsRoot() string {
+	return filepath.Join(k.root, "dev")
+}
+
+// ProcRoot returns the path of the simulated procfs tree. It only holds
+// the interrupts
+func (k *Kernel) ProcRoot() string {
+	return filepath.Join(k.root, "proc")
+}
+
+// Install makes kvdpa use the simulated kernel: its netlink operations, its
+// sysfs, devfs and procfs trees and its uevents. The returned function
+// restores the defaults
+func (k *Kernel) Install() func() {
+	oldOps := kvdpa.GetNetlinkOps()
+	kvdpa.SetNetlinkOps(k)
+	hooks.SetRootDirs(k.SysfsRoot(), k.DevfsRoot())
+	hooks.SetProcRoot(k.ProcRoot())
+	hooks.SetUEventSource(k.uevents)
+	return func() {
+		kvdpa.SetNetlinkOps(oldOps)
+		hooks.SetRootDirs("/sys", "/dev")
+		hooks.SetProcRoot("/proc")
+		hooks.SetUEventSource(nil)
+	}
+}
+
+// AddMgmtDev adds a management device
+func (k *Kernel) AddMgmtDev(m MgmtDev) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if m.DevName == "" {
+		return fmt.Errorf("management device name is required")
+	}
+	if k.mgmtDev(m.Name()) != nil {
+		return fmt.Errorf("management device %s already exists", m.Name())
+	}
+	if m.SupportedClasses == 0 {
+		m.SupportedClasses = 1 << kvdpa.VirtioIDNet
+	}
+	if m.DeviceID == 0 {
+		m.DeviceID = kvdpa.VirtioIDNet
+	}
+	if m.MaxVqs == 0 {
+		m.MaxVqs = 2
+	}
+	if err := k.renderMgmtDev(&m); err != nil {
+		return err
+	}
+	k.mgmtDevs = append(k.mgmtDevs, &m)
+	return nil
+}
+
+// MgmtDevs returns the management devices
+func (k *Kernel) MgmtDevs() []MgmtDev {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	result := make([]MgmtDev, 0, len(k.mgmtDevs))
+	for _, m := range k.mgmtDevs {
+		result = append(result, *m)
+	}
+	return result
+}
+
+// Devices returns the devices sorted by name
+func (k *Kernel) Devices() []Device {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	result := make([]Device, 0, len(k.devices))
+	for _, name := range k.deviceNames() {
+		result = append(result, k.devices[name].copy())
+	}
+	return result
+}
+
+// Device returns a device by name
+func (k *Kernel) Device(name string) (Device, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	dev, ok := k.devices[name]
+	if !ok {
+		return Device{}, false
+	}
+	return dev.copy(), true
+}
+
+// SetStats sets the vendor statistics of a device's queue
+func (k *Kernel) SetStats(name string, queue uint32, stats map[string]uint64) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	dev, ok := k.devices[name]
+	if !ok {
+		return fmt.Errorf("device %s not found", name)
+	}
+	dev.Stats[queue] = map[string]uint64{}
+	for statName, value := range stats {
+		dev.Stats[queue][statName] = value
+	}
+	return nil
+}
+
+// Bind binds a device to a driver as writing to the driver's bind file would
+func (k *Kernel) Bind(name, driver string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.bind(name, driver)
+}
+
+// Unbind unbinds a device from its driver as writing to the driver's unbind file would
+func (k *Kernel) Unbind(name string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.unbind(name)
+}
+
+// SetNetDevUp sets the operational state and the carrier of the netdev of a
+// device bound to the virtio_vdpa driver
+func (k *Kernel) SetNetDevUp(name string, up bool) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	dev, err := k.netDevice(name)
+	if err != nil {
+		return err
+	}
+	state, carrier := "down\n", "0\n"
+	if up {
+		state, carrier = "up\n", "1\n"
+	}
+	path := k.netDevPath(dev)
+	if err := ioutil.WriteFile(filepath.Join(path, "operstate"), []byte(state), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(path, "carrier"), []byte(carrier), 0644)
+}
+
+// SetNetDevStats sets the statistics of the netdev of a device bound to the
+// virtio_vdpa driver
+func (k *Kernel) SetNetDevStats(name string, stats kvdpa.NetDevStats) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	dev, err := k.netDevice(name)
+	if err != nil {
+		return err
+	}
+	values := []uint64{
+		stats.RxBytes, stats.RxPackets, stats.RxErrors, stats.RxDropped,
+		stats.TxBytes, stats.TxPackets, stats.TxErrors, stats.TxDropped,
+	}
+	for i, name := range netDevStatsFiles {
+		path := filepath.Join(k.netDevPath(dev), "statistics", name)
+		if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", values[i])), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// netDevice returns a device that has a netdev
+func (k *Kernel) netDevice(name string) (*Device, error) {
+	dev, ok := k.devices[name]
+	if !ok {
+		return nil, fmt.Errorf("device %s not found", name)
+	}
+	if dev.Driver != kvdpa.VirtioVdpaDriver {
+		return nil, fmt.Errorf("device %s has no netdev", name)
+	}
+	return dev, nil
+}
+
+// Sync processes the pending writes to the vdpa drivers' bind and unbind files.
+// They are also processed before answering every netlink request
+func (k *Kernel) Sync() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.syncSysfs()
+}
+
+// uevents returns the uevents generated by the simulated kernel, as the
+// uevent source of kvdpa
+func (k *Kernel) uevents(ctx context.Context) (<-chan hooks.UEvent, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	w := &watcher{events: make(chan hooks.UEvent, 256)}
+	k.watchers = append(k.watchers, w)
+
+	go func() {
+		<-ctx.Done()
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		for i, other := range k.watchers {
+			if other == w {
+				k.watchers = append(k.watchers[:i:i], k.watchers[i+1:]...)
+				break
+			}
+		}
+		close(w.events)
+	}()
+	return w.events, nil
+}
+
+// emit sends a uevent to the watchers. Like the uevent socket, if a watcher
+// does not keep up the uevents are lost and an overrun is notified
+func (k *Kernel) emit(action, devPath, subsystem string, env map[string]string) {
+	devPath = "/" + strings.TrimPrefix(devPath, k.SysfsRoot()+"/")
+	ev := hooks.UEvent{
+		Action:    action,
+		DevPath:   devPath,
+		Subsystem: subsystem,
+		Env: map[string]string{
+			"ACTION":    action,
+			"DEVPATH":   devPath,
+			"SUBSYSTEM": subsystem,
+		},
+	}
+	for key, value := range env {
+		ev.Env[key] = value
+	}
+	for _, w := range k.watchers {
+		if w.overrun {
+			select {
+			case w.events <- hooks.UEvent{Overrun: true}:
+				w.overrun = false
+			default:
+				continue
+			}
+		}
+		select {
+		case w.events <- ev:
+		default:
+			w.overrun = true
+		}
+	}
+}
+
+func (k *Kernel) mgmtDev(name string) *MgmtDev {
+	for _, m := range k.mgmtDevs {
+		if m.Name() == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func (k *Kernel) deviceNames() []string {
+	names := make([]string, 0, len(k.devices))
+	for name := range k.devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// bind binds a device to a driver. The device is configured by the driver
+// (the features are negotiated and the link is up) and its endpoint is created
+func (k *Kernel) bind(name, driver string) error {
+	dev, ok := k.devices[name]
+	if !ok {
+		return fmt.Errorf("device %s not found", name)
+	}
+	if driver != kvdpa.VhostVdpaDriver && driver != kvdpa.VirtioVdpaDriver {
+		return fmt.Errorf("unknown driver %s", driver)
+	}
+	if dev.Driver != "" {
+		return fmt.Errorf("device %s already bound to %s", name, dev.Driver)
+	}
+	dev.Driver = driver
+	dev.NegotiatedFeatures = dev.Features
+	dev.Status |= VirtioNetStatusLinkUp
+	return k.renderBind(dev)
+}
+
+// unbind unbinds a device from its driver, if any
+func (k *Kernel) unbind(name string) error {
+	dev, ok := k.devices[name]
+	if !ok {
+		return fmt.Errorf("device %s not found", name)
+	}
+	if dev.Driver == "" {
+		return nil
+	}
+	if err := k.renderUnbind(dev); err != nil {
+		return err
+	}
+	dev.Driver = ""
+	dev.NegotiatedFeatures = 0
+	dev.Status &^= VirtioNetStatusLinkUp
+	return nil
+}
@@ -0,0 +1,71 @@
+package fake_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/fake"
+)
+
+func TestDeviceLocality(t *testing.T) {
+	k := newKernel(t)
+	require.NoError(t, k.AddMgmtDev(fake.MgmtDev{
+		BusName:     "pci",
+		DevName:     "0000:66:00.2",
+		NumaNode:    1,
+		LocalCPUs:   "8-11,40",
+		MSIXVectors: 2,
+	}))
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:66:00.2", "vdpa0"))
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa1"))
+
+	locality, err := kvdpa.GetVdpaDeviceLocality("vdpa0")
+	require.NoError(t, err)
+	assert.Equal(t, "0000:66:00.2", locality.PCIAddress)
+	assert.Equal(t, 1, locality.NumaNode)
+	assert.Equal(t, []int{8, 9, 10, 11, 40}, locality.LocalCPUs)
+	require.Len(t, locality.IRQs, 2)
+	allCPUs := make([]int, 32)
+	for i := range allCPUs {
+		allCPUs[i] = i
+	}
+	assert.Equal(t, kvdpa.IRQ{Number: 100, Actions: []string{"mlx5_comp0@pci:0000:66:00.2"}, Affinity: allCPUs},
+		locality.IRQs[0])
+	assert.Equal(t, 101, locality.IRQs[1].Number)
+
+	require.NoError(t, kvdpa.SetVdpaDeviceIRQAffinity("vdpa0", []int{8, 9, 40}))
+	content, err := ioutil.ReadFile(filepath.Join(k.ProcRoot(), "irq/101/smp_affinity"))
+	require.NoError(t, err)
+	assert.Equal(t, "00000100,00000300", string(content))
+	require.NoError(t, kvdpa.SetIRQAffinity(100, []int{10}))
+	locality, err = kvdpa.GetVdpaDeviceLocality("vdpa0")
+	require.NoError(t, err)
+	assert.Equal(t, []int{10}, locality.IRQs[0].Affinity)
+	assert.Equal(t, []int{8, 9, 40}, locality.IRQs[1].Affinity)
+	require.NoError(t, kvdpa.SetVdpaDeviceIRQAffinity("vdpa0", []int{11}, 101))
+	locality, err = kvdpa.GetVdpaDeviceLocality("vdpa0")
+	require.NoError(t, err)
+	assert.Equal(t, []int{10}, locality.IRQs[0].Affinity)
+	assert.Equal(t, []int{11}, locality.IRQs[1].Affinity)
+	assert.ErrorIs(t, kvdpa.SetVdpaDeviceIRQAffinity("vdpa0", []int{11}, 99), syscall.EINVAL)
+
+	// A PCI device on a NUMA node without local CPUs nor interrupts
+	locality, err = kvdpa.GetVdpaDeviceLocality("vdpa1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, locality.NumaNode)
+	assert.Empty(t, locality.LocalCPUs)
+	assert.Empty(t, locality.IRQs)
+	assert.ErrorIs(t, kvdpa.SetVdpaDeviceIRQAffinity("vdpa1", []int{0}), syscall.ENOENT)
+
+	assert.ErrorIs(t, kvdpa.SetIRQAffinity(100, nil), syscall.EINVAL)
+	assert.ErrorIs(t, kvdpa.SetIRQAffinity(100, []int{-1}), syscall.EINVAL)
+	assert.ErrorIs(t, kvdpa.SetIRQAffinity(99, []int{0}), syscall.ENOENT)
+	_, err = kvdpa.GetVdpaDeviceLocality("vdpa2")
+	assert.ErrorIs(t, err, syscall.ENODEV)
+}
@@ -0,0 +1,87 @@
+package fake_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+)
+
+func TestDeviceLabels(t *testing.T) {
+	k := newKernel(t)
+	dir := t.TempDir()
+	kvdpa.SetLockDir(filepath.Join(dir, "locks"))
+	kvdpa.SetOwnerRegistry(filepath.Join(dir, "owners.json"))
+	t.Cleanup(func() {
+		kvdpa.SetLockDir(kvdpa.DefaultLockDir)
+		kvdpa.SetOwnerRegistry(kvdpa.DefaultOwnerRegistry)
+	})
+
+	labels := map[string]string{"pod": "default/vm-a", "interface": "net1"}
+	require.NoError(t, kvdpa.AddVdpaDeviceWithLabels("pci/0000:65:00.2", "vdpa0", nil, labels))
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa1"))
+	labels["pod"] = "changed"
+
+	devs, err := kvdpa.ListVdpaDevices()
+	require.NoError(t, err)
+	require.Len(t, devs, 2)
+	assertLabels(t, map[string]string{"pod": "default/vm-a", "interface": "net1"}, devs[0])
+	assertLabels(t, nil, devs[1])
+
+	require.NoError(t, kvdpa.SetVdpaDeviceLabels("vdpa1", map[string]string{"pod": "default/vm-b"}))
+	dev, err := kvdpa.GetVdpaDevice("vdpa1")
+	require.NoError(t, err)
+	assertLabels(t, map[string]string{"pod": "default/vm-b"}, dev)
+
+	// Deleting a device removes its labels
+	require.NoError(t, kvdpa.DeleteVdpaDevice("vdpa0"))
+	registry, err := ioutil.ReadFile(filepath.Join(dir, "owners.json"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(registry), "vdpa0")
+
+	// A device deleted behind the library's back and created again with the
+	// same name does not inherit the labels
+	require.NoError(t, kvdpa.AddVdpaDeviceWithLabels("pci/0000:65:00.2", "vdpa0", nil, labels))
+	name, err := k.NewAttribute(kvdpa.VdpaAttrDevName, "vdpa0")
+	require.NoError(t, err)
+	_, err = k.RunVdpaNetlinkCmd(kvdpa.VdpaCmdDevDel, 0, []*nl.RtAttr{name})
+	require.NoError(t, err)
+	require.NoError(t, kvdpa.AddVdpaDevice("auxiliary/mlx5_core.sf.1", "vdpa0"))
+	dev, err = kvdpa.GetVdpaDevice("vdpa0")
+	require.NoError(t, err)
+	assertLabels(t, nil, dev)
+
+	require.NoError(t, kvdpa.RemoveVdpaDeviceLabels("vdpa1"))
+	dev, err = kvdpa.GetVdpaDevice("vdpa1")
+	require.NoError(t, err)
+	assertLabels(t, nil, dev)
+
+	// A corrupt store or a store of another version does not prevent listing,
+	// the devices return the error instead of their labels
+	for _, content := range []string{"garbage", `{"version": 2, "owners": {}}`} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "owners.json"), []byte(content), 0644))
+		devs, err = kvdpa.ListVdpaDevices()
+		require.NoError(t, err)
+		require.Len(t, devs, 2)
+		labels, err := devs[1].Labels()
+		assert.Error(t, err)
+		assert.Nil(t, labels)
+		assert.Error(t, kvdpa.SetVdpaDeviceLabels("vdpa1", nil))
+	}
+
+	assert.ErrorIs(t, kvdpa.SetVdpaDeviceLabels("vdpa2", nil), syscall.ENODEV)
+	assert.ErrorIs(t, kvdpa.AddVdpaDeviceWithLabels("pci/0000:65:00.2", "vdpa2", nil, map[string]string{"": "x"}), syscall.EINVAL)
+}
+
+func assertLabels(t *testing.T, expected map[string]string, dev kvdpa.VdpaDevice) {
+	t.Helper()
+	labels, err := dev.Labels()
+	require.NoError(t, err)
+	assert.Equal(t, expected, labels)
+}
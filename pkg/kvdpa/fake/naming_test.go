@@ -0,0 +1,77 @@
+package fake_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+)
+
+func TestAllocateVdpaDevice(t *testing.T) {
+	k := newKernel(t)
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa1"))
+
+	name, err := kvdpa.AllocateVdpaDevice("pci/0000:65:00.2", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "vdpa0", name)
+	name, err = kvdpa.AllocateVdpaDevice("pci/0000:65:00.2", &kvdpa.VdpaNetConfig{MTU: 9000})
+	require.NoError(t, err)
+	assert.Equal(t, "vdpa2", name)
+	dev, ok := k.Device("vdpa2")
+	require.True(t, ok)
+	assert.Equal(t, uint16(9000), dev.MTU)
+
+	// Concurrent allocations get distinct names
+	var wg sync.WaitGroup
+	names := make([]string, 8)
+	errs := make([]error, len(names))
+	for i := range names {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			names[i], errs[i] = kvdpa.AllocateVdpaDevice("auxiliary/mlx5_core.sf.1", nil)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	sort.Strings(names)
+	expected := []string{}
+	for i := 3; i < 3+len(names); i++ {
+		expected = append(expected, fmt.Sprintf("vdpa%d", i))
+	}
+	sort.Strings(expected)
+	assert.Equal(t, expected, names)
+}
+
+func TestNamingPolicies(t *testing.T) {
+	newKernel(t)
+	t.Cleanup(func() { require.NoError(t, kvdpa.SetNameTemplate("")) })
+
+	require.NoError(t, kvdpa.SetNameTemplate("vdpa-{pci}-{idx}"))
+	name, err := kvdpa.AllocateVdpaDevice("auxiliary/mlx5_core.sf.1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "vdpa-000065000-0", name)
+
+	// Without a counter, a single name can be allocated
+	require.NoError(t, kvdpa.SetNameTemplate("{mgmtdev}"))
+	name, err = kvdpa.AllocateVdpaDevice("pci/0000:65:00.2", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "0000:65:00.2", name)
+	_, err = kvdpa.AllocateVdpaDevice("pci/0000:65:00.2", nil)
+	assert.ErrorIs(t, err, syscall.EEXIST)
+
+	require.NoError(t, kvdpa.SetNameTemplate(strings.Repeat("v", kvdpa.MaxVdpaDeviceNameLen)+"{n}"))
+	_, err = kvdpa.AllocateVdpaDevice("pci/0000:65:00.2", nil)
+	assert.ErrorIs(t, err, syscall.ENAMETOOLONG)
+
+	assert.Error(t, kvdpa.SetNameTemplate("vdpa{unknown}"))
+}
@@ -0,0 +1,436 @@
+package fake
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+)
+
+// allCommands are the commands supported by the simulated vdpa family
+var allCommands = []uint8{
+	kvdpa.VdpaCmdMgmtDevGet,
+	kvdpa.VdpaCmdDevNew,
+	kvdpa.VdpaCmdDevDel,
+	kvdpa.VdpaCmdDevGet,
+	kvdpa.VdpaCmdDevConfigGet,
+	kvdpa.VdpaCmdDevVstatsGet,
+	kvdpa.VdpaCmdDevAttrSet,
+}
+
+// GetVdpaFamily returns the simulated vdpa generic netlink family
+func (k *Kernel) GetVdpaFamily() (*netlink.GenlFamily, error) {
+	family := &netlink.GenlFamily{
+		ID:      VdpaFamilyID,
+		Name:    kvdpa.VdpaGenlName,
+		Version: 1,
+		MaxAttr: k.maxAttr(),
+	}
+	for _, cmd := range k.commands() {
+		family.Ops = append(family.Ops, netlink.GenlOp{ID: uint32(cmd)})
+	}
+	return family, nil
+}
+
+func (k *Kernel) commands() []uint8 {
+	if len(k.Commands) > 0 {
+		return k.Commands
+	}
+	return allCommands
+}
+
+func (k *Kernel) maxAttr() uint32 {
+	if k.MaxAttr != 0 {
+		return k.MaxAttr
+	}
+	return kvdpa.VdpaAttrMax - 1
+}
+
+// NewAttribute returns a new netlink attribute encoded the way the kernel expects it
+func (k *Kernel) NewAttribute(attrType int, data interface{}) (*nl.RtAttr, error) {
+	switch value := data.(type) {
+	case string:
+		return nl.NewRtAttr(attrType, nl.ZeroTerminated(value)), nil
+	case uint8:
+		return nl.NewRtAttr(attrType, nl.Uint8Attr(value)), nil
+	case uint16:
+		return nl.NewRtAttr(attrType, nl.Uint16Attr(value)), nil
+	case uint32:
+		return nl.NewRtAttr(attrType, nl.Uint32Attr(value)), nil
+	case uint64:
+		return nl.NewRtAttr(attrType, nl.Uint64Attr(value)), nil
+	case []byte:
+		return nl.NewRtAttr(attrType, value), nil
+	case net.HardwareAddr:
+		return nl.NewRtAttr(attrType, value), nil
+	}
+	return nil, fmt.Errorf("unsupported data type %T for attribute type %d", data, attrType)
+}
+
+// request holds the attributes of a netlink request
+type request map[uint16][]byte
+
+func (r request) has(attrType int) bool {
+	_, ok := r[uint16(attrType)]
+	return ok
+}
+
+func (r request) str(attrType int) string {
+	value := r[uint16(attrType)]
+	if len(value) > 0 && value[len(value)-1] == 0 {
+		value = value[:len(value)-1]
+	}
+	return string(value)
+}
+
+func (r request) u16(attrType int) uint16 {
+	value := r[uint16(attrType)]
+	if len(value) < 2 {
+		return 0
+	}
+	return nl.NativeEndian().Uint16(value)
+}
+
+func (r request) u32(attrType int) uint32 {
+	value := r[uint16(attrType)]
+	if len(value) < 4 {
+		return 0
+	}
+	return nl.NativeEndian().Uint32(value)
+}
+
+func (r request) u64(attrType int) uint64 {
+	value := r[uint16(attrType)]
+	if len(value) < 8 {
+		return 0
+	}
+	return nl.NativeEndian().Uint64(value)
+}
+
+// message builds a generic netlink message (without the netlink header)
+type message struct {
+	command uint8
+	attrs   []*nl.RtAttr
+}
+
+func (m *message) str(attrType int, value string) {
+	m.attrs = append(m.attrs, nl.NewRtAttr(attrType, nl.ZeroTerminated(value)))
+}
+
+func (m *message) u8(attrType int, value uint8) {
+	m.attrs = append(m.attrs, nl.NewRtAttr(attrType, nl.Uint8Attr(value)))
+}
+
+func (m *message) u16(attrType int, value uint16) {
+	m.attrs = append(m.attrs, nl.NewRtAttr(attrType, nl.Uint16Attr(value)))
+}
+
+func (m *message) u32(attrType int, value uint32) {
+	m.attrs = append(m.attrs, nl.NewRtAttr(attrType, nl.Uint32Attr(value)))
+}
+
+func (m *message) u64(attrType int, value uint64) {
+	m.attrs = append(m.attrs, nl.NewRtAttr(attrType, nl.Uint64Attr(value)))
+}
+
+func (m *message) binary(attrType int, value []byte) {
+	m.attrs = append(m.attrs, nl.NewRtAttr(attrType, value))
+}
+
+// serialize returns the message without the attributes an older kernel
+// (whose highest attribute is maxAttr) would not know about
+func (m *message) serialize(maxAttr uint32) []byte {
+	genlmsg := &nl.Genlmsg{
+		Command: m.command,
+		Version: nl.GENL_CTRL_VERSION,
+	}
+	b := genlmsg.Serialize()
+	for _, attr := range m.attrs {
+		if uint32(attr.Type) <= maxAttr {
+			b = append(b, attr.Serialize()...)
+		}
+	}
+	return b
+}
+
+// RunVdpaNetlinkCmd answers a vdpa netlink request as the kernel would
+func (k *Kernel) RunVdpaNetlinkCmd(command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.syncSysfs(); err != nil {
+		return nil, err
+	}
+
+	supported := false
+	for _, cmd := range k.commands() {
+		supported = supported || cmd == command
+	}
+	if !supported {
+		return nil, syscall.EOPNOTSUPP
+	}
+
+	req := request{}
+	for _, attr := range data {
+		if uint32(attr.Type) > k.maxAttr() {
+			return nil, syscall.EINVAL
+		}
+		req[attr.Type] = attr.Data
+	}
+	dump := flags&syscall.NLM_F_DUMP != 0
+
+	var msgs []*message
+	var err error
+	switch command {
+	case kvdpa.VdpaCmdMgmtDevGet:
+		msgs, err = k.mgmtDevGet(req, dump)
+	case kvdpa.VdpaCmdDevNew:
+		err = k.devNew(req)
+	case kvdpa.VdpaCmdDevDel:
+		err = k.devDel(req)
+	case kvdpa.VdpaCmdDevGet:
+		msgs, err = k.devGet(req, dump, k.devMessage)
+	case kvdpa.VdpaCmdDevConfigGet:
+		msgs, err = k.devGet(req, dump, k.devConfigMessage)
+	case kvdpa.VdpaCmdDevVstatsGet:
+		msgs, err = k.devVstatsGet(req)
+	case kvdpa.VdpaCmdDevAttrSet:
+		err = k.devAttrSet(req)
+	default:
+		err = syscall.EOPNOTSUPP
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([][]byte, 0, len(msgs))
+	for _, m := range msgs {
+		result = append(result, m.serialize(k.maxAttr()))
+	}
+	return result, nil
+}
+
+func (k *Kernel) mgmtDevGet(req request, dump bool) ([]*message, error) {
+	msgs := []*message{}
+	for _, m := range k.mgmtDevs {
+		if !dump && (m.BusName != req.str(kvdpa.VdpaAttrMgmtDevBusName) ||
+			m.DevName != req.str(kvdpa.VdpaAttrMgmtDevDevName)) {
+			continue
+		}
+		msg := &message{command: kvdpa.VdpaCmdMgmtDevNew}
+		if m.BusName != "" {
+			msg.str(kvdpa.VdpaAttrMgmtDevBusName, m.BusName)
+		}
+		msg.str(kvdpa.VdpaAttrMgmtDevDevName, m.DevName)
+		msg.u64(kvdpa.VdpaAttrMgmtDevSupportedClasses, m.SupportedClasses)
+		msg.u32(kvdpa.VdpaAttrDevMgmtDevMaxVqs, m.MaxVqs)
+		msg.u64(kvdpa.VdpaAttrDevSupportedFeatures, m.SupportedFeatures)
+		msgs = append(msgs, msg)
+	}
+	if !dump && len(msgs) == 0 {
+		return nil, syscall.ENODEV
+	}
+	return msgs, nil
+}
+
+func (k *Kernel) devNew(req request) error {
+	name := req.str(kvdpa.VdpaAttrDevName)
+	if name == "" || !req.has(kvdpa.VdpaAttrMgmtDevDevName) {
+		return syscall.EINVAL
+	}
+	mgmtName := req.str(kvdpa.VdpaAttrMgmtDevDevName)
+	if bus := req.str(kvdpa.VdpaAttrMgmtDevBusName); bus != "" {
+		mgmtName = bus + "/" + mgmtName
+	}
+	m := k.mgmtDev(mgmtName)
+	if m == nil {
+		return syscall.ENODEV
+	}
+	if _, ok := k.devices[name]; ok {
+		return syscall.EEXIST
+	}
+	if m.ConfigAttrs != nil {
+		for _, attr := range []uint16{kvdpa.VdpaAttrDevNetCfgMacAddr, kvdpa.VdpaAttrGetNetCfgMTU,
+			kvdpa.VdpaAttrDevNetCfgMaxVqp, kvdpa.VdpaAttrDevFeatures} {
+			if req.has(int(attr)) && !hasAttr(m.ConfigAttrs, attr) {
+				return syscall.EOPNOTSUPP
+			}
+		}
+	}
+
+	dev := &Device{
+		Name:      name,
+		MgmtDev:   m.Name(),
+		DeviceID:  m.DeviceID,
+		VendorID:  m.VendorID,
+		MaxVqs:    m.MaxVqs,
+		MaxVqSize: 256,
+		MinVqSize: 1,
+		MTU:       1500,
+		MaxVqp:    1,
+		Features:  m.SupportedFeatures,
+		Stats:     map[uint32]map[string]uint64{},
+		index:     k.nextIndex,
+	}
+	if req.has(kvdpa.VdpaAttrDevNetCfgMacAddr) {
+		mac := req[kvdpa.VdpaAttrDevNetCfgMacAddr]
+		if len(mac) != 6 {
+			return syscall.EINVAL
+		}
+		dev.MAC = append(net.HardwareAddr{}, mac...)
+	}
+	if req.has(kvdpa.VdpaAttrGetNetCfgMTU) {
+		dev.MTU = req.u16(kvdpa.VdpaAttrGetNetCfgMTU)
+	}
+	if req.has(kvdpa.VdpaAttrDevNetCfgMaxVqp) {
+		dev.MaxVqp = req.u16(kvdpa.VdpaAttrDevNetCfgMaxVqp)
+		if dev.MaxVqp == 0 || uint32(dev.MaxVqp)*2 > m.MaxVqs {
+			return syscall.EINVAL
+		}
+	}
+	if req.has(kvdpa.VdpaAttrDevFeatures) {
+		dev.Features = req.u64(kvdpa.VdpaAttrDevFeatures)
+		if dev.Features&^m.SupportedFeatures != 0 {
+			return syscall.EINVAL
+		}
+	}
+	k.nextIndex++
+
+	if err := k.renderDevice(dev); err != nil {
+		return err
+	}
+	k.devices[name] = dev
+	if k.AutoprobeDriver != "" {
+		return k.bind(name, k.AutoprobeDriver)
+	}
+	return nil
+}
+
+func (k *Kernel) devDel(req request) error {
+	name := req.str(kvdpa.VdpaAttrDevName)
+	dev, ok := k.devices[name]
+	if !ok {
+		return syscall.ENODEV
+	}
+	if err := k.unbind(name); err != nil {
+		return err
+	}
+	if err := k.renderDelete(dev); err != nil {
+		return err
+	}
+	delete(k.devices, name)
+	return nil
+}
+
+func (k *Kernel) devGet(req request, dump bool, fill func(*Device) *message) ([]*message, error) {
+	if !dump {
+		dev, ok := k.devices[req.str(kvdpa.VdpaAttrDevName)]
+		if !ok {
+			return nil, syscall.ENODEV
+		}
+		return []*message{fill(dev)}, nil
+	}
+	msgs := []*message{}
+	for _, name := range k.deviceNames() {
+		msgs = append(msgs, fill(k.devices[name]))
+	}
+	return msgs, nil
+}
+
+func (k *Kernel) devMessage(dev *Device) *message {
+	m := k.mgmtDev(dev.MgmtDev)
+	msg := &message{command: kvdpa.VdpaCmdDevNew}
+	msg.str(kvdpa.VdpaAttrDevName, dev.Name)
+	if m.BusName != "" {
+		msg.str(kvdpa.VdpaAttrMgmtDevBusName, m.BusName)
+	}
+	msg.str(kvdpa.VdpaAttrMgmtDevDevName, m.DevName)
+	msg.u32(kvdpa.VdpaAttrDevID, dev.DeviceID)
+	msg.u32(kvdpa.VdpaAttrDevVendorID, dev.VendorID)
+	msg.u32(kvdpa.VdpaAttrDevMaxVqs, dev.MaxVqs)
+	msg.u16(kvdpa.VdpaAttrDevMaxVqSize, dev.MaxVqSize)
+	msg.u16(kvdpa.VdpaAttrDevMinVqSize, dev.MinVqSize)
+	return msg
+}
+
+func (k *Kernel) devConfigMessage(dev *Device) *message {
+	msg := &message{command: kvdpa.VdpaCmdDevConfigGet}
+	msg.str(kvdpa.VdpaAttrDevName, dev.Name)
+	msg.u32(kvdpa.VdpaAttrDevID, dev.DeviceID)
+	if len(dev.MAC) > 0 {
+		msg.binary(kvdpa.VdpaAttrDevNetCfgMacAddr, dev.MAC)
+	}
+	msg.u8(kvdpa.VdpaAttrDevNetStatus, dev.Status)
+	msg.u16(kvdpa.VdpaAttrGetNetCfgMTU, dev.MTU)
+	msg.u16(kvdpa.VdpaAttrDevNetCfgMaxVqp, dev.MaxVqp)
+	if dev.Driver != "" {
+		msg.u64(kvdpa.VdpaAttrDevNegotiatedFeatures, dev.NegotiatedFeatures)
+	}
+	msg.u64(kvdpa.VdpaAttrDevFeatures, dev.Features)
+	return msg
+}
+
+func (k *Kernel) devVstatsGet(req request) ([]*message, error) {
+	dev, ok := k.devices[req.str(kvdpa.VdpaAttrDevName)]
+	if !ok {
+		return nil, syscall.ENODEV
+	}
+	if !req.has(kvdpa.VdpaAttrDevQueueIndex) {
+		return nil, syscall.EINVAL
+	}
+	queue := req.u32(kvdpa.VdpaAttrDevQueueIndex)
+	if queue >= dev.MaxVqs {
+		return nil, syscall.EINVAL
+	}
+	// Statistics are only available once the driver has set the device up
+	if dev.Driver == "" {
+		return nil, syscall.EAGAIN
+	}
+
+	msg := &message{command: kvdpa.VdpaCmdDevVstatsGet}
+	msg.str(kvdpa.VdpaAttrDevName, dev.Name)
+	msg.u32(kvdpa.VdpaAttrDevID, dev.DeviceID)
+	msg.u32(kvdpa.VdpaAttrDevQueueIndex, queue)
+	stats := dev.Stats[queue]
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		msg.str(kvdpa.VdpaAttrDevVendorAttrName, name)
+		msg.u64(kvdpa.VdpaAttrDevVendorAttrValue, stats[name])
+	}
+	return []*message{msg}, nil
+}
+
+func (k *Kernel) devAttrSet(req request) error {
+	dev, ok := k.devices[req.str(kvdpa.VdpaAttrDevName)]
+	if !ok {
+		return syscall.ENODEV
+	}
+	if !req.has(kvdpa.VdpaAttrDevNetCfgMacAddr) {
+		return syscall.EOPNOTSUPP
+	}
+	mac := req[kvdpa.VdpaAttrDevNetCfgMacAddr]
+	if len(mac) != 6 {
+		return syscall.EINVAL
+	}
+	dev.MAC = append(net.HardwareAddr{}, mac...)
+	return nil
+}
+
+// hasAttr returns whether attr is in attrs
+func hasAttr(attrs []uint16, attr uint16) bool {
+	for _, a := range attrs {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
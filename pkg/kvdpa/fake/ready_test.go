@@ -0,0 +1,57 @@
+package fake_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+)
+
+func TestWaitReady(t *testing.T) {
+	k := newKernel(t)
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa0"))
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	err := kvdpa.WaitReady(ctx, "vdpa0")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), "not bound to any driver")
+
+	// The bind is only processed by the kernel later
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		assert.NoError(t, kvdpa.BindVdpaDevice("vdpa0", kvdpa.VhostVdpaDriver))
+		assert.NoError(t, k.Sync())
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, kvdpa.WaitReadyWithOptions(ctx, "vdpa0", kvdpa.ReadyOptions{Driver: kvdpa.VhostVdpaDriver}))
+	dev, err := kvdpa.GetVdpaDevice("vdpa0")
+	require.NoError(t, err)
+	assert.NotNil(t, dev.VhostVdpa())
+
+	// The netdev is registered down
+	require.NoError(t, kvdpa.BindVdpaDevice("vdpa1", kvdpa.VirtioVdpaDriver))
+	require.NoError(t, k.Sync())
+	require.NoError(t, kvdpa.WaitReady(ctx, "vdpa1"))
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer shortCancel()
+	err = kvdpa.WaitReadyWithOptions(shortCtx, "vdpa1", kvdpa.ReadyOptions{NetDevUp: true})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), "netdev eth1 is not up")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		assert.NoError(t, k.SetNetDevUp("vdpa1", true))
+	}()
+	require.NoError(t, kvdpa.WaitReadyWithOptions(ctx, "vdpa1", kvdpa.ReadyOptions{NetDevUp: true}))
+
+	// Bound to another driver
+	err = kvdpa.WaitReadyWithOptions(shortCtx, "vdpa1", kvdpa.ReadyOptions{Driver: kvdpa.VhostVdpaDriver})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), "bound to virtio_vdpa instead of vhost_vdpa")
+}
@@ -0,0 +1,103 @@
+package fake_test
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+)
+
+func TestReconcile(t *testing.T) {
+	k := newKernel(t)
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa0"))
+	require.NoError(t, kvdpa.BindVdpaDevice("vdpa0", kvdpa.VhostVdpaDriver))
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa2"))
+	require.NoError(t, kvdpa.AddVdpaDevice("auxiliary/mlx5_core.sf.1", "stale"))
+
+	desired := &kvdpa.DesiredState{
+		Prune: true,
+		Devices: []kvdpa.DesiredDevice{
+			{Name: "vdpa0", MgmtDev: "pci/0000:65:00.2", MTU: 9000, Driver: kvdpa.VirtioVdpaDriver},
+			{Name: "vdpa1", MgmtDev: "auxiliary/mlx5_core.sf.1", MAC: "02:00:00:00:00:01", Driver: kvdpa.VhostVdpaDriver},
+			{Name: "vdpa2", MgmtDev: "pci/0000:65:00.2", MAC: "02:00:00:00:00:02"},
+		},
+	}
+	plan, err := kvdpa.PlanReconcile(desired)
+	require.NoError(t, err)
+	assert.Equal(t, `delete stale: not in the desired state
+delete vdpa0: MTU is 1500 instead of 9000
+create vdpa0: MTU is 1500 instead of 9000
+create vdpa1: does not exist
+attr-set vdpa2: MAC address is "" instead of 02:00:00:00:00:02
+rebind vdpa0: driver is "vhost_vdpa" instead of virtio_vdpa
+rebind vdpa1: new device
+`, plan.String())
+
+	results := kvdpa.ApplyPlan(plan)
+	require.Len(t, results, len(plan.Steps))
+	for _, result := range results {
+		assert.NoError(t, result.Err, result.Step.String())
+		assert.True(t, result.Changed, result.Step.String())
+	}
+
+	require.NoError(t, k.Sync())
+	devs := k.Devices()
+	require.Len(t, devs, 3)
+	assert.Equal(t, "vdpa0", devs[0].Name)
+	assert.Equal(t, uint16(9000), devs[0].MTU)
+	assert.Equal(t, kvdpa.VirtioVdpaDriver, devs[0].Driver)
+	assert.Equal(t, "vdpa1", devs[1].Name)
+	assert.Equal(t, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}, devs[1].MAC)
+	assert.Equal(t, kvdpa.VhostVdpaDriver, devs[1].Driver)
+	assert.Equal(t, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}, devs[2].MAC)
+
+	// Applying the plan again is a no-op, and so is the next plan
+	for _, result := range kvdpa.ApplyPlan(plan) {
+		assert.NoError(t, result.Err, result.Step.String())
+		assert.False(t, result.Changed, result.Step.String())
+	}
+	plan, err = kvdpa.PlanReconcile(desired)
+	require.NoError(t, err)
+	assert.Empty(t, plan.Steps)
+}
+
+func TestReconcileErrors(t *testing.T) {
+	k := newKernel(t)
+
+	invalid := []kvdpa.DesiredDevice{
+		{Name: "../vdpa0", MgmtDev: "pci/0000:65:00.2"},
+		{Name: "vdpa0", MgmtDev: "a/b/c"},
+		{Name: "vdpa0", MgmtDev: "pci/0000:65:00.2", MAC: "02:00"},
+		{Name: "vdpa0", MgmtDev: "pci/0000:65:00.2", Driver: "unknown"},
+	}
+	for _, d := range invalid {
+		_, err := kvdpa.PlanReconcile(&kvdpa.DesiredState{Devices: []kvdpa.DesiredDevice{d}})
+		assert.Error(t, err, d.Name)
+	}
+	_, err := kvdpa.PlanReconcile(&kvdpa.DesiredState{Devices: []kvdpa.DesiredDevice{
+		{Name: "vdpa0", MgmtDev: "pci/0000:65:00.2"},
+		{Name: "vdpa0", MgmtDev: "pci/0000:65:00.2"},
+	}})
+	assert.ErrorIs(t, err, syscall.EINVAL)
+
+	// The steps after a failed one are skipped, other devices are reconciled
+	results, err := kvdpa.Reconcile(&kvdpa.DesiredState{Devices: []kvdpa.DesiredDevice{
+		{Name: "vdpa0", MgmtDev: "pci/0000:66:00.2", Driver: kvdpa.VhostVdpaDriver},
+		{Name: "vdpa1", MgmtDev: "pci/0000:65:00.2", Driver: kvdpa.VhostVdpaDriver},
+	}})
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+	assert.ErrorIs(t, results[0].Err, syscall.ENODEV)
+	assert.NoError(t, results[1].Err)
+	assert.Equal(t, kvdpa.StepRebind, results[2].Step.Action)
+	assert.ErrorIs(t, results[2].Err, kvdpa.ErrStepSkipped)
+	assert.NoError(t, results[3].Err)
+	require.NoError(t, k.Sync())
+	devs := k.Devices()
+	require.Len(t, devs, 1)
+	assert.Equal(t, kvdpa.VhostVdpaDriver, devs[0].Driver)
+}
@@ -0,0 +1,80 @@
+package fake_test
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+)
+
+func TestSnapshot(t *testing.T) {
+	k := newKernel(t)
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa0"))
+	require.NoError(t, kvdpa.BindVdpaDevice("vdpa0", kvdpa.VhostVdpaDriver))
+	require.NoError(t, kvdpa.AddVdpaDevice("auxiliary/mlx5_core.sf.1", "vdpa1"))
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa2"))
+
+	before, err := kvdpa.TakeSnapshot()
+	require.NoError(t, err)
+	require.Len(t, before.Devices, 3)
+	vdpa0 := before.Devices[0]
+	assert.Equal(t, "pci/0000:65:00.2", vdpa0.MgmtDev)
+	assert.Equal(t, "pci0000:00/0000:65:00.2", vdpa0.Parent)
+	assert.Equal(t, "0000:65:00.2", vdpa0.ParentPCIAddress)
+	assert.Equal(t, filepath.Join(k.DevfsRoot(), "vhost-vdpa-0"), vdpa0.VhostPath)
+	require.NotNil(t, vdpa0.Config)
+	assert.Equal(t, uint16(1500), vdpa0.Config.MTU)
+	assert.Equal(t, "0000:65:00.0", before.Devices[1].ParentPCIAddress)
+
+	// The encoding is stable
+	again, err := kvdpa.TakeSnapshot()
+	require.NoError(t, err)
+	again.Time = before.Time
+	encoded, err := json.Marshal(before)
+	require.NoError(t, err)
+	encodedAgain, err := json.Marshal(again)
+	require.NoError(t, err)
+	assert.Equal(t, string(encoded), string(encodedAgain))
+	assert.True(t, kvdpa.DiffSnapshots(before, again).Empty())
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	require.NoError(t, before.Save(path))
+	loaded, err := kvdpa.LoadSnapshot(path)
+	require.NoError(t, err)
+	assert.True(t, kvdpa.DiffSnapshots(before, loaded).Empty())
+
+	// The event
+	require.NoError(t, kvdpa.UnbindVdpaDevice("vdpa0"))
+	require.NoError(t, kvdpa.BindVdpaDevice("vdpa0", kvdpa.VirtioVdpaDriver))
+	require.NoError(t, kvdpa.SetVdpaDeviceMacAddr("vdpa2", net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}))
+	require.NoError(t, kvdpa.DeleteVdpaDevice("vdpa1"))
+	require.NoError(t, kvdpa.AddVdpaDevice("auxiliary/mlx5_core.sf.1", "vdpa3"))
+
+	after, err := kvdpa.TakeSnapshot()
+	require.NoError(t, err)
+	diff := kvdpa.DiffSnapshots(before, after)
+	assert.Empty(t, diff.AddedMgmtDevs)
+	assert.Empty(t, diff.RemovedMgmtDevs)
+	assert.Equal(t, []string{"vdpa3"}, diff.Added)
+	assert.Equal(t, []string{"vdpa1"}, diff.Removed)
+	require.Len(t, diff.Changed, 2)
+	assert.Equal(t, kvdpa.DeviceChange{
+		Name: "vdpa0",
+		Fields: []kvdpa.FieldChange{
+			{Field: "driver", Before: kvdpa.VhostVdpaDriver, After: kvdpa.VirtioVdpaDriver},
+			{Field: "vhostPath", Before: vdpa0.VhostPath, After: ""},
+			{Field: "virtioName", Before: "", After: "virtio0"},
+			{Field: "netdev", Before: "", After: "eth0"},
+		},
+	}, diff.Changed[0])
+	assert.Equal(t, kvdpa.DeviceChange{
+		Name:   "vdpa2",
+		Fields: []kvdpa.FieldChange{{Field: "config.mac", Before: "", After: "02:00:00:00:00:02"}},
+	}, diff.Changed[1])
+	assert.Contains(t, diff.String(), "~ device vdpa2\n    config.mac: \"\" -> \"02:00:00:00:00:02\"\n")
+}
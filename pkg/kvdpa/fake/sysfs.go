@@ -0,0 +1,345 @@
+package fake
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+)
+
+// firstIRQ is the number of the first MSI-X interrupt
+const firstIRQ = 100
+
+// vdpaDrivers are the vdpa bus drivers rendered in sysfs
+var vdpaDrivers = []string{kvdpa.VhostVdpaDriver, kvdpa.VirtioVdpaDriver}
+
+func (k *Kernel) sysPath(elem ...string) string {
+	return filepath.Join(append([]string{k.SysfsRoot()}, elem...)...)
+}
+
+// renderBase creates the sysfs and devfs skeleton: buses, drivers and the
+// drivers' bind and unbind files
+func (k *Kernel) renderBase() error {
+	dirs := []string{
+		k.sysPath("devices/pci0000:00"),
+		k.sysPath("bus/vdpa/devices"),
+		k.sysPath("bus/virtio/devices"),
+		k.sysPath("bus/pci/devices"),
+		k.sysPath("bus/auxiliary/devices"),
+		k.DevfsRoot(),
+		filepath.Join(k.ProcRoot(), "irq"),
+	}
+	for _, driver := range vdpaDrivers {
+		dirs = append(dirs, k.sysPath("bus/vdpa/drivers", driver))
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	for _, driver := range vdpaDrivers {
+		for _, file := range []string{"bind", "unbind"} {
+			if err := ioutil.WriteFile(k.sysPath("bus/vdpa/drivers", driver, file), nil, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mgmtDevPath returns the sysfs device path of a management device
+func (k *Kernel) mgmtDevPath(m *MgmtDev) string {
+	switch m.BusName {
+	case "pci":
+		return k.sysPath("devices/pci0000:00", m.DevName)
+	case "auxiliary":
+		return k.sysPath("devices/pci0000:00", m.ParentPCIAddress, m.DevName)
+	}
+	return k.sysPath("devices", m.DevName)
+}
+
+// renderMgmtDev creates the sysfs device of a management device and, for
+// auxiliary devices, its parent PCI device
+func (k *Kernel) renderMgmtDev(m *MgmtDev) error {
+	switch m.BusName {
+	case "pci":
+		return k.renderPCIDevice(m.DevName, m)
+	case "auxiliary":
+		if m.ParentPCIAddress == "" {
+			return fmt.Errorf("auxiliary management device %s requires a parent PCI address", m.DevName)
+		}
+		if _, err := os.Stat(k.sysPath("bus/pci/devices", m.ParentPCIAddress)); os.IsNotExist(err) {
+			if err := k.renderPCIDevice(m.ParentPCIAddress, m); err != nil {
+				return err
+			}
+		}
+		return k.renderBusDevice(k.mgmtDevPath(m), "auxiliary")
+	case "":
+		return os.MkdirAll(k.mgmtDevPath(m), 0755)
+	}
+	return fmt.Errorf("unsupported management device bus %s", m.BusName)
+}
+
+// renderPCIDevice creates a PCI device with the NUMA information and the
+// MSI-X interrupts of a management device
+func (k *Kernel) renderPCIDevice(address string, m *MgmtDev) error {
+	path := k.sysPath("devices/pci0000:00", address)
+	if err := k.renderBusDevice(path, "pci"); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "numa_node"), []byte(fmt.Sprintf("%d\n", m.NumaNode)), 0644); err != nil {
+		return err
+	}
+	if m.LocalCPUs != "" {
+		if err := ioutil.WriteFile(filepath.Join(path, "local_cpulist"), []byte(m.LocalCPUs+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	if m.MSIXVectors == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(path, "msi_irqs"), 0755); err != nil {
+		return err
+	}
+	for vector := 0; vector < m.MSIXVectors; vector++ {
+		irq := strconv.Itoa(k.nextIRQ)
+		k.nextIRQ++
+		if err := ioutil.WriteFile(filepath.Join(path, "msi_irqs", irq), []byte("msix\n"), 0644); err != nil {
+			return err
+		}
+		// The interrupts can be delivered to any CPU
+		action := fmt.Sprintf("mlx5_comp%d@pci:%s", vector, address)
+		if err := os.MkdirAll(filepath.Join(k.ProcRoot(), "irq", irq, action), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(k.ProcRoot(), "irq", irq, "smp_affinity"), []byte("ffffffff\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderBusDevice creates a device directory and links it with its bus
+func (k *Kernel) renderBusDevice(path, bus string) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	if err := os.Symlink(k.sysPath("bus", bus), filepath.Join(path, "subsystem")); err != nil {
+		return err
+	}
+	return os.Symlink(path, k.sysPath("bus", bus, "devices", filepath.Base(path)))
+}
+
+// renderDevice creates the sysfs device of a vdpa device
+func (k *Kernel) renderDevice(dev *Device) error {
+	path := filepath.Join(k.mgmtDevPath(k.mgmtDev(dev.MgmtDev)), dev.Name)
+	if err := k.renderBusDevice(path, "vdpa"); err != nil {
+		return err
+	}
+	k.emit("add", path, "vdpa", nil)
+	return nil
+}
+
+// renderDelete removes the sysfs device of a vdpa device
+func (k *Kernel) renderDelete(dev *Device) error {
+	path := filepath.Join(k.mgmtDevPath(k.mgmtDev(dev.MgmtDev)), dev.Name)
+	if err := os.Remove(k.sysPath("bus/vdpa/devices", dev.Name)); err != nil {
+		return err
+	}
+	// Like kernfs, which does not reuse inode numbers right away, the
+	// directory is moved out of the tree rather than removed: a device
+	// created again with the same name gets another inode
+	deleted := filepath.Join(k.root, "deleted")
+	if err := os.MkdirAll(deleted, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(path, filepath.Join(deleted, strconv.Itoa(dev.index))); err != nil {
+		return err
+	}
+	k.emit("remove", path, "vdpa", nil)
+	return nil
+}
+
+// virtioPath returns the sysfs path of the virtio device of a vdpa device.
+// As kvdpa expects, it is created in the vdpa device's parent
+func (k *Kernel) virtioPath(dev *Device) string {
+	parent := k.mgmtDevPath(k.mgmtDev(dev.MgmtDev))
+	return filepath.Join(parent, fmt.Sprintf("virtio%d", dev.index))
+}
+
+// renderBind creates the driver links and the endpoint of a bound device:
+// the vhost-vdpa device (and its device node) or the virtio device and netdev
+func (k *Kernel) renderBind(dev *Device) error {
+	path := filepath.Join(k.mgmtDevPath(k.mgmtDev(dev.MgmtDev)), dev.Name)
+	if err := os.Symlink(k.sysPath("bus/vdpa/drivers", dev.Driver), filepath.Join(path, "driver")); err != nil {
+		return err
+	}
+	if err := os.Symlink(path, k.sysPath("bus/vdpa/drivers", dev.Driver, dev.Name)); err != nil {
+		return err
+	}
+
+	switch dev.Driver {
+	case kvdpa.VhostVdpaDriver:
+		vhostName := fmt.Sprintf("vhost-vdpa-%d", dev.index)
+		vhostPath := filepath.Join(path, vhostName)
+		if err := os.MkdirAll(vhostPath, 0755); err != nil {
+			return err
+		}
+		// Device nodes cannot be created without privileges
+		if err := os.Symlink("/dev/null", filepath.Join(k.DevfsRoot(), vhostName)); err != nil {
+			return err
+		}
+		k.emit("add", vhostPath, "vhost-vdpa", map[string]string{"DEVNAME": vhostName})
+	case kvdpa.VirtioVdpaDriver:
+		virtioPath := k.virtioPath(dev)
+		netName := fmt.Sprintf("eth%d", dev.index)
+		if err := k.renderBusDevice(virtioPath, "virtio"); err != nil {
+			return err
+		}
+		files := map[string]string{
+			"device":   fmt.Sprintf("0x%04x\n", dev.DeviceID),
+			"vendor":   fmt.Sprintf("0x%04x\n", dev.VendorID),
+			"features": featureBits(dev.NegotiatedFeatures) + "\n",
+		}
+		for name, content := range files {
+			if err := ioutil.WriteFile(filepath.Join(virtioPath, name), []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+		if err := k.renderNetDev(dev); err != nil {
+			return err
+		}
+		k.emit("add", virtioPath, "virtio", nil)
+		k.emit("add", filepath.Join(virtioPath, "net", netName), "net", map[string]string{"INTERFACE": netName})
+	}
+	k.emit("bind", path, "vdpa", map[string]string{"DRIVER": dev.Driver})
+	return nil
+}
+
+// netDevPath returns the sysfs path of the netdev of a device bound to the
+// virtio_vdpa driver
+func (k *Kernel) netDevPath(dev *Device) string {
+	return filepath.Join(k.virtioPath(dev), "net", fmt.Sprintf("eth%d", dev.index))
+}
+
+// renderNetDev creates the netdev of a device bound to the virtio_vdpa
+// driver. Netdevs are registered down, with the MAC address of the device or
+// a generated one
+func (k *Kernel) renderNetDev(dev *Device) error {
+	path := k.netDevPath(dev)
+	if err := os.MkdirAll(filepath.Join(path, "statistics"), 0755); err != nil {
+		return err
+	}
+	mac := dev.MAC
+	if len(mac) == 0 {
+		mac = net.HardwareAddr{0x02, 0, 0, 0, byte(dev.index >> 8), byte(dev.index)}
+	}
+	files := map[string]string{
+		"address":   mac.String(),
+		"mtu":       fmt.Sprintf("%d", dev.MTU),
+		"operstate": "down",
+		"carrier":   "0",
+	}
+	for _, name := range netDevStatsFiles {
+		files[filepath.Join("statistics", name)] = "0"
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(path, name), []byte(content+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// netDevStatsFiles are the files of a netdev "statistics" directory, in the
+// order of the kvdpa.NetDevStats fields
+var netDevStatsFiles = []string{
+	"rx_bytes", "rx_packets", "rx_errors", "rx_dropped",
+	"tx_bytes", "tx_packets", "tx_errors", "tx_dropped",
+}
+
+// renderUnbind removes what renderBind created
+func (k *Kernel) renderUnbind(dev *Device) error {
+	path := filepath.Join(k.mgmtDevPath(k.mgmtDev(dev.MgmtDev)), dev.Name)
+	switch dev.Driver {
+	case kvdpa.VhostVdpaDriver:
+		vhostName := fmt.Sprintf("vhost-vdpa-%d", dev.index)
+		vhostPath := filepath.Join(path, vhostName)
+		if err := os.Remove(filepath.Join(k.DevfsRoot(), vhostName)); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(vhostPath); err != nil {
+			return err
+		}
+		k.emit("remove", vhostPath, "vhost-vdpa", map[string]string{"DEVNAME": vhostName})
+	case kvdpa.VirtioVdpaDriver:
+		virtioPath := k.virtioPath(dev)
+		netName := fmt.Sprintf("eth%d", dev.index)
+		if err := os.Remove(k.sysPath("bus/virtio/devices", filepath.Base(virtioPath))); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(virtioPath); err != nil {
+			return err
+		}
+		k.emit("remove", filepath.Join(virtioPath, "net", netName), "net", map[string]string{"INTERFACE": netName})
+		k.emit("remove", virtioPath, "virtio", nil)
+	}
+
+	if err := os.Remove(k.sysPath("bus/vdpa/drivers", dev.Driver, dev.Name)); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(path, "driver")); err != nil {
+		return err
+	}
+	k.emit("unbind", path, "vdpa", nil)
+	return nil
+}
+
+// syncSysfs processes the device names written to the drivers' bind and
+// unbind files. Writes the kernel would have rejected (e.g: unknown devices)
+// are dropped. Unbinds are processed first so that a device can be moved
+// from a driver to another
+func (k *Kernel) syncSysfs() error {
+	for _, file := range []string{"unbind", "bind"} {
+		for _, driver := range vdpaDrivers {
+			path := k.sysPath("bus/vdpa/drivers", driver, file)
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if len(content) == 0 {
+				continue
+			}
+			if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+				return err
+			}
+			for _, name := range strings.Fields(string(content)) {
+				if file == "bind" {
+					_ = k.bind(name, driver)
+				} else if dev, ok := k.devices[name]; ok && dev.Driver == driver {
+					_ = k.unbind(name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// featureBits formats a feature bitmask the way the virtio "features" sysfs
+// file does: one character per feature bit, starting with bit 0
+func featureBits(features uint64) string {
+	var b strings.Builder
+	for bit := 0; bit < 64; bit++ {
+		if features&(1<<uint(bit)) != 0 {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,133 @@
+package fake_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/fake"
+)
+
+func TestTopology(t *testing.T) {
+	k := newKernel(t)
+	require.NoError(t, k.AddMgmtDev(fake.MgmtDev{
+		DevName:     "vdpasim_net",
+		ConfigAttrs: []uint16{kvdpa.VdpaAttrDevNetCfgMacAddr, kvdpa.VdpaAttrGetNetCfgMTU},
+	}))
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	require.NoError(t, kvdpa.AddVdpaDeviceWithConfig("pci/0000:65:00.2", "vdpa0",
+		&kvdpa.VdpaNetConfig{MacAddr: mac, MTU: 9000}))
+	require.NoError(t, kvdpa.BindVdpaDevice("vdpa0", kvdpa.VhostVdpaDriver))
+	require.NoError(t, kvdpa.AddVdpaDevice("auxiliary/mlx5_core.sf.1", "vdpa1"))
+	require.NoError(t, kvdpa.BindVdpaDevice("vdpa1", kvdpa.VirtioVdpaDriver))
+	require.NoError(t, kvdpa.AddVdpaDevice("vdpasim_net", "vdpa2"))
+
+	topology, err := kvdpa.ExportTopology()
+	require.NoError(t, err)
+	assert.Equal(t, []kvdpa.TopologyMgmtDev{
+		{Name: "pci/0000:65:00.2", PCIAddress: "0000:65:00.2"},
+		{Name: "auxiliary/mlx5_core.sf.1", PCIAddress: "0000:65:00.0"},
+		{Name: "vdpasim_net"},
+	}, topology.MgmtDevs)
+	require.Len(t, topology.Devices, 3)
+	assert.Equal(t, "02:00:00:00:00:01", topology.Devices[0].MAC)
+	assert.Equal(t, uint16(9000), topology.Devices[0].MTU)
+	assert.Equal(t, kvdpa.VhostVdpaDriver, topology.Devices[0].Driver)
+	// The defaults are not exported: vdpasim_net cannot provision them
+	assert.Equal(t, kvdpa.TopologyDevice{Name: "vdpa2", MgmtDev: "vdpasim_net"}, topology.Devices[2])
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "topology.json")
+	require.NoError(t, topology.Save(path))
+	require.NoError(t, topology.Save(path))
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	topology, err = kvdpa.LoadTopology(path)
+	require.NoError(t, err)
+
+	// After a reboot: the SF got another name and vdpasim is not loaded
+	rebooted, err := fake.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, rebooted.AddMgmtDev(fake.MgmtDev{BusName: "pci", DevName: "0000:65:00.2", VendorID: 0x15b3}))
+	require.NoError(t, rebooted.AddMgmtDev(fake.MgmtDev{
+		BusName:          "auxiliary",
+		DevName:          "mlx5_core.sf.4",
+		ParentPCIAddress: "0000:65:00.0",
+		VendorID:         0x15b3,
+	}))
+	t.Cleanup(rebooted.Install())
+
+	report, err := kvdpa.RestoreTopology(topology)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"pci/0000:65:00.2":         "pci/0000:65:00.2",
+		"auxiliary/mlx5_core.sf.1": "auxiliary/mlx5_core.sf.4",
+	}, report.MgmtDevs)
+	require.Len(t, report.Failures, 1)
+	assert.ErrorIs(t, report.Failures["vdpa2"], kvdpa.ErrMgmtDevNotFound)
+
+	require.NoError(t, rebooted.Sync())
+	devs := rebooted.Devices()
+	require.Len(t, devs, 2)
+	assert.Equal(t, mac, devs[0].MAC)
+	assert.Equal(t, uint16(9000), devs[0].MTU)
+	assert.Equal(t, kvdpa.VhostVdpaDriver, devs[0].Driver)
+	assert.Equal(t, "auxiliary/mlx5_core.sf.4", devs[1].MgmtDev)
+	assert.Equal(t, kvdpa.VirtioVdpaDriver, devs[1].Driver)
+
+	// Restoring again does not change anything
+	report, err = kvdpa.RestoreTopology(topology)
+	require.NoError(t, err)
+	assert.Empty(t, report.Steps)
+	assert.Len(t, report.Failures, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = kvdpa.RestoreTopologyContext(ctx, topology)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = kvdpa.CapabilitiesContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTopologyDefaults(t *testing.T) {
+	k := newKernel(t)
+	simulator := fake.MgmtDev{
+		DevName:     "vdpasim_net",
+		ConfigAttrs: []uint16{kvdpa.VdpaAttrDevNetCfgMacAddr, kvdpa.VdpaAttrGetNetCfgMTU},
+	}
+	require.NoError(t, k.AddMgmtDev(simulator))
+	require.NoError(t, kvdpa.AddVdpaDevice("vdpasim_net", "vdpa0"))
+	require.NoError(t, kvdpa.AddVdpaDeviceWithConfig("vdpasim_net", "vdpa1", &kvdpa.VdpaNetConfig{MTU: 9000}))
+	// The simulator rejects the attributes it cannot provision
+	assert.ErrorIs(t, kvdpa.AddVdpaDeviceWithConfig("vdpasim_net", "vdpa2", &kvdpa.VdpaNetConfig{MaxVqp: 1}),
+		syscall.EOPNOTSUPP)
+
+	topology, err := kvdpa.ExportTopology()
+	require.NoError(t, err)
+	assert.Equal(t, []kvdpa.TopologyDevice{
+		{Name: "vdpa0", MgmtDev: "vdpasim_net"},
+		{Name: "vdpa1", MgmtDev: "vdpasim_net", MTU: 9000},
+	}, topology.Devices)
+
+	rebooted, err := fake.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, rebooted.AddMgmtDev(simulator))
+	t.Cleanup(rebooted.Install())
+
+	report, err := kvdpa.RestoreTopology(topology)
+	require.NoError(t, err)
+	assert.Empty(t, report.Failures)
+	require.NoError(t, rebooted.Sync())
+	devs := rebooted.Devices()
+	require.Len(t, devs, 2)
+	assert.Equal(t, uint16(1500), devs[0].MTU)
+	assert.Equal(t, uint16(9000), devs[1].MTU)
+}
@@ -0,0 +1,101 @@
+package fake_test
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa"
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/fake"
+)
+
+func TestVirtioNet(t *testing.T) {
+	k := newKernel(t)
+	const features = 1<<5 | 1<<16 | 1<<32 | 1<<45
+	require.NoError(t, k.AddMgmtDev(fake.MgmtDev{
+		BusName:           "pci",
+		DevName:           "0000:66:00.2",
+		SupportedFeatures: features,
+	}))
+	mac, err := net.ParseMAC("00:11:22:33:44:55")
+	require.NoError(t, err)
+	require.NoError(t, kvdpa.AddVdpaDeviceWithConfig("pci/0000:66:00.2", "vdpa0",
+		&kvdpa.VdpaNetConfig{MacAddr: mac, MTU: 9000}))
+	require.NoError(t, kvdpa.BindVdpaDevice("vdpa0", kvdpa.VirtioVdpaDriver))
+	require.NoError(t, k.Sync())
+
+	dev, err := kvdpa.GetVdpaDevice("vdpa0")
+	require.NoError(t, err)
+	require.NotNil(t, dev.VirtioNet())
+	virtioNet := dev.VirtioNet()
+	assert.Equal(t, "eth0", dev.VirtioNet().NetDev())
+	assert.Equal(t, mac, virtioNet.MAC())
+	assert.Equal(t, 9000, virtioNet.MTU())
+	assert.Equal(t, "down", virtioNet.OperState())
+	assert.False(t, virtioNet.Carrier())
+	assert.Equal(t, uint64(features), virtioNet.Features())
+	assert.Equal(t, []string{"VIRTIO_NET_F_MAC", "VIRTIO_NET_F_STATUS", "VIRTIO_F_VERSION_1", "bit 45"},
+		virtioNet.FeatureNames())
+
+	stats, err := virtioNet.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, &kvdpa.NetDevStats{}, stats)
+	// The statistics are read on every call
+	require.NoError(t, k.SetNetDevStats("vdpa0", kvdpa.NetDevStats{RxBytes: 1500, RxPackets: 1, TxDropped: 3}))
+	stats, err = virtioNet.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, &kvdpa.NetDevStats{RxBytes: 1500, RxPackets: 1, TxDropped: 3}, stats)
+
+	require.NoError(t, k.SetNetDevUp("vdpa0", true))
+	dev, err = kvdpa.GetVdpaDevice("vdpa0")
+	require.NoError(t, err)
+	assert.Equal(t, "up", dev.VirtioNet().OperState())
+	assert.True(t, dev.VirtioNet().Carrier())
+
+	// The netdev of a device without MAC address has a generated one
+	require.NoError(t, kvdpa.AddVdpaDevice("pci/0000:65:00.2", "vdpa1"))
+	require.NoError(t, kvdpa.BindVdpaDevice("vdpa1", kvdpa.VirtioVdpaDriver))
+	require.NoError(t, k.Sync())
+	dev, err = kvdpa.GetVdpaDevice("vdpa1")
+	require.NoError(t, err)
+	assert.Len(t, dev.VirtioNet().MAC(), 6)
+	assert.Equal(t, 1500, dev.VirtioNet().MTU())
+	assert.Empty(t, dev.VirtioNet().FeatureNames())
+
+	// The netdev is gone
+	require.NoError(t, kvdpa.UnbindVdpaDevice("vdpa0"))
+	require.NoError(t, k.Sync())
+	_, err = virtioNet.Stats()
+	assert.ErrorIs(t, err, syscall.ENOENT)
+}
+
+func TestVirtioNetFeatureNames(t *testing.T) {
+	names := []string{
+		"VIRTIO_NET_F_GSO",
+		"VIRTIO_NET_F_GUEST_TSO4",
+		"VIRTIO_NET_F_GUEST_TSO6",
+		"VIRTIO_NET_F_GUEST_ECN",
+		"VIRTIO_NET_F_GUEST_UFO",
+		"VIRTIO_NET_F_HOST_TSO4",
+		"VIRTIO_NET_F_HOST_TSO6",
+		"VIRTIO_NET_F_HOST_ECN",
+		"VIRTIO_NET_F_HOST_UFO",
+		"VIRTIO_NET_F_MRG_RXBUF",
+		"VIRTIO_NET_F_STATUS",
+		"VIRTIO_NET_F_CTRL_VQ",
+		"VIRTIO_NET_F_CTRL_RX",
+		"VIRTIO_NET_F_CTRL_VLAN",
+		"VIRTIO_NET_F_CTRL_RX_EXTRA",
+		"VIRTIO_NET_F_GUEST_ANNOUNCE",
+		"VIRTIO_NET_F_MQ",
+		"VIRTIO_NET_F_CTRL_MAC_ADDR",
+	}
+	for i, name := range names {
+		bit := uint(6 + i)
+		assert.Equal(t, []string{name}, kvdpa.VirtioNetFeatureNames(1<<bit), "bit %d", bit)
+	}
+	assert.Equal(t, names, kvdpa.VirtioNetFeatureNames(0xffffc0))
+}
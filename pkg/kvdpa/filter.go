@@ -0,0 +1,100 @@
+package kvdpa
+
+import (
+	"github.com/vishvananda/netlink/nl"
+)
+
+// VdpaDeviceFilter selects the vdpa devices returned by ListVdpaDevices.
+// Empty (or nil) fields match any device.
+type VdpaDeviceFilter struct {
+	// MgmtBusName and MgmtDevName select the devices of a management device.
+	// MgmtBusName is only taken into account if MgmtDevName is set,
+	// in which case it has to match exactly (an empty bus name included)
+	MgmtBusName string
+	MgmtDevName string
+	// Driver selects the devices bound to the given driver (e.g: VhostVdpaDriver)
+	Driver string
+	// DeviceID selects the devices of a virtio device class (e.g: VirtioIDNet)
+	DeviceID uint32
+	// VendorID selects the devices with the given virtio vendor ID
+	VendorID *uint32
+	// ParentPCIAddress selects the devices whose parent PCI device has the
+	// given address (e.g: 0000:65:00.2)
+	ParentPCIAddress string
+	// NumaNode selects the devices whose parent PCI device is in the given NUMA node
+	NumaNode *int
+}
+
+// matchAttributes returns whether the device matches all the filters based
+// on the information retrieved from netlink
+func matchAttributes(dev *vdpaDev, filters []VdpaDeviceFilter) bool {
+	for _, f := range filters {
+		if f.MgmtDevName != "" &&
+			(dev.mgmtDev == nil ||
+				dev.mgmtDev.busName != f.MgmtBusName ||
+				dev.mgmtDev.devName != f.MgmtDevName) {
+			return false
+		}
+		if f.DeviceID != 0 && dev.deviceID != f.DeviceID {
+			return false
+		}
+		if f.VendorID != nil && dev.vendorID != *f.VendorID {
+			return false
+		}
+	}
+	return true
+}
+
+// matchBusInfo returns whether the device matches all the filters based on
+// the information retrieved from sysfs
+func matchBusInfo(dev *vdpaDev, filters []VdpaDeviceFilter) (bool, error) {
+	for _, f := range filters {
+		if f.Driver != "" && dev.driver != f.Driver {
+			return false, nil
+		}
+		if f.ParentPCIAddress != "" {
+			pciAddress, err := dev.parentPCIAddress()
+			if err != nil {
+				return false, err
+			}
+			if pciAddress != f.ParentPCIAddress {
+				return false, nil
+			}
+		}
+		if f.NumaNode != nil {
+			node, err := dev.numaNode()
+			if err != nil {
+				return false, err
+			}
+			if node != *f.NumaNode {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// mgmtDevFilterAttrs returns the netlink attributes that ask the kernel to
+// only dump the devices of the filtered management device. Kernels that do not
+// support it simply ignore them, so the filtering is also performed locally
+func mgmtDevFilterAttrs(filters []VdpaDeviceFilter) ([]*nl.RtAttr, error) {
+	for _, f := range filters {
+		if f.MgmtDevName == "" {
+			continue
+		}
+		data := []*nl.RtAttr{}
+		if f.MgmtBusName != "" {
+			bus, err := GetNetlinkOps().NewAttribute(VdpaAttrMgmtDevBusName, f.MgmtBusName)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, bus)
+		}
+		dev, err := GetNetlinkOps().NewAttribute(VdpaAttrMgmtDevDevName, f.MgmtDevName)
+		if err != nil {
+			return nil, err
+		}
+		return append(data, dev), nil
+	}
+	return nil, nil
+}
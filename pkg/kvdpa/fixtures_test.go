@@ -0,0 +1,144 @@
+package kvdpa
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of the simulator netlink sessions")
+
+var commandNames = map[uint8]string{
+	VdpaCmdMgmtDevGet:   "MgmtDevGet",
+	VdpaCmdDevNew:       "DevNew",
+	VdpaCmdDevDel:       "DevDel",
+	VdpaCmdDevGet:       "DevGet",
+	VdpaCmdDevConfigGet: "DevConfigGet",
+	VdpaCmdDevVstatsGet: "DevVstatsGet",
+	VdpaCmdDevAttrSet:   "DevAttrSet",
+}
+
+// describeFixture runs the parsers against every recorded response and
+// returns a description of the result
+func describeFixture(t *testing.T, fixture *Fixture) string {
+	var b strings.Builder
+	if fixture.Family != nil {
+		if fixture.Family.Error != "" {
+			fmt.Fprintf(&b, "family: error: %s\n", fixture.Family.Error)
+		} else {
+			fmt.Fprintf(&b, "family: version=%d maxAttr=%d commands=%v\n",
+				fixture.Family.Version, fixture.Family.MaxAttr, fixture.Family.Commands)
+		}
+	}
+	for i, exchange := range fixture.Exchanges {
+		fmt.Fprintf(&b, "exchange %d: %s dump=%t\n", i, commandNames[exchange.Command],
+			exchange.Flags&syscall.NLM_F_DUMP != 0)
+		if err := decodeError(exchange.Errno, exchange.Error); err != nil {
+			fmt.Fprintf(&b, "  error: %v\n", err)
+			continue
+		}
+		switch exchange.Command {
+		case VdpaCmdMgmtDevGet:
+			mgmtDevs, err := parseDevLinkVdpaMgmtDevList(exchange.Response)
+			require.NoError(t, err)
+			for _, m := range mgmtDevs {
+				fmt.Fprintf(&b, "  mgmtdev: %s\n", m.Name())
+			}
+		case VdpaCmdDevGet:
+			devs, err := parseDevLinkVdpaDevList(exchange.Response)
+			require.NoError(t, err)
+			for _, dev := range devs {
+				fmt.Fprintf(&b, "  device: %s mgmtdev=%s deviceID=%d vendorID=%#x\n",
+					dev.Name(), dev.MgmtDev().Name(), dev.DeviceID(), dev.VendorID())
+			}
+		}
+	}
+	return b.String()
+}
+
+// TestSimulatorFixtures runs the parsers against the sessions recorded on the
+// fake kernel: it does not tell whether they handle what real drivers send
+func TestSimulatorFixtures(t *testing.T) {
+	// The parsers look the devices up in sysfs, which must not be the host's
+	newFakeSysfs(t)
+
+	paths, err := filepath.Glob("testdata/simulator/*.json")
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			fixture, err := LoadFixture(path)
+			require.NoError(t, err)
+
+			description := describeFixture(t, fixture)
+			goldenPath := strings.TrimSuffix(path, ".json") + ".golden"
+			if *updateGolden {
+				require.NoError(t, ioutil.WriteFile(goldenPath, []byte(description), 0644))
+			}
+			golden, err := ioutil.ReadFile(goldenPath)
+			require.NoError(t, err)
+			assert.Equal(t, string(golden), description)
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	newFakeSysfs(t)
+	fixture, err := LoadFixture("testdata/simulator/sim-pci-auxiliary.json")
+	require.NoError(t, err)
+	SetNetlinkOps(NewReplayNetlinkOps(fixture))
+	defer SetNetlinkOps(&defaultNetlinkOps{})
+
+	caps, err := Capabilities()
+	require.NoError(t, err)
+	assert.True(t, caps.Create)
+
+	devs, err := ListVdpaDevices()
+	require.NoError(t, err)
+	require.Len(t, devs, 3)
+	assert.Equal(t, "vdpa0", devs[0].Name())
+	assert.Equal(t, "auxiliary/mlx5_core.sf.1", devs[2].MgmtDev().Name())
+
+	dev, err := GetVdpaDevice("vdpa1")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0x15b3), dev.VendorID())
+	_, err = GetVdpaDevice("missing")
+	assert.ErrorIs(t, err, syscall.ENODEV)
+
+	// Commands that were not recorded
+	_, err = GetVdpaDevice("vdpa3")
+	assert.Error(t, err)
+}
+
+func TestRecord(t *testing.T) {
+	fixture, err := LoadFixture("testdata/simulator/sim-vdpasim.json")
+	require.NoError(t, err)
+	recorder := NewRecordingNetlinkOps(NewReplayNetlinkOps(fixture), "test")
+	SetNetlinkOps(recorder)
+	defer SetNetlinkOps(&defaultNetlinkOps{})
+
+	_, err = ListVdpaMgmtDevices()
+	require.NoError(t, err)
+	_, err = GetVdpaDevice("missing")
+	require.ErrorIs(t, err, syscall.ENODEV)
+
+	recorded := recorder.Fixture()
+	assert.Equal(t, fixture.Family, recorded.Family)
+	require.Len(t, recorded.Exchanges, 2)
+	assert.Equal(t, fixture.Exchanges[0], recorded.Exchanges[0])
+	assert.Equal(t, syscall.ENODEV, recorded.Exchanges[1].Errno)
+
+	// Round trip
+	path := filepath.Join(t.TempDir(), "session.json")
+	require.NoError(t, recorded.Save(path))
+	loaded, err := LoadFixture(path)
+	require.NoError(t, err)
+	assert.Equal(t, recorded, loaded)
+}
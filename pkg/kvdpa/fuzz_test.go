@@ -0,0 +1,153 @@
+package kvdpa
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// addFixtureSeeds adds the recorded responses to a command as fuzzing seeds
+func addFixtureSeeds(f *testing.F, command uint8) {
+	paths, err := filepath.Glob("testdata/simulator/*.json")
+	require.NoError(f, err)
+	for _, path := range paths {
+		fixture, err := LoadFixture(path)
+		require.NoError(f, err)
+		for _, exchange := range fixture.Exchanges {
+			if exchange.Command != command {
+				continue
+			}
+			for _, msg := range exchange.Response {
+				f.Add(msg)
+			}
+		}
+	}
+}
+
+func FuzzParseDevLinkVdpaDevList(f *testing.F) {
+	// The parser looks the devices up in sysfs, which must not be the host's
+	newFakeSysfs(f)
+	addFixtureSeeds(f, VdpaCmdDevGet)
+	f.Add([]byte{})
+	f.Add(newMockSingleMessage(VdpaCmdDevNew, []*nl.RtAttr{nl.NewRtAttr(VdpaAttrDevName, []byte{})}))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		devs, err := parseDevLinkVdpaDevList([][]byte{msg})
+		if err != nil {
+			return
+		}
+		for _, dev := range devs {
+			if !validName(dev.Name()) {
+				t.Errorf("invalid device name %q", dev.Name())
+			}
+		}
+	})
+}
+
+func FuzzParseDevLinkVdpaMgmtDevList(f *testing.F) {
+	addFixtureSeeds(f, VdpaCmdMgmtDevGet)
+	f.Add([]byte{})
+	f.Add(newMockSingleMessage(VdpaCmdMgmtDevNew, []*nl.RtAttr{nl.NewRtAttr(VdpaAttrMgmtDevDevName, []byte{})}))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		mgmtDevs, err := parseDevLinkVdpaMgmtDevList([][]byte{msg})
+		if err != nil {
+			return
+		}
+		for _, m := range mgmtDevs {
+			if !validName(m.DevName()) {
+				t.Errorf("invalid management device name %q", m.DevName())
+			}
+		}
+	})
+}
+
+func TestParseAttributes(t *testing.T) {
+	str := func(attrType int, value string) *nl.RtAttr {
+		return nl.NewRtAttr(attrType, []byte(value))
+	}
+	nested := nl.NewRtAttr(VdpaAttrMax+1|nl.NLA_F_NESTED, nil)
+	nested.AddRtAttr(1, nl.Uint32Attr(7))
+
+	tests := []struct {
+		name     string
+		attrs    []*nl.RtAttr
+		err      bool
+		devName  string
+		deviceID uint32
+		raw      map[uint16][]byte
+	}{
+		{
+			name:    "NUL terminated name",
+			attrs:   []*nl.RtAttr{str(VdpaAttrDevName, "vdpa0\x00")},
+			devName: "vdpa0",
+		},
+		{
+			name:    "Unterminated name",
+			attrs:   []*nl.RtAttr{str(VdpaAttrDevName, "vdpa0")},
+			devName: "vdpa0",
+		},
+		{
+			name:    "Name with trailing garbage",
+			attrs:   []*nl.RtAttr{str(VdpaAttrDevName, "vdpa0\x00garbage")},
+			devName: "vdpa0",
+		},
+		{
+			name:  "Empty name",
+			attrs: []*nl.RtAttr{str(VdpaAttrDevName, "")},
+			err:   true,
+		},
+		{
+			name:  "Missing name",
+			attrs: []*nl.RtAttr{nl.NewRtAttr(VdpaAttrDevID, nl.Uint32Attr(VirtioIDNet))},
+			err:   true,
+		},
+		{
+			name:  "Path in name",
+			attrs: []*nl.RtAttr{str(VdpaAttrDevName, "../../vdpa0\x00")},
+			err:   true,
+		},
+		{
+			name: "Short u32",
+			attrs: []*nl.RtAttr{
+				str(VdpaAttrDevName, "vdpa0\x00"),
+				nl.NewRtAttr(VdpaAttrDevID, []byte{1, 0}),
+			},
+			err: true,
+		},
+		{
+			name: "Unknown and nested attributes",
+			attrs: []*nl.RtAttr{
+				str(VdpaAttrDevName, "vdpa0\x00"),
+				nl.NewRtAttr(VdpaAttrDevID, nl.Uint32Attr(VirtioIDNet)),
+				nl.NewRtAttr(VdpaAttrDevMaxVqs, nl.Uint32Attr(16)),
+				nested,
+			},
+			devName:  "vdpa0",
+			deviceID: VirtioIDNet,
+			raw: map[uint16][]byte{
+				VdpaAttrDevMaxVqs: nl.Uint32Attr(16),
+				VdpaAttrMax + 1:   nested.Serialize()[4:],
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newFakeSysfs(t)
+			devs, err := parseDevLinkVdpaDevList([][]byte{newMockSingleMessage(VdpaCmdDevNew, tt.attrs)})
+			if tt.err {
+				assert.ErrorIs(t, err, ErrMalformedMessage)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, devs, 1)
+			assert.Equal(t, tt.devName, devs[0].Name())
+			assert.Equal(t, tt.deviceID, devs[0].DeviceID())
+			assert.Equal(t, tt.raw, devs[0].RawAttributes())
+		})
+	}
+}
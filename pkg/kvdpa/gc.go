@@ -0,0 +1,225 @@
+package kvdpa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// DefaultGCGracePeriod is how long a device stays orphaned before it is
+// deleted if GCOptions.GracePeriod is not set. It leaves time to the
+// creators of devices to register their owner
+const DefaultGCGracePeriod = 10 * time.Minute
+
+// GCOptions configures CollectGarbage
+type GCOptions struct {
+	// GracePeriod is how long a device stays orphaned before it is deleted
+	// (DefaultGCGracePeriod if zero)
+	GracePeriod time.Duration
+	// OwnerAlive, if set, tells whether an owner still exists (e.g: whether
+	// its pod still runs). The devices of the owners that are gone are orphaned
+	OwnerAlive func(owner string) bool
+	// Filters select the devices to collect (all of them by default)
+	Filters []VdpaDeviceFilter
+	// DryRun reports the devices that would be deleted without deleting
+	// them or updating the owner registry
+	DryRun bool
+}
+
+// GCReport is the outcome of CollectGarbage
+type GCReport struct {
+	// Deleted are the orphaned devices deleted (or to delete on a dry run)
+	Deleted []string
+	// Pending are the orphaned devices still in their grace period
+	Pending []string
+	// InUse are the devices without owner that processes hold open
+	InUse map[string][]VdpaDeviceUser
+	// PrunedOwners are the devices that no longer exist whose owners were
+	// forgotten
+	PrunedOwners []string
+	// Failures are the errors by device
+	Failures map[string]error
+}
+
+func (r *GCReport) String() string {
+	return fmt.Sprintf("deleted %v, pending %v, in use %d, pruned owners %v, failures %d",
+		r.Deleted, r.Pending, len(r.InUse), r.PrunedOwners, len(r.Failures))
+}
+
+/*
+CollectGarbage deletes the orphaned vdpa devices: the devices that have no
+owner in the owner registry (see SetVdpaDeviceOwner), or whose owner is gone,
+and that no process holds open. A device is only deleted once it has been
+found orphaned for the grace period, which covers the creations whose owner is
+not registered yet: it is meant to be run periodically. Failing to handle a
+device does not stop the collection; it is reported in GCReport.Failures
+*/
+func CollectGarbage(opts GCOptions) (*GCReport, error) {
+	return CollectGarbageContext(context.Background(), opts)
+}
+
+// CollectGarbageContext is CollectGarbage with a context. Once the context is
+// done, the remaining devices are not deleted
+func CollectGarbageContext(ctx context.Context, opts GCOptions) (*GCReport, error) {
+	if opts.GracePeriod < 0 {
+		return nil, fmt.Errorf("negative grace period %v: %w", opts.GracePeriod, syscall.EINVAL)
+	}
+	if opts.GracePeriod == 0 {
+		opts.GracePeriod = DefaultGCGracePeriod
+	}
+	all, err := ListVdpaDevicesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	devs := all
+	if len(opts.Filters) > 0 {
+		if devs, err = ListVdpaDevicesContext(ctx, opts.Filters...); err != nil {
+			return nil, err
+		}
+	}
+	registry, err := loadOwnerRegistry(getOwnerRegistry())
+	if err != nil {
+		return nil, err
+	}
+	owned := func(r *ownerRegistry, name string) bool {
+		owner, ok := r.Owners[name]
+		return ok && (opts.OwnerAlive == nil || opts.OwnerAlive(owner.Owner))
+	}
+
+	report := &GCReport{
+		Deleted:      []string{},
+		Pending:      []string{},
+		InUse:        map[string][]VdpaDeviceUser{},
+		PrunedOwners: []string{},
+		Failures:     map[string]error{},
+	}
+	now := time.Now().UTC()
+	// The orphan marks of the collected devices: the zero time clears one
+	orphans := map[string]orphanMark{}
+	candidates := []string{}
+	for _, dev := range devs {
+		name := dev.Name()
+		orphans[name] = orphanMark{}
+		if owned(registry, name) {
+			continue
+		}
+		identity, err := deviceIdentity(dev)
+		if err != nil {
+			// The device was deleted meanwhile
+			if !errors.Is(err, syscall.ENODEV) {
+				report.Failures[name] = err
+			}
+			continue
+		}
+		users, err := GetVdpaDeviceUsersContext(ctx, name)
+		if err != nil {
+			report.Failures[name] = err
+			continue
+		}
+		if len(users) > 0 {
+			report.InUse[name] = users
+			continue
+		}
+		// A device created again with the same name is found anew
+		mark, ok := registry.Orphans[name]
+		if !ok || !mark.Identity.matches(identity) {
+			mark = orphanMark{Since: now, Identity: identity}
+		}
+		orphans[name] = mark
+		if now.Sub(mark.Since) >= opts.GracePeriod {
+			candidates = append(candidates, name)
+		} else {
+			report.Pending = append(report.Pending, name)
+		}
+	}
+
+	if opts.DryRun {
+		report.Deleted = candidates
+		return report, nil
+	}
+
+	exists := map[string]bool{}
+	for _, dev := range all {
+		exists[dev.Name()] = true
+	}
+	err = updateOwnerRegistry(func(r *ownerRegistry) error {
+		for name, mark := range orphans {
+			if mark.Since.IsZero() {
+				delete(r.Orphans, name)
+			} else {
+				r.Orphans[name] = mark
+			}
+		}
+		for name := range r.Owners {
+			if !exists[name] {
+				delete(r.Owners, name)
+				report.PrunedOwners = append(report.PrunedOwners, name)
+			}
+		}
+		for name := range r.Orphans {
+			if !exists[name] {
+				delete(r.Orphans, name)
+			}
+		}
+		for name := range r.Labels {
+			if !exists[name] {
+				delete(r.Labels, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(report.PrunedOwners)
+
+	for _, name := range candidates {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		deleted, recreated := false, false
+		// The registry lock keeps owners from being registered meanwhile
+		err := updateOwnerRegistry(func(r *ownerRegistry) error {
+			if owned(r, name) {
+				return nil
+			}
+			// The device may have been created again since it was found
+			dev, err := GetVdpaDeviceContext(ctx, name)
+			if errors.Is(err, syscall.ENODEV) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			identity, err := deviceIdentity(dev)
+			if err != nil {
+				return err
+			}
+			if !orphans[name].Identity.matches(identity) {
+				r.Orphans[name] = orphanMark{Since: now, Identity: identity}
+				recreated = true
+				return nil
+			}
+			if err := removeVdpaDevice(ctx, name, false); err != nil {
+				return err
+			}
+			delete(r.Owners, name)
+			delete(r.Orphans, name)
+			delete(r.Labels, name)
+			deleted = true
+			return nil
+		})
+		switch {
+		case err != nil:
+			report.Failures[name] = err
+		case deleted:
+			report.Deleted = append(report.Deleted, name)
+		case recreated:
+			report.Pending = append(report.Pending, name)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,243 @@
+package kvdpa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// genlFamilyGet resolves a generic netlink family. It is replaced by unit tests
+var genlFamilyGet = netlink.GenlFamilyGet
+
+/*
+genlClient sends the requests of a generic netlink family through a
+long-lived socket, with the family resolved once. The zero value is a client
+of the vdpa family.
+
+Requests are serialized: the socket is held for the whole exchange so that
+the responses cannot be mixed. A socket left with part of a response (e.g:
+because the context of the request was done) is closed; the next request
+opens another one.
+
+The family ID is allocated when the family is registered, so it may change
+when the kernel module is reloaded. Requests to an unknown family fail with
+ENOENT: the family is resolved again then, and the request is sent again if
+its ID changed
+*/
+type genlClient struct {
+	// name is the family name (VdpaGenlName if empty)
+	name string
+	// sem is held by the request being run. Unlike a mutex, waiting for it
+	// can be cancelled
+	sem  chan struct{}
+	once sync.Once
+
+	// Accessed with sem held
+	sock *nl.NetlinkSocket
+	pid  uint32
+
+	mu     sync.Mutex
+	family *netlink.GenlFamily
+	// tap, if set, is given the messages sent and received
+	tap func(outgoing bool, msg []byte)
+}
+
+// setTap sets the function given the messages sent and received (none if nil)
+func (c *genlClient) setTap(tap func(outgoing bool, msg []byte)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tap = tap
+}
+
+func (c *genlClient) getTap() func(outgoing bool, msg []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tap
+}
+
+// getFamily returns the family, resolving it unless it is cached
+func (c *genlClient) getFamily() (*netlink.GenlFamily, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.family != nil {
+		return c.family, nil
+	}
+	name := c.name
+	if name == "" {
+		name = VdpaGenlName
+	}
+	f, err := genlFamilyGet(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrGenlFamilyNotFound, err)
+	}
+	c.family = f
+	return f, nil
+}
+
+// forgetFamily drops the cached family if its ID is id
+func (c *genlClient) forgetFamily(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.family != nil && c.family.ID == id {
+		c.family = nil
+	}
+}
+
+// acquire takes the socket, waiting until the context is done
+func (c *genlClient) acquire(ctx context.Context) error {
+	c.once.Do(func() { c.sem = make(chan struct{}, 1) })
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case c.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *genlClient) release() {
+	<-c.sem
+}
+
+// request runs a command and returns the response messages
+func (c *genlClient) request(ctx context.Context, command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	f, err := c.getFamily()
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := c.execute(ctx, f.ID, command, flags, data)
+	if !errors.Is(err, syscall.ENOENT) {
+		return msgs, err
+	}
+	// The module may have been reloaded
+	c.forgetFamily(f.ID)
+	newF, resolveErr := c.getFamily()
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	if newF.ID == f.ID {
+		return nil, err
+	}
+	return c.execute(ctx, newF.ID, command, flags, data)
+}
+
+// execute sends a request to the family with the given ID and returns the
+// response messages. Unlike nl.NetlinkRequest.Execute, it reports
+// interrupted dumps
+func (c *genlClient) execute(ctx context.Context, familyID uint16, command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.release()
+
+	if c.sock == nil {
+		if err := c.open(); err != nil {
+			return nil, err
+		}
+	}
+	req := nl.NewNetlinkRequest(int(familyID), commonNetlinkFlags|flags)
+	req.AddData(&nl.Genlmsg{Command: command, Version: nl.GENL_CTRL_VERSION})
+	for _, d := range data {
+		req.AddData(d)
+	}
+	msgs, complete, err := c.exchange(ctx, req)
+	if !complete {
+		c.close()
+	}
+	return msgs, err
+}
+
+// open opens the socket. Its receives time out regularly so that the
+// requests can check their context
+func (c *genlClient) open() error {
+	// A socket without multicast groups
+	s, err := nl.Subscribe(syscall.NETLINK_GENERIC)
+	if err != nil {
+		return err
+	}
+	timeout := syscall.NsecToTimeval(netlinkPollInterval.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(s.GetFd(), syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		s.Close()
+		return err
+	}
+	pid, err := s.GetPid()
+	if err != nil {
+		s.Close()
+		return err
+	}
+	c.sock, c.pid = s, pid
+	return nil
+}
+
+func (c *genlClient) close() {
+	if c.sock != nil {
+		c.sock.Close()
+		c.sock = nil
+	}
+}
+
+// exchange sends a request and receives its response. It returns whether
+// the whole response was received, i.e: whether the socket can be reused
+func (c *genlClient) exchange(ctx context.Context, req *nl.NetlinkRequest) ([][]byte, bool, error) {
+	tap := c.getTap()
+	if err := c.sock.Send(req); err != nil {
+		return nil, false, err
+	}
+	if tap != nil {
+		tap(true, req.Serialize())
+	}
+	resp := &netlinkResponse{
+		seq: req.Seq,
+		pid: c.pid,
+		// The socket is reused: the ack must not be left behind
+		ack: req.Flags&syscall.NLM_F_ACK != 0 && req.Flags&syscall.NLM_F_DUMP != syscall.NLM_F_DUMP,
+	}
+	for !resp.done {
+		msgs, from, err := c.sock.Receive()
+		if errors.Is(err, syscall.EAGAIN) {
+			if err := ctx.Err(); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if from.Pid != nl.PidKernel {
+			return nil, false, fmt.Errorf("wrong sender portid %d, expected %d", from.Pid, nl.PidKernel)
+		}
+		if tap != nil {
+			for _, m := range msgs {
+				tap(false, serializeNetlinkMessage(m))
+			}
+		}
+		if err := resp.add(msgs); err != nil {
+			var errno syscall.Errno
+			// An error reply ends the response
+			return nil, errors.As(err, &errno), err
+		}
+	}
+	if resp.interrupted {
+		return nil, true, ErrDumpInterrupted
+	}
+	return resp.data, true, nil
+}
+
+// serializeNetlinkMessage returns the bytes of a received netlink message
+func serializeNetlinkMessage(m syscall.NetlinkMessage) []byte {
+	b := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(m.Data))
+	native := nl.NativeEndian()
+	native.PutUint32(b[0:4], m.Header.Len)
+	native.PutUint16(b[4:6], m.Header.Type)
+	native.PutUint16(b[6:8], m.Header.Flags)
+	native.PutUint32(b[8:12], m.Header.Seq)
+	native.PutUint32(b[12:16], m.Header.Pid)
+	return append(b, m.Data...)
+}
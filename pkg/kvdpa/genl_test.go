@@ -0,0 +1,114 @@
+package kvdpa
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// newCtrlClient returns a client of the generic netlink controller, which
+// is always registered
+func newCtrlClient(t *testing.T) *genlClient {
+	if _, err := netlink.GenlFamilyGet(nl.GENL_CTRL_NAME); err != nil {
+		t.Skipf("generic netlink is not available: %v", err)
+	}
+	c := &genlClient{name: nl.GENL_CTRL_NAME}
+	t.Cleanup(c.close)
+	return c
+}
+
+// getCtrlFamily asks the controller for its own family
+func getCtrlFamily(ctx context.Context, c *genlClient) ([][]byte, error) {
+	attr := nl.NewRtAttr(nl.GENL_CTRL_ATTR_FAMILY_NAME, nl.ZeroTerminated(nl.GENL_CTRL_NAME))
+	return c.request(ctx, nl.GENL_CTRL_CMD_GETFAMILY, 0, []*nl.RtAttr{attr})
+}
+
+func TestGenlClient(t *testing.T) {
+	c := newCtrlClient(t)
+	resolutions := 0
+	genlFamilyGet = func(name string) (*netlink.GenlFamily, error) {
+		resolutions++
+		return netlink.GenlFamilyGet(name)
+	}
+	defer func() { genlFamilyGet = netlink.GenlFamilyGet }()
+
+	msgs, err := getCtrlFamily(context.Background(), c)
+	require.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	sock := c.sock
+	require.NotNil(t, sock)
+
+	// The socket and the family are reused
+	_, err = getCtrlFamily(context.Background(), c)
+	require.NoError(t, err)
+	assert.Same(t, sock, c.sock)
+	assert.Equal(t, 1, resolutions)
+
+	// An error reply does not close the socket
+	_, err = c.request(context.Background(), nl.GENL_CTRL_CMD_GETFAMILY, 0,
+		[]*nl.RtAttr{nl.NewRtAttr(nl.GENL_CTRL_ATTR_FAMILY_NAME, nl.ZeroTerminated("kvdpa-none"))})
+	assert.ErrorIs(t, err, syscall.ENOENT)
+	assert.Same(t, sock, c.sock)
+
+	// Concurrent requests are serialized
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				msgs, err := getCtrlFamily(context.Background(), c)
+				assert.NoError(t, err)
+				assert.Len(t, msgs, 1)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGenlClientReload(t *testing.T) {
+	c := newCtrlClient(t)
+	family, err := netlink.GenlFamilyGet(nl.GENL_CTRL_NAME)
+	require.NoError(t, err)
+
+	// The cached ID is stale, as after a module reload
+	c.family = &netlink.GenlFamily{ID: 0xfff0, Name: nl.GENL_CTRL_NAME}
+	_, err = getCtrlFamily(context.Background(), c)
+	require.NoError(t, err)
+	assert.Equal(t, family.ID, c.family.ID)
+
+	// The module is unloaded
+	c.family = &netlink.GenlFamily{ID: 0xfff0, Name: nl.GENL_CTRL_NAME}
+	genlFamilyGet = func(name string) (*netlink.GenlFamily, error) {
+		return nil, syscall.ENOENT
+	}
+	defer func() { genlFamilyGet = netlink.GenlFamilyGet }()
+	_, err = getCtrlFamily(context.Background(), c)
+	assert.ErrorIs(t, err, ErrGenlFamilyNotFound)
+}
+
+func TestGenlClientContext(t *testing.T) {
+	c := newCtrlClient(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := getCtrlFamily(ctx, c)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Waiting for another request
+	require.NoError(t, c.acquire(context.Background()))
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = getCtrlFamily(ctx, c)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	c.release()
+	_, err = getCtrlFamily(context.Background(), c)
+	assert.NoError(t, err)
+}
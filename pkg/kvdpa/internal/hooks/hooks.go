@@ -0,0 +1,32 @@
+// Package hooks gives the simulator of the kvdpa/fake package access to the
+// paths and the uevent source of kvdpa. It is not part of the kvdpa API
+package hooks
+
+import "context"
+
+// UEvent is a kernel object event
+type UEvent struct {
+	Action    string
+	DevPath   string
+	Subsystem string
+	Env       map[string]string
+	// Overrun is set when the socket buffer overflowed and some uevents were lost
+	Overrun bool
+}
+
+// UEventSource returns the uevents received until the context is cancelled.
+// The channel is closed when no more uevents can be received
+type UEventSource func(ctx context.Context) (<-chan UEvent, error)
+
+// The hooks are set by kvdpa when it is initialized
+var (
+	// SetRootDirs makes kvdpa look for the sysfs and devfs trees under the
+	// provided directories instead of /sys and /dev
+	SetRootDirs func(sysfs, devfs string)
+	// SetProcRoot makes kvdpa look for the procfs tree under the provided
+	// directory instead of /proc
+	SetProcRoot func(procfs string)
+	// SetUEventSource replaces the kernel uevent socket as the source of
+	// uevents. A nil source restores the kernel uevent socket
+	SetUEventSource func(source UEventSource)
+)
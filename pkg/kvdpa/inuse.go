@@ -0,0 +1,205 @@
+package kvdpa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/internal/hooks"
+)
+
+var (
+	procMu  sync.RWMutex
+	procDir = "/proc"
+)
+
+func init() {
+	hooks.SetProcRoot = setProcRoot
+}
+
+// setProcRoot makes the library look for the procfs tree under the provided
+// directory instead of /proc
+func setProcRoot(procfs string) {
+	procMu.Lock()
+	defer procMu.Unlock()
+	procDir = procfs
+}
+
+func getProcDir() string {
+	procMu.RLock()
+	defer procMu.RUnlock()
+	return procDir
+}
+
+// ErrDeviceInUse is returned when a vdpa device is held open by a process
+var ErrDeviceInUse = errors.New("vdpa device is in use")
+
+// VdpaDeviceUser is a process that holds the vhost-vdpa device node of a
+// vdpa device open (e.g: QEMU)
+type VdpaDeviceUser struct {
+	PID int
+	// Command is the command name of the process (/proc/<pid>/comm)
+	Command string
+}
+
+func (u VdpaDeviceUser) String() string {
+	return fmt.Sprintf("%s (pid %d)", u.Command, u.PID)
+}
+
+/*
+GetVdpaDeviceUsers returns the processes that hold the vhost-vdpa device node
+of a vdpa device open, sorted by PID. A device that is not bound to the
+vhost_vdpa driver has none. The file descriptors of other users' processes
+can only be read with privileges: their processes are otherwise missed
+*/
+func GetVdpaDeviceUsers(name string) ([]VdpaDeviceUser, error) {
+	return GetVdpaDeviceUsersContext(context.Background(), name)
+}
+
+// GetVdpaDeviceUsersContext is GetVdpaDeviceUsers with a context, which is
+// checked between processes
+func GetVdpaDeviceUsersContext(ctx context.Context, name string) ([]VdpaDeviceUser, error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("invalid vdpa device name %q: %w", name, syscall.EINVAL)
+	}
+	devicePath := filepath.Join(vdpaBusDevDir, name)
+	if _, err := os.Stat(devicePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, syscall.ENODEV
+		}
+		return nil, err
+	}
+	driverLink, err := os.Readlink(filepath.Join(devicePath, "driver"))
+	if err != nil || filepath.Base(driverLink) != VhostVdpaDriver {
+		return nil, nil
+	}
+	// The device node may not be visible (e.g: in a container), so it is
+	// only named after the vhost-vdpa device of sysfs
+	entries, err := os.ReadDir(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "vhost-vdpa") && entry.IsDir() {
+			return deviceNodeUsers(ctx, filepath.Join(vdpaVhostDevDir, entry.Name()),
+				filepath.Join(devicePath, entry.Name(), "dev"))
+		}
+	}
+	// The driver is still being bound
+	return nil, nil
+}
+
+// deviceNodeUsers scans the file descriptors of every process for the
+// device node. A process in another mount namespace may see the node under
+// another path: character devices are also matched by name and device
+// number, which is read from the device's sysfs "dev" file if the node is
+// missing. If both are missing, they are matched by name only
+func deviceNodeUsers(ctx context.Context, nodePath, sysfsDevPath string) ([]VdpaDeviceUser, error) {
+	var rdev uint64
+	if info, err := os.Lstat(nodePath); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			rdev = uint64(stat.Rdev)
+		}
+	} else if rdev, err = readDevNumber(sysfsDevPath); err != nil {
+		return nil, err
+	}
+	nodeName := filepath.Base(nodePath)
+
+	procDir := getProcDir()
+	procs, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	users := []VdpaDeviceUser{}
+	for _, proc := range procs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(procDir, proc.Name(), "fd")
+		// The process may be gone or not be readable
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			fdPath := filepath.Join(fdDir, fd.Name())
+			target, err := os.Readlink(fdPath)
+			if err != nil {
+				continue
+			}
+			if target != nodePath && (filepath.Base(target) != nodeName || rdev != 0 && !isCharDevice(fdPath, rdev)) {
+				continue
+			}
+			command, _ := ioutil.ReadFile(filepath.Join(procDir, proc.Name(), "comm"))
+			users = append(users, VdpaDeviceUser{PID: pid, Command: strings.TrimSpace(string(command))})
+			break
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].PID < users[j].PID })
+	return users, nil
+}
+
+// readDevNumber reads a sysfs "dev" file (major:minor) as a device number,
+// 0 if it is missing
+func readDevNumber(path string) (uint64, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	parts := strings.Split(strings.TrimSpace(string(content)), ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid device number %s: %q", path, content)
+	}
+	major, err1 := strconv.ParseUint(parts[0], 10, 32)
+	minor, err2 := strconv.ParseUint(parts[1], 10, 32)
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("invalid device number %s: %q", path, content)
+	}
+	// The encoding of the Linux dev_t
+	return (major&0xfff)<<8 | (major&^0xfff)<<32 | minor&0xff | (minor&^0xff)<<12, nil
+}
+
+// isCharDevice returns whether a file is the character device rdev
+func isCharDevice(path string, rdev uint64) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && uint64(stat.Rdev) == rdev
+}
+
+// checkNotInUse returns ErrDeviceInUse if processes hold the device open.
+// A device missing from sysfs is left for the kernel to report
+func checkNotInUse(ctx context.Context, name string) error {
+	users, err := GetVdpaDeviceUsersContext(ctx, name)
+	if err != nil {
+		if errors.Is(err, syscall.ENODEV) {
+			return nil
+		}
+		return err
+	}
+	if len(users) == 0 {
+		return nil
+	}
+	held := make([]string, 0, len(users))
+	for _, user := range users {
+		held = append(held, user.String())
+	}
+	return fmt.Errorf("%w: %s is held open by %s", ErrDeviceInUse, name, strings.Join(held, ", "))
+}
@@ -0,0 +1,100 @@
+package kvdpa
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/mocks"
+)
+
+// addProcess adds a process to the fake proc directory with file
+// descriptors pointing to the targets
+func addProcess(t *testing.T, dir string, pid, command string, targets ...string) {
+	fdDir := filepath.Join(dir, pid, "fd")
+	require.NoError(t, os.MkdirAll(fdDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, pid, "comm"), []byte(command+"\n"), 0644))
+	for i, target := range targets {
+		require.NoError(t, os.Symlink(target, filepath.Join(fdDir, string(rune('3'+i)))))
+	}
+}
+
+func TestVdpaDeviceUsers(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	vf := sysfs.addPCIDevice(t, "0000:65:00.2", 0)
+	sysfs.addVdpaDevice(t, vf, "vdpa0", VhostVdpaDriver, 0)
+	sysfs.addVdpaDevice(t, vf, "vdpa1", VhostVdpaDriver, 1)
+	sysfs.addVdpaDevice(t, vf, "vdpa2", VirtioVdpaDriver, 2)
+	sysfs.writeFile(t, "", "sys/bus/vdpa/drivers", VhostVdpaDriver, "unbind")
+
+	proc := sysfs.mkdir(t, "proc")
+	setProcRoot(proc)
+	defer setProcRoot("/proc")
+	addProcess(t, proc, "100", "qemu-kvm", "/dev/null", sysfs.path("dev/vhost-vdpa-0"))
+	addProcess(t, proc, "42", "dpdk-testpmd", sysfs.path("dev/vhost-vdpa-0"), sysfs.path("dev/vhost-vdpa-0"))
+	addProcess(t, proc, "7", "qemu-kvm", sysfs.path("dev/vhost-vdpa-1"))
+	addProcess(t, proc, "8", "bash", "/dev/null")
+	sysfs.mkdir(t, "proc/sys")
+
+	users, err := GetVdpaDeviceUsers("vdpa0")
+	require.NoError(t, err)
+	assert.Equal(t, []VdpaDeviceUser{{PID: 42, Command: "dpdk-testpmd"}, {PID: 100, Command: "qemu-kvm"}}, users)
+	users, err = GetVdpaDeviceUsers("vdpa1")
+	require.NoError(t, err)
+	assert.Equal(t, []VdpaDeviceUser{{PID: 7, Command: "qemu-kvm"}}, users)
+	users, err = GetVdpaDeviceUsers("vdpa2")
+	require.NoError(t, err)
+	assert.Empty(t, users)
+	_, err = GetVdpaDeviceUsers("vdpa3")
+	assert.ErrorIs(t, err, syscall.ENODEV)
+
+	// The device node is not visible: the processes are matched by its name
+	require.NoError(t, os.Remove(sysfs.path("dev/vhost-vdpa-1")))
+	addProcess(t, proc, "9", "qemu-kvm", "/dev/vhost-vdpa-1")
+	users, err = GetVdpaDeviceUsers("vdpa1")
+	require.NoError(t, err)
+	assert.Equal(t, []VdpaDeviceUser{{PID: 7, Command: "qemu-kvm"}, {PID: 9, Command: "qemu-kvm"}}, users)
+
+	// Deleting and unbinding in-use devices requires forcing
+	err = DeleteVdpaDevice("vdpa0")
+	assert.ErrorIs(t, err, ErrDeviceInUse)
+	assert.EqualError(t, err, "vdpa device is in use: vdpa0 is held open by dpdk-testpmd (pid 42), qemu-kvm (pid 100)")
+	assert.ErrorIs(t, UnbindVdpaDevice("vdpa1"), ErrDeviceInUse)
+	require.NoError(t, ForceUnbindVdpaDevice("vdpa1"))
+	content, err := ioutil.ReadFile(sysfs.path("sys/bus/vdpa/drivers", VhostVdpaDriver, "unbind"))
+	require.NoError(t, err)
+	assert.Equal(t, "vdpa1", string(content))
+
+	netLinkMock := &mocks.NetlinkOps{}
+	SetNetlinkOps(netLinkMock)
+	defer SetNetlinkOps(&defaultNetlinkOps{})
+	netLinkMock.On("NewAttribute", mock.AnythingOfType("int"), mock.Anything).Return(&nl.RtAttr{}, nil)
+	netLinkMock.On("RunVdpaNetlinkCmd", VdpaCmdDevDel, mock.AnythingOfType("int"), mock.Anything).Return(nil, nil)
+	assert.NoError(t, ForceDeleteVdpaDevice("vdpa0"))
+	assert.NoError(t, DeleteVdpaDevice("vdpa2"))
+	netLinkMock.AssertNumberOfCalls(t, "RunVdpaNetlinkCmd", 2)
+}
+
+func TestReadDevNumber(t *testing.T) {
+	info, err := os.Stat("/dev/null")
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "dev")
+	require.NoError(t, ioutil.WriteFile(path, []byte("1:3\n"), 0644))
+	rdev, err := readDevNumber(path)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(info.Sys().(*syscall.Stat_t).Rdev), rdev)
+
+	rdev, err = readDevNumber(filepath.Join(t.TempDir(), "missing"))
+	require.NoError(t, err)
+	assert.Zero(t, rdev)
+	require.NoError(t, ioutil.WriteFile(path, []byte("garbage\n"), 0644))
+	_, err = readDevNumber(path)
+	assert.Error(t, err)
+}
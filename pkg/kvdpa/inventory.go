@@ -0,0 +1,370 @@
+package kvdpa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// InventoryEventType is the type of change notified by an Inventory
+type InventoryEventType int
+
+// Inventory event types
+const (
+	DeviceAdded InventoryEventType = iota
+	DeviceRemoved
+	DeviceUpdated
+	MgmtDevAdded
+	MgmtDevRemoved
+)
+
+func (t InventoryEventType) String() string {
+	switch t {
+	case DeviceAdded:
+		return "DeviceAdded"
+	case DeviceRemoved:
+		return "DeviceRemoved"
+	case DeviceUpdated:
+		return "DeviceUpdated"
+	case MgmtDevAdded:
+		return "MgmtDevAdded"
+	case MgmtDevRemoved:
+		return "MgmtDevRemoved"
+	}
+	return fmt.Sprintf("InventoryEventType(%d)", int(t))
+}
+
+// InventoryEvent is a change in the Inventory
+type InventoryEvent struct {
+	Type InventoryEventType
+	// Device is set on device events. On removal, it holds the last known state
+	Device VdpaDevice
+	// MgmtDev is set on management device events
+	MgmtDev MgmtDev
+}
+
+// Inventory keeps an in-memory snapshot of the vdpa management devices and
+// devices. It is kept up to date incrementally from the vdpa, virtio and
+// vhost-vdpa uevents and fully resynchronized periodically.
+// It is safe for concurrent use.
+type Inventory struct {
+	resyncPeriod time.Duration
+
+	// updateMu serializes the updates, mu protects the snapshot
+	updateMu sync.Mutex
+	mu       sync.RWMutex
+	mgmtDevs map[string]MgmtDev
+	devices  map[string]VdpaDevice
+
+	subMu       sync.Mutex
+	nextSubID   int
+	subscribers []subscriber
+}
+
+type subscriber struct {
+	id       int
+	callback func(InventoryEvent)
+}
+
+// NewInventory returns an empty Inventory that is fully resynchronized every
+// resyncPeriod once running. A zero resyncPeriod disables the periodic resync
+func NewInventory(resyncPeriod time.Duration) *Inventory {
+	return &Inventory{
+		resyncPeriod: resyncPeriod,
+		mgmtDevs:     map[string]MgmtDev{},
+		devices:      map[string]VdpaDevice{},
+	}
+}
+
+// Run synchronizes the inventory and keeps it up to date until the context is
+// cancelled. It returns an error if the initial synchronization fails or the
+// uevents can no longer be received
+func (inv *Inventory) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Listen before synchronizing so that no change is missed in between
+	events, err := ueventSource(ctx)
+	if err != nil {
+		return err
+	}
+	return inv.run(ctx, events)
+}
+
+func (inv *Inventory) run(ctx context.Context, events <-chan uevent) error {
+	if err := inv.resync(ctx); err != nil {
+		return err
+	}
+
+	var resync <-chan time.Time
+	if inv.resyncPeriod > 0 {
+		ticker := time.NewTicker(inv.resyncPeriod)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-resync:
+			// Errors are transient, the next resync will try again
+			_ = inv.resync(ctx)
+		case ev, ok := <-events:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("uevent listener stopped")
+			}
+			if ev.Overrun {
+				_ = inv.resync(ctx)
+				continue
+			}
+			inv.handleUEvent(ev)
+		}
+	}
+}
+
+// Resync fully resynchronizes the inventory
+func (inv *Inventory) Resync() error {
+	return inv.resync(context.Background())
+}
+
+func (inv *Inventory) resync(ctx context.Context) error {
+	inv.updateMu.Lock()
+	defer inv.updateMu.Unlock()
+
+	mgmtDevList, err := ListVdpaMgmtDevicesContext(ctx)
+	if err != nil {
+		return err
+	}
+	devList, err := ListVdpaDevicesContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	mgmtDevs := make(map[string]MgmtDev, len(mgmtDevList))
+	for _, m := range mgmtDevList {
+		mgmtDevs[m.Name()] = m
+	}
+	devices := make(map[string]VdpaDevice, len(devList))
+	for _, d := range devList {
+		devices[d.Name()] = d
+	}
+
+	inv.mu.Lock()
+	oldMgmtDevs, oldDevices := inv.mgmtDevs, inv.devices
+	inv.mgmtDevs, inv.devices = mgmtDevs, devices
+	inv.mu.Unlock()
+
+	events := []InventoryEvent{}
+	for _, name := range sortedMgmtDevNames(mgmtDevs) {
+		if _, ok := oldMgmtDevs[name]; !ok {
+			events = append(events, InventoryEvent{Type: MgmtDevAdded, MgmtDev: mgmtDevs[name]})
+		}
+	}
+	for _, name := range sortedDeviceNames(oldDevices) {
+		if _, ok := devices[name]; !ok {
+			events = append(events, InventoryEvent{Type: DeviceRemoved, Device: oldDevices[name]})
+		}
+	}
+	for _, name := range sortedDeviceNames(devices) {
+		if ev, changed := deviceEvent(oldDevices[name], devices[name]); changed {
+			events = append(events, ev)
+		}
+	}
+	for _, name := range sortedMgmtDevNames(oldMgmtDevs) {
+		if _, ok := mgmtDevs[name]; !ok {
+			events = append(events, InventoryEvent{Type: MgmtDevRemoved, MgmtDev: oldMgmtDevs[name]})
+		}
+	}
+	inv.notify(events...)
+	return nil
+}
+
+// handleUEvent refreshes the devices affected by a uevent
+func (inv *Inventory) handleUEvent(ev uevent) {
+	switch ev.Subsystem {
+	case "vdpa":
+		inv.refreshDevice(filepath.Base(ev.DevPath))
+	case "vhost-vdpa":
+		// vhost-vdpa devices are children of the vdpa device
+		inv.refreshDevice(filepath.Base(filepath.Dir(ev.DevPath)))
+	case "virtio", "net":
+		// virtio devices are children of the vdpa device's parent and
+		// netdevs are children of the virtio device
+		if !strings.Contains(ev.DevPath, "/virtio") {
+			return
+		}
+		virtioPath := ev.DevPath
+		for !strings.HasPrefix(filepath.Base(virtioPath), "virtio") {
+			virtioPath = filepath.Dir(virtioPath)
+		}
+		parentPath := filepath.Join(sysfsRoot, filepath.Dir(virtioPath))
+		for _, dev := range inv.Devices() {
+			if strings.Contains(ev.DevPath, "/"+dev.Name()+"/") {
+				inv.refreshDevice(dev.Name())
+				continue
+			}
+			if devParent, err := dev.ParentDevicePath(); err == nil && devParent == parentPath {
+				inv.refreshDevice(dev.Name())
+			}
+		}
+	}
+}
+
+// refreshDevice updates a single device
+func (inv *Inventory) refreshDevice(name string) {
+	inv.updateMu.Lock()
+	defer inv.updateMu.Unlock()
+
+	dev, err := GetVdpaDevice(name)
+	if err != nil && !errors.Is(err, syscall.ENODEV) {
+		// Leave it as it is, the next resync will fix it
+		return
+	}
+
+	inv.mu.Lock()
+	old := inv.devices[name]
+	if dev == nil {
+		delete(inv.devices, name)
+	} else {
+		inv.devices[name] = dev
+	}
+	inv.mu.Unlock()
+
+	if dev == nil {
+		if old != nil {
+			inv.notify(InventoryEvent{Type: DeviceRemoved, Device: old})
+		}
+		return
+	}
+	if ev, changed := deviceEvent(old, dev); changed {
+		inv.notify(ev)
+	}
+}
+
+// Devices returns the devices in the inventory sorted by name
+func (inv *Inventory) Devices() []VdpaDevice {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	result := make([]VdpaDevice, 0, len(inv.devices))
+	for _, name := range sortedDeviceNames(inv.devices) {
+		result = append(result, inv.devices[name])
+	}
+	return result
+}
+
+// Device returns a device in the inventory by name
+func (inv *Inventory) Device(name string) (VdpaDevice, bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	dev, ok := inv.devices[name]
+	return dev, ok
+}
+
+// MgmtDevices returns the management devices in the inventory sorted by name
+func (inv *Inventory) MgmtDevices() []MgmtDev {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	result := make([]MgmtDev, 0, len(inv.mgmtDevs))
+	for _, name := range sortedMgmtDevNames(inv.mgmtDevs) {
+		result = append(result, inv.mgmtDevs[name])
+	}
+	return result
+}
+
+// Subscribe registers a callback that is called, in order, for every change in
+// the inventory. Callbacks must not block; they may subscribe or unsubscribe.
+// The returned function unregisters it
+func (inv *Inventory) Subscribe(callback func(InventoryEvent)) func() {
+	inv.subMu.Lock()
+	defer inv.subMu.Unlock()
+	id := inv.nextSubID
+	inv.nextSubID++
+	inv.subscribers = append(inv.subscribers, subscriber{id: id, callback: callback})
+	return func() {
+		inv.subMu.Lock()
+		defer inv.subMu.Unlock()
+		for i, sub := range inv.subscribers {
+			if sub.id == id {
+				inv.subscribers = append(inv.subscribers[:i:i], inv.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (inv *Inventory) notify(events ...InventoryEvent) {
+	if len(events) == 0 {
+		return
+	}
+	// The callbacks are called unlocked so that they can (un)subscribe
+	inv.subMu.Lock()
+	subscribers := append([]subscriber{}, inv.subscribers...)
+	inv.subMu.Unlock()
+	for _, ev := range events {
+		for _, sub := range subscribers {
+			sub.callback(ev)
+		}
+	}
+}
+
+// deviceEvent returns the event corresponding to a device going from old to new
+// and whether there was any change at all
+func deviceEvent(old, cur VdpaDevice) (InventoryEvent, bool) {
+	if old == nil {
+		return InventoryEvent{Type: DeviceAdded, Device: cur}, true
+	}
+	if sameDevice(old, cur) {
+		return InventoryEvent{}, false
+	}
+	return InventoryEvent{Type: DeviceUpdated, Device: cur}, true
+}
+
+// sameDevice returns whether two devices have the same information
+func sameDevice(a, b VdpaDevice) bool {
+	if a.Name() != b.Name() || a.Driver() != b.Driver() ||
+		a.DeviceID() != b.DeviceID() || a.VendorID() != b.VendorID() {
+		return false
+	}
+	if (a.MgmtDev() == nil) != (b.MgmtDev() == nil) ||
+		a.MgmtDev() != nil && a.MgmtDev().Name() != b.MgmtDev().Name() {
+		return false
+	}
+	if (a.VhostVdpa() == nil) != (b.VhostVdpa() == nil) ||
+		a.VhostVdpa() != nil && (a.VhostVdpa().Name() != b.VhostVdpa().Name() ||
+			a.VhostVdpa().Path() != b.VhostVdpa().Path()) {
+		return false
+	}
+	if (a.VirtioNet() == nil) != (b.VirtioNet() == nil) ||
+		a.VirtioNet() != nil && (a.VirtioNet().Name() != b.VirtioNet().Name() ||
+			a.VirtioNet().NetDev() != b.VirtioNet().NetDev()) {
+		return false
+	}
+	return true
+}
+
+func sortedDeviceNames(m map[string]VdpaDevice) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedMgmtDevNames(m map[string]MgmtDev) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
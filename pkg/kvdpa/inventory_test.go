@@ -0,0 +1,212 @@
+package kvdpa
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/mocks"
+)
+
+// fakeVdpaState is the state served by the netlink mock set by setStateMock
+type fakeVdpaState struct {
+	sync.Mutex
+	t        *testing.T
+	mgmtDevs []MgmtDev
+	devs     []VdpaDevice
+}
+
+func (s *fakeVdpaState) setDevices(devs ...VdpaDevice) {
+	s.Lock()
+	defer s.Unlock()
+	s.devs = devs
+}
+
+func (s *fakeVdpaState) setMgmtDevices(mgmtDevs ...MgmtDev) {
+	s.Lock()
+	defer s.Unlock()
+	s.mgmtDevs = mgmtDevs
+}
+
+func (s *fakeVdpaState) run(command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	switch command {
+	case VdpaCmdMgmtDevGet:
+		return mgmtDevToNlMessage(s.t, s.mgmtDevs...), nil
+	case VdpaCmdDevGet:
+		if flags&syscall.NLM_F_DUMP != 0 {
+			return vdpaDevToNlMessage(s.t, s.devs...), nil
+		}
+		name := string(data[0].Data[:len(data[0].Data)-1])
+		for _, dev := range s.devs {
+			if dev.Name() == name {
+				return vdpaDevToNlMessage(s.t, dev), nil
+			}
+		}
+		return nil, syscall.ENODEV
+	}
+	return nil, syscall.EOPNOTSUPP
+}
+
+// setStateMock sets a netlink mock that serves the returned state
+func setStateMock(t *testing.T) *fakeVdpaState {
+	state := &fakeVdpaState{t: t}
+	netLinkMock := &mocks.NetlinkOps{}
+	SetNetlinkOps(netLinkMock)
+	netLinkMock.On("NewAttribute", mock.AnythingOfType("int"), mock.Anything).
+		Return(func(attrType int, data interface{}) *nl.RtAttr {
+			attr, _ := (&defaultNetlinkOps{}).NewAttribute(attrType, data)
+			return attr
+		}, nil)
+	netLinkMock.On("RunVdpaNetlinkCmd",
+		mock.AnythingOfType("uint8"),
+		mock.AnythingOfType("int"),
+		mock.Anything).
+		Return(func(command uint8, flags int, data []*nl.RtAttr) [][]byte {
+			msgs, _ := state.run(command, flags, data)
+			return msgs
+		}, func(command uint8, flags int, data []*nl.RtAttr) error {
+			_, err := state.run(command, flags, data)
+			return err
+		})
+	return state
+}
+
+func waitInventoryEvent(t *testing.T, events <-chan InventoryEvent, evType InventoryEventType, name string) InventoryEvent {
+	select {
+	case ev := <-events:
+		assert.Equal(t, evType, ev.Type)
+		if ev.Device != nil {
+			assert.Equal(t, name, ev.Device.Name())
+		} else if assert.NotNil(t, ev.MgmtDev) {
+			assert.Equal(t, name, ev.MgmtDev.Name())
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for %s event of %s", evType, name)
+	}
+	return InventoryEvent{}
+}
+
+func TestInventoryUEvents(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	sysfs.addVdpaDevice(t, "", "vdpa0", "", 0)
+	sysfs.addVdpaDevice(t, "", "vdpa1", "", 1)
+	sysfs.addVdpaDevice(t, "", "vdpa2", "", 2)
+
+	sim := &mgmtDev{devName: "vdpasim_net"}
+	vdpa0 := &vdpaDev{name: "vdpa0", mgmtDev: sim}
+	vdpa1 := &vdpaDev{name: "vdpa1", mgmtDev: sim}
+	vdpa2 := &vdpaDev{name: "vdpa2", mgmtDev: sim}
+	state := setStateMock(t)
+	state.setMgmtDevices(sim)
+	state.setDevices(vdpa0, vdpa1)
+
+	events := make(chan InventoryEvent, 10)
+	inv := NewInventory(0)
+	inv.Subscribe(func(ev InventoryEvent) { events <- ev })
+
+	uevents := make(chan uevent)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- inv.run(ctx, uevents) }()
+
+	waitInventoryEvent(t, events, MgmtDevAdded, "vdpasim_net")
+	waitInventoryEvent(t, events, DeviceAdded, "vdpa0")
+	waitInventoryEvent(t, events, DeviceAdded, "vdpa1")
+
+	state.setDevices(vdpa0, vdpa1, vdpa2)
+	uevents <- uevent{Action: "add", Subsystem: "vdpa", DevPath: "/devices/vdpa2"}
+	waitInventoryEvent(t, events, DeviceAdded, "vdpa2")
+
+	sysfs.bindVdpaDevice(t, "vdpa1", VhostVdpaDriver, 1)
+	uevents <- uevent{Action: "add", Subsystem: "vhost-vdpa", DevPath: "/devices/vdpa1/vhost-vdpa-1"}
+	ev := waitInventoryEvent(t, events, DeviceUpdated, "vdpa1")
+	if assert.NotNil(t, ev.Device.VhostVdpa()) {
+		assert.Equal(t, "vhost-vdpa-1", ev.Device.VhostVdpa().Name())
+	}
+
+	state.setDevices(vdpa1, vdpa2)
+	uevents <- uevent{Action: "remove", Subsystem: "vdpa", DevPath: "/devices/vdpa0"}
+	waitInventoryEvent(t, events, DeviceRemoved, "vdpa0")
+
+	// Unrelated events do not produce changes
+	uevents <- uevent{Action: "add", Subsystem: "vdpa", DevPath: "/devices/vdpa2"}
+	uevents <- uevent{Action: "add", Subsystem: "net", DevPath: "/devices/virtual/net/lo"}
+
+	// Lost uevents trigger a full resync
+	state.setMgmtDevices()
+	uevents <- uevent{Overrun: true}
+	waitInventoryEvent(t, events, MgmtDevRemoved, "vdpasim_net")
+
+	names := []string{}
+	for _, dev := range inv.Devices() {
+		names = append(names, dev.Name())
+	}
+	assert.Equal(t, []string{"vdpa1", "vdpa2"}, names)
+	assert.Empty(t, inv.MgmtDevices())
+	_, ok := inv.Device("vdpa0")
+	assert.False(t, ok)
+
+	cancel()
+	assert.Nil(t, <-done)
+	assert.Empty(t, events)
+}
+
+func TestInventoryResync(t *testing.T) {
+	sim := &mgmtDev{devName: "vdpasim_net"}
+	state := setStateMock(t)
+	state.setMgmtDevices(sim)
+
+	events := make(chan InventoryEvent, 10)
+	inv := NewInventory(10 * time.Millisecond)
+	unsubscribe := inv.Subscribe(func(ev InventoryEvent) { events <- ev })
+	// A callback can unsubscribe itself
+	first := make(chan InventoryEvent, 10)
+	var unsubscribeFirst func()
+	unsubscribeFirst = inv.Subscribe(func(ev InventoryEvent) {
+		first <- ev
+		unsubscribeFirst()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- inv.run(ctx, make(chan uevent)) }()
+	waitInventoryEvent(t, events, MgmtDevAdded, "vdpasim_net")
+	waitInventoryEvent(t, first, MgmtDevAdded, "vdpasim_net")
+
+	state.setDevices(&vdpaDev{name: "vdpa0", mgmtDev: sim})
+	waitInventoryEvent(t, events, DeviceAdded, "vdpa0")
+	assert.Empty(t, first)
+
+	unsubscribe()
+	state.setDevices()
+	assert.Eventually(t, func() bool { return len(inv.Devices()) == 0 },
+		5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, events)
+
+	cancel()
+	assert.Nil(t, <-done)
+}
+
+func TestParseUEvent(t *testing.T) {
+	ev, ok := parseUEvent([]byte("bind@/devices/vdpa0\x00ACTION=bind\x00DEVPATH=/devices/vdpa0\x00" +
+		"SUBSYSTEM=vdpa\x00DRIVER=vhost_vdpa\x00SEQNUM=2130\x00"))
+	assert.True(t, ok)
+	assert.Equal(t, "bind", ev.Action)
+	assert.Equal(t, "/devices/vdpa0", ev.DevPath)
+	assert.Equal(t, "vdpa", ev.Subsystem)
+	assert.Equal(t, "vhost_vdpa", ev.Env["DRIVER"])
+
+	_, ok = parseUEvent([]byte("libudev\x00\xfe\xed\xca\xfe"))
+	assert.False(t, ok)
+	_, ok = parseUEvent([]byte("add@/devices/vdpa0\x00"))
+	assert.False(t, ok)
+}
@@ -0,0 +1,262 @@
+package kvdpa
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func getProcIRQDir() string {
+	return filepath.Join(getProcDir(), "irq")
+}
+
+// IRQ is an MSI-X interrupt of a device
+type IRQ struct {
+	Number int
+	// Actions are the names of the handlers (e.g: mlx5_comp0@pci:0000:65:00.2),
+	// which usually tell the queue the interrupt serves
+	Actions []string
+	// Affinity are the CPUs the interrupt can be delivered to (smp_affinity)
+	Affinity []int
+}
+
+// DeviceLocality tells where a vdpa device sits in the host topology
+type DeviceLocality struct {
+	// PCIAddress is the address of the parent PCI device. The other fields
+	// are unknown if it is empty (e.g: vdpasim)
+	PCIAddress string
+	// NumaNode is the NUMA node of the parent PCI device, -1 if unknown
+	NumaNode int
+	// LocalCPUs are the CPUs of the NUMA node of the parent PCI device
+	LocalCPUs []int
+	// IRQs are the MSI-X interrupts of the parent PCI device. They are
+	// shared by all the vdpa devices of the PCI device (e.g: its SFs)
+	IRQs []IRQ
+}
+
+// GetVdpaDeviceLocality returns the NUMA node, the local CPUs and the
+// interrupts of a vdpa device's parent PCI device
+func GetVdpaDeviceLocality(name string) (*DeviceLocality, error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("invalid vdpa device name %q: %w", name, syscall.EINVAL)
+	}
+	if _, err := os.Stat(filepath.Join(vdpaBusDevDir, name)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, syscall.ENODEV
+		}
+		return nil, err
+	}
+	dev := &vdpaDev{name: name}
+	pciAddress, err := dev.parentPCIAddress()
+	if err != nil {
+		return nil, err
+	}
+	locality := &DeviceLocality{PCIAddress: pciAddress, NumaNode: -1}
+	if pciAddress == "" {
+		return locality, nil
+	}
+	if locality.NumaNode, err = dev.numaNode(); err != nil {
+		return nil, err
+	}
+	pciPath := filepath.Join(pciDevDir, pciAddress)
+	content, err := ioutil.ReadFile(filepath.Join(pciPath, "local_cpulist"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if locality.LocalCPUs, err = ParseCPUList(strings.TrimSpace(string(content))); err != nil {
+			return nil, err
+		}
+	}
+	irqs, err := msixIRQs(pciPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, number := range irqs {
+		irq, err := getIRQ(number)
+		if err != nil {
+			return nil, err
+		}
+		locality.IRQs = append(locality.IRQs, *irq)
+	}
+	return locality, nil
+}
+
+// msixIRQs returns the MSI-X interrupts of a PCI device, in order
+func msixIRQs(pciPath string) ([]int, error) {
+	entries, err := os.ReadDir(filepath.Join(pciPath, "msi_irqs"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	irqs := []int{}
+	for _, entry := range entries {
+		number, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		mode, err := ioutil.ReadFile(filepath.Join(pciPath, "msi_irqs", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(mode)) == "msix" {
+			irqs = append(irqs, number)
+		}
+	}
+	sort.Ints(irqs)
+	return irqs, nil
+}
+
+// getIRQ reads an interrupt from procfs. Its actions are the directories
+// of its procfs directory
+func getIRQ(number int) (*IRQ, error) {
+	dir := filepath.Join(getProcIRQDir(), strconv.Itoa(number))
+	content, err := ioutil.ReadFile(filepath.Join(dir, "smp_affinity"))
+	if err != nil {
+		return nil, err
+	}
+	irq := &IRQ{Number: number, Actions: []string{}}
+	if irq.Affinity, err = parseCPUMask(strings.TrimSpace(string(content))); err != nil {
+		return nil, fmt.Errorf("invalid affinity of IRQ %d: %v", number, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			irq.Actions = append(irq.Actions, entry.Name())
+		}
+	}
+	return irq, nil
+}
+
+// SetIRQAffinity sets the CPUs an interrupt can be delivered to. The IRQs of
+// GetVdpaDeviceLocality are shared by all the vdpa devices of a PCI device
+func SetIRQAffinity(irq int, cpus []int) error {
+	if len(cpus) == 0 {
+		return fmt.Errorf("empty affinity of IRQ %d: %w", irq, syscall.EINVAL)
+	}
+	mask, err := formatCPUMask(cpus)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(getProcIRQDir(), strconv.Itoa(irq), "smp_affinity")
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, []byte(mask), 0644); err != nil {
+		return fmt.Errorf("setting the affinity of IRQ %d: %w", irq, err)
+	}
+	return nil
+}
+
+// SetVdpaDeviceIRQAffinity sets the CPUs the queue interrupts of a vdpa device
+// can be delivered to: the provided MSI-X interrupts of its parent PCI device,
+// or all of them if none is provided. It fails with EINVAL if an interrupt
+// is not one of the device's. The interrupts are shared by all the vdpa
+// devices of a PCI device
+func SetVdpaDeviceIRQAffinity(name string, cpus []int, irqs ...int) error {
+	locality, err := GetVdpaDeviceLocality(name)
+	if err != nil {
+		return err
+	}
+	if len(locality.IRQs) == 0 {
+		return fmt.Errorf("vdpa device %s has no MSI-X interrupts: %w", name, syscall.ENOENT)
+	}
+	deviceIRQs := map[int]bool{}
+	for _, irq := range locality.IRQs {
+		deviceIRQs[irq.Number] = true
+	}
+	if len(irqs) == 0 {
+		for _, irq := range locality.IRQs {
+			irqs = append(irqs, irq.Number)
+		}
+	}
+	for _, irq := range irqs {
+		if !deviceIRQs[irq] {
+			return fmt.Errorf("IRQ %d is not an interrupt of vdpa device %s: %w", irq, name, syscall.EINVAL)
+		}
+	}
+	for _, irq := range irqs {
+		if err := SetIRQAffinity(irq, cpus); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseCPUList parses a CPU list (e.g: "0-3,8,10-11") into sorted CPU numbers
+func ParseCPUList(list string) ([]int, error) {
+	cpus := []int{}
+	if list == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid CPU list %q", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("invalid CPU list %q", list)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// parseCPUMask parses a CPU mask as found in smp_affinity: hexadecimal 32-bit
+// words separated by commas, most significant first (e.g: "00000000,0000ff00")
+func parseCPUMask(mask string) ([]int, error) {
+	words := strings.Split(mask, ",")
+	cpus := []int{}
+	for i := len(words) - 1; i >= 0; i-- {
+		word, err := strconv.ParseUint(words[i], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU mask %q", mask)
+		}
+		base := (len(words) - 1 - i) * 32
+		for bit := 0; bit < 32; bit++ {
+			if word&(1<<uint(bit)) != 0 {
+				cpus = append(cpus, base+bit)
+			}
+		}
+	}
+	return cpus, nil
+}
+
+// formatCPUMask formats CPU numbers as a CPU mask (see parseCPUMask)
+func formatCPUMask(cpus []int) (string, error) {
+	max := 0
+	for _, cpu := range cpus {
+		if cpu < 0 {
+			return "", fmt.Errorf("invalid CPU %d: %w", cpu, syscall.EINVAL)
+		}
+		if cpu > max {
+			max = cpu
+		}
+	}
+	words := make([]uint32, max/32+1)
+	for _, cpu := range cpus {
+		words[cpu/32] |= 1 << uint(cpu%32)
+	}
+	parts := make([]string, 0, len(words))
+	for i := len(words) - 1; i >= 0; i-- {
+		parts = append(parts, fmt.Sprintf("%08x", words[i]))
+	}
+	return strings.Join(parts, ","), nil
+}
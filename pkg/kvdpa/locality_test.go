@@ -0,0 +1,46 @@
+package kvdpa
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCPUList(t *testing.T) {
+	cpus, err := ParseCPUList("0-2,5,7-8")
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2, 5, 7, 8}, cpus)
+	cpus, err = ParseCPUList("")
+	require.NoError(t, err)
+	assert.Empty(t, cpus)
+	for _, list := range []string{"a", "3-1", "1,", "-1"} {
+		_, err = ParseCPUList(list)
+		assert.Error(t, err, list)
+	}
+}
+
+func TestCPUMask(t *testing.T) {
+	tests := []struct {
+		mask string
+		cpus []int
+	}{
+		{"00000001", []int{0}},
+		{"0000ff00", []int{8, 9, 10, 11, 12, 13, 14, 15}},
+		{"80000000,00000003", []int{0, 1, 63}},
+	}
+	for _, tt := range tests {
+		cpus, err := parseCPUMask(tt.mask)
+		require.NoError(t, err)
+		assert.Equal(t, tt.cpus, cpus)
+		mask, err := formatCPUMask(tt.cpus)
+		require.NoError(t, err)
+		assert.Equal(t, tt.mask, mask)
+	}
+	// Short masks, as written by hand
+	cpus, err := parseCPUMask("f")
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2, 3}, cpus)
+	_, err = parseCPUMask("00000001,xyz")
+	assert.Error(t, err)
+}
@@ -0,0 +1,226 @@
+package kvdpa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultLockDir is the directory of the lock files
+const DefaultLockDir = "/run/kvdpa/locks"
+
+// lockPollInterval is how often a held lock is checked for release
+const lockPollInterval = 10 * time.Millisecond
+
+// ErrLockTimeout is returned when a lock could not be taken in time
+var ErrLockTimeout = errors.New("timed out waiting for the vdpa lock")
+
+var (
+	lockMu      sync.RWMutex
+	lockDir     = DefaultLockDir
+	autoLock    bool
+	autoTimeout time.Duration
+)
+
+// SetLockDir sets the directory of the lock files. Every process that
+// changes the vdpa devices of a host must use the same one
+func SetLockDir(dir string) {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	lockDir = dir
+}
+
+// SetAutoLock makes the mutating operations (AddVdpaDevice, DeleteVdpaDevice,
+// SetVdpaDeviceMacAddr, BindVdpaDevice and UnbindVdpaDevice) take the lock of
+// the device, and AddVdpaDevice also the one of the management device, for
+// their duration. Locks are not reentrant: a caller that already holds a
+// lock must not run a mutating operation on the same device with auto-locking
+func SetAutoLock(enabled bool, timeout time.Duration) {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	autoLock = enabled
+	autoTimeout = timeout
+}
+
+// Lock is an advisory lock on a vdpa device or management device, shared
+// by all the processes that use the same lock directory. It is a flock(2) on
+// the lock file, held as long as the file is open: the kernel releases it if
+// the process dies. The file holds the pid of the owner, only to tell who
+// holds the lock
+type Lock struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// LockVdpaDevice takes the lock of a vdpa device, waiting at most timeout
+// for it to be released
+func LockVdpaDevice(name string, timeout time.Duration) (*Lock, error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("invalid vdpa device name %q: %w", name, syscall.EINVAL)
+	}
+	return lock(context.Background(), "dev-"+name, time.Now().Add(timeout))
+}
+
+// LockVdpaDeviceContext takes the lock of a vdpa device, waiting for it to
+// be released until the context is done
+func LockVdpaDeviceContext(ctx context.Context, name string) (*Lock, error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("invalid vdpa device name %q: %w", name, syscall.EINVAL)
+	}
+	return lock(ctx, "dev-"+name, time.Time{})
+}
+
+// LockMgmtDev takes the lock of a management device ([busName/]devName),
+// waiting at most timeout for it to be released
+func LockMgmtDev(name string, timeout time.Duration) (*Lock, error) {
+	lockName, err := mgmtDevLockName(name)
+	if err != nil {
+		return nil, err
+	}
+	return lock(context.Background(), lockName, time.Now().Add(timeout))
+}
+
+// LockMgmtDevContext takes the lock of a management device, waiting for it
+// to be released until the context is done
+func LockMgmtDevContext(ctx context.Context, name string) (*Lock, error) {
+	lockName, err := mgmtDevLockName(name)
+	if err != nil {
+		return nil, err
+	}
+	return lock(ctx, lockName, time.Time{})
+}
+
+// mgmtDevLockName returns the lock name of a management device. The name is
+// locked as given: the processes must name a management device alike
+func mgmtDevLockName(name string) (string, error) {
+	if _, _, err := splitMgmtDevName(name); err != nil {
+		return "", err
+	}
+	return "mgmtdev-" + url.PathEscape(name), nil
+}
+
+// lock takes a lock, waiting until the deadline (if not zero) or until the
+// context is done. It is tried at least once
+func lock(ctx context.Context, name string, deadline time.Time) (*Lock, error) {
+	lockMu.RLock()
+	dir := lockDir
+	lockMu.RUnlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &Lock{path: filepath.Join(dir, name+".lock")}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, err
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			holder := lockHolder(f)
+			f.Close()
+			return nil, fmt.Errorf("%w %s: held by %s", ErrLockTimeout, name, holder)
+		}
+		timer := time.NewTimer(lockPollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			holder := lockHolder(f)
+			f.Close()
+			return nil, fmt.Errorf("waiting for the vdpa lock %s held by %s: %w", name, holder, ctx.Err())
+		}
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.file = f
+	return l, nil
+}
+
+// lockHolder tells which process holds a lock, from the content of its
+// file. The holder may not have written its pid yet
+func lockHolder(f *os.File) string {
+	content := make([]byte, 32)
+	n, _ := f.ReadAt(content, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content[:n])))
+	if err != nil {
+		return "another process"
+	}
+	return fmt.Sprintf("process %d", pid)
+}
+
+// Unlock releases the lock
+func (l *Lock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("vdpa lock %s is not held", l.path)
+	}
+	f := l.file
+	l.file = nil
+	// Closing the file releases the lock
+	defer f.Close()
+	return f.Truncate(0)
+}
+
+// lockForOperation takes the locks of a mutating operation if auto-locking
+// is enabled and returns the function that releases them
+func lockForOperation(ctx context.Context, device, mgmtDev string) (func(), error) {
+	lockMu.RLock()
+	enabled, timeout := autoLock, autoTimeout
+	lockMu.RUnlock()
+	if !enabled || getDryRun(ctx) != nil {
+		return func() {}, nil
+	}
+
+	locks := []*Lock{}
+	release := func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			_ = locks[i].Unlock()
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	// The management device lock is always taken first
+	if mgmtDev != "" {
+		lockName, err := mgmtDevLockName(mgmtDev)
+		if err != nil {
+			return nil, err
+		}
+		l, err := lock(ctx, lockName, deadline)
+		if err != nil {
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+	l, err := lock(ctx, "dev-"+device, deadline)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	locks = append(locks, l)
+	return release, nil
+}
@@ -0,0 +1,163 @@
+package kvdpa
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setLockDir(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "locks")
+	SetLockDir(dir)
+	t.Cleanup(func() { SetLockDir(DefaultLockDir) })
+	return dir
+}
+
+func TestLock(t *testing.T) {
+	setLockDir(t)
+
+	l, err := LockVdpaDevice("vdpa0", 0)
+	require.NoError(t, err)
+	_, err = LockVdpaDevice("vdpa0", 30*time.Millisecond)
+	assert.ErrorIs(t, err, ErrLockTimeout)
+	assert.Contains(t, err.Error(), fmt.Sprintf("held by process %d", os.Getpid()))
+
+	// Other devices and management devices have their own locks
+	other, err := LockVdpaDevice("vdpa1", 0)
+	require.NoError(t, err)
+	mgmtDev, err := LockMgmtDev("pci/0000:65:00.2", 0)
+	require.NoError(t, err)
+	require.NoError(t, other.Unlock())
+	require.NoError(t, mgmtDev.Unlock())
+
+	// Waiting for the release
+	go func(held *Lock) {
+		time.Sleep(20 * time.Millisecond)
+		assert.NoError(t, held.Unlock())
+	}(l)
+	l, err = LockVdpaDevice("vdpa0", time.Second)
+	require.NoError(t, err)
+	require.NoError(t, l.Unlock())
+	assert.Error(t, l.Unlock())
+
+	// Waiting until the context is done
+	l, err = LockVdpaDeviceContext(context.Background(), "vdpa0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = LockVdpaDeviceContext(ctx, "vdpa0")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NoError(t, l.Unlock())
+
+	_, err = LockVdpaDevice("../vdpa0", 0)
+	assert.Error(t, err)
+	_, err = LockMgmtDev("a/b/c", 0)
+	assert.Error(t, err)
+}
+
+func TestStaleLock(t *testing.T) {
+	dir := setLockDir(t)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+
+	// The file of a lock that is not held
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "dev-vdpa0.lock"), []byte("1\n"), 0644))
+	l, err := LockVdpaDevice("vdpa0", 0)
+	require.NoError(t, err)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "dev-vdpa0.lock"))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d\n", os.Getpid()), string(content))
+	require.NoError(t, l.Unlock())
+
+	// Garbage
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "dev-vdpa0.lock"), []byte("garbage"), 0644))
+	l, err = LockVdpaDevice("vdpa0", 0)
+	require.NoError(t, err)
+	_, err = LockVdpaDevice("vdpa0", 0)
+	assert.ErrorIs(t, err, ErrLockTimeout)
+	require.NoError(t, l.Unlock())
+}
+
+func TestMgmtDevLockName(t *testing.T) {
+	name, err := mgmtDevLockName("pci/0000:65:00.2")
+	require.NoError(t, err)
+	assert.Equal(t, "mgmtdev-pci%2F0000:65:00.2", name)
+	name, err = mgmtDevLockName("vdpasim_net")
+	require.NoError(t, err)
+	assert.Equal(t, "mgmtdev-vdpasim_net", name)
+	_, err = mgmtDevLockName("pci/0000:65:00.2/x")
+	assert.Error(t, err)
+}
+
+// TestLockHelperProcess takes a lock on behalf of TestCrossProcessLock
+func TestLockHelperProcess(t *testing.T) {
+	dir := os.Getenv("KVDPA_TEST_LOCK_DIR")
+	if dir == "" {
+		t.Skip("only run by TestCrossProcessLock")
+	}
+	SetLockDir(dir)
+	_, err := LockVdpaDevice("vdpa0", 0)
+	require.NoError(t, err)
+	fmt.Println("locked")
+	// Exit without releasing the lock once the parent closes stdin
+	_, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+	os.Exit(0)
+}
+
+func TestCrossProcessLock(t *testing.T) {
+	dir := setLockDir(t)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelperProcess$")
+	cmd.Env = append(os.Environ(), "KVDPA_TEST_LOCK_DIR="+dir)
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "locked\n", line)
+
+	_, err = LockVdpaDevice("vdpa0", 30*time.Millisecond)
+	assert.ErrorIs(t, err, ErrLockTimeout)
+	assert.Contains(t, err.Error(), fmt.Sprintf("held by process %d", cmd.Process.Pid))
+
+	// The helper exits while holding the lock: the kernel releases it
+	require.NoError(t, stdin.Close())
+	_ = cmd.Wait()
+	l, err := LockVdpaDevice("vdpa0", 0)
+	require.NoError(t, err)
+	require.NoError(t, l.Unlock())
+}
+
+func TestAutoLock(t *testing.T) {
+	newFakeSysfs(t)
+	SetNetlinkOps(&defaultNetlinkOps{})
+	setLockDir(t)
+	SetAutoLock(true, 20*time.Millisecond)
+	defer SetAutoLock(false, 0)
+
+	l, err := LockVdpaDevice("vdpa0", 0)
+	require.NoError(t, err)
+	assert.ErrorIs(t, DeleteVdpaDevice("vdpa0"), ErrLockTimeout)
+	assert.ErrorIs(t, UnbindVdpaDevice("vdpa0"), ErrLockTimeout)
+	require.NoError(t, l.Unlock())
+
+	mgmtDev, err := LockMgmtDev("pci/0000:65:00.2", 0)
+	require.NoError(t, err)
+	assert.ErrorIs(t, AddVdpaDevice("pci/0000:65:00.2", "vdpa1"), ErrLockTimeout)
+	// The context is done before the lock timeout
+	SetAutoLock(true, time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, AddVdpaDeviceContext(ctx, "pci/0000:65:00.2", "vdpa1"), context.DeadlineExceeded)
+	require.NoError(t, mgmtDev.Unlock())
+}
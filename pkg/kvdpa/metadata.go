@@ -0,0 +1,181 @@
+package kvdpa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DeviceIdentity identifies a vdpa device instance: a device deleted and
+// created again with the same name is another instance, which does not
+// inherit the labels of the previous one
+type DeviceIdentity struct {
+	MgmtDev string `json:"mgmtdev"`
+	// Inode is the inode of the device's sysfs directory, which is
+	// allocated anew every time a device is created
+	Inode uint64 `json:"inode"`
+}
+
+// matches returns whether two identities are the same device instance. The
+// management device is unknown to the sysfs fallback
+func (i DeviceIdentity) matches(other DeviceIdentity) bool {
+	return i.Inode == other.Inode && (i.MgmtDev == "" || other.MgmtDev == "" || i.MgmtDev == other.MgmtDev)
+}
+
+// deviceIdentity returns the identity of the current instance of a device
+func deviceIdentity(dev VdpaDevice) (DeviceIdentity, error) {
+	info, err := os.Stat(filepath.Join(vdpaBusDevDir, dev.Name()))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return DeviceIdentity{}, syscall.ENODEV
+		}
+		return DeviceIdentity{}, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return DeviceIdentity{}, fmt.Errorf("no inode for vdpa device %s", dev.Name())
+	}
+	identity := DeviceIdentity{Inode: uint64(stat.Ino)}
+	if dev.MgmtDev() != nil {
+		identity.MgmtDev = dev.MgmtDev().Name()
+	}
+	return identity, nil
+}
+
+// validateLabels checks that label keys are not empty
+func validateLabels(labels map[string]string) error {
+	for key := range labels {
+		if key == "" {
+			return fmt.Errorf("empty label key: %w", syscall.EINVAL)
+		}
+	}
+	return nil
+}
+
+// setLabels stores the labels of the current instance of a device
+func setLabels(ctx context.Context, name string, labels map[string]string) error {
+	dev, err := GetVdpaDeviceContext(ctx, name)
+	if err != nil {
+		return err
+	}
+	identity, err := deviceIdentity(dev)
+	if err != nil {
+		return err
+	}
+	copied := make(map[string]string, len(labels))
+	for key, value := range labels {
+		copied[key] = value
+	}
+	return updateOwnerRegistry(func(r *ownerRegistry) error {
+		r.Labels[name] = deviceLabels{Identity: identity, Labels: copied}
+		return nil
+	})
+}
+
+/*
+SetVdpaDeviceLabels replaces the labels of a vdpa device. They are stored in
+the owner registry (see SetOwnerRegistry) and returned by VdpaDevice.Labels()
+until the device is deleted
+*/
+func SetVdpaDeviceLabels(name string, labels map[string]string) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid vdpa device name %q: %w", name, syscall.EINVAL)
+	}
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+	return setLabels(context.Background(), name, labels)
+}
+
+// RemoveVdpaDeviceLabels removes the labels of a vdpa device, if any
+func RemoveVdpaDeviceLabels(name string) error {
+	return updateOwnerRegistry(func(r *ownerRegistry) error {
+		delete(r.Labels, name)
+		return nil
+	})
+}
+
+// forgetLabels removes the labels of a deleted vdpa device, so that they
+// cannot attach to another device. The registry is only updated if it holds
+// some, and is left alone if it cannot be read (e.g: for unprivileged users)
+func forgetLabels(name string) error {
+	r, err := loadOwnerRegistry(getOwnerRegistry())
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil
+		}
+		return err
+	}
+	if _, ok := r.Labels[name]; !ok {
+		return nil
+	}
+	return RemoveVdpaDeviceLabels(name)
+}
+
+/*
+AddVdpaDeviceWithLabels creates a vdpa device like AddVdpaDeviceWithConfig
+and stores its labels. If they cannot be stored, the device is deleted
+*/
+func AddVdpaDeviceWithLabels(mgmtDeviceName, vdpaDeviceName string, config *VdpaNetConfig, labels map[string]string) error {
+	return AddVdpaDeviceWithLabelsContext(context.Background(), mgmtDeviceName, vdpaDeviceName, config, labels)
+}
+
+// AddVdpaDeviceWithLabelsContext is AddVdpaDeviceWithLabels with a context
+func AddVdpaDeviceWithLabelsContext(ctx context.Context, mgmtDeviceName, vdpaDeviceName string, config *VdpaNetConfig, labels map[string]string) error {
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+	if err := AddVdpaDeviceWithConfigContext(ctx, mgmtDeviceName, vdpaDeviceName, config); err != nil {
+		return err
+	}
+	if getDryRun(ctx) != nil {
+		return nil
+	}
+	if err := setLabels(ctx, vdpaDeviceName, labels); err != nil {
+		// The device is deleted even if the context is done
+		if delErr := DeleteVdpaDevice(vdpaDeviceName); delErr != nil {
+			return fmt.Errorf("storing the labels of %s: %w (deleting it: %v)", vdpaDeviceName, err, delErr)
+		}
+		return fmt.Errorf("storing the labels of %s: %w", vdpaDeviceName, err)
+	}
+	return nil
+}
+
+// attachLabels sets the labels of the devices whose stored identity is the
+// one of their current instance. Without a readable store (e.g: for
+// unprivileged users), there are none. The other errors are returned by
+// the Labels() of the devices: they do not prevent listing them
+func attachLabels(devices []*vdpaDev) {
+	if len(devices) == 0 {
+		return
+	}
+	r, err := loadOwnerRegistry(getOwnerRegistry())
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return
+		}
+		for _, dev := range devices {
+			dev.labelsErr = err
+		}
+		return
+	}
+	for _, dev := range devices {
+		stored, ok := r.Labels[dev.Name()]
+		if !ok {
+			continue
+		}
+		identity, err := deviceIdentity(dev)
+		if err != nil {
+			if !errors.Is(err, syscall.ENODEV) {
+				dev.labelsErr = err
+			}
+			continue
+		}
+		if identity.matches(stored.Identity) {
+			dev.labels = stored.Labels
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package kvdpa
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"strings"
 	"syscall"
 
@@ -12,11 +15,15 @@ type MgmtDev interface {
 	BusName() string // Optional
 	DevName() string //
 	Name() string    // The MgmtDevName is BusName/DevName
+	// RawAttributes returns the netlink attributes that were not parsed,
+	// indexed by attribute type
+	RawAttributes() map[uint16][]byte
 }
 
 type mgmtDev struct {
 	busName string
 	devName string
+	raw     map[uint16][]byte
 }
 
 // BusName returns the MgmtDev's bus name
@@ -37,22 +44,40 @@ func (m *mgmtDev) Name() string {
 	return m.devName
 }
 
+// RawAttributes returns the netlink attributes that were not parsed
+func (m *mgmtDev) RawAttributes() map[uint16][]byte {
+	return m.raw
+}
+
 // parseAttributes parses the netlink attributes and populates the fields accordingly
 func (m *mgmtDev) parseAttributes(attrs []syscall.NetlinkRouteAttr) error {
 	for _, a := range attrs {
-		switch a.Attr.Type {
+		switch attrType(a) {
 		case VdpaAttrMgmtDevBusName:
-			m.busName = string(a.Value[:len(a.Value)-1])
+			m.busName = attrString(a.Value)
 		case VdpaAttrMgmtDevDevName:
-			m.devName = string(a.Value[:len(a.Value)-1])
+			m.devName = attrString(a.Value)
+		default:
+			m.raw = addRawAttribute(m.raw, a)
 		}
 	}
+	if !validName(m.devName) || (m.busName != "" && !validName(m.busName)) {
+		return fmt.Errorf("%w: invalid management device name %q/%q", ErrMalformedMessage, m.busName, m.devName)
+	}
 	return nil
 }
 
 // ListVdpaMgmtDevices returns the list of all available MgmtDevs
 func ListVdpaMgmtDevices() ([]MgmtDev, error) {
-	msgs, err := GetNetlinkOps().RunVdpaNetlinkCmd(VdpaCmdMgmtDevGet, syscall.NLM_F_DUMP, nil)
+	return ListVdpaMgmtDevicesContext(context.Background())
+}
+
+// ListVdpaMgmtDevicesContext is ListVdpaMgmtDevices with a context
+func ListVdpaMgmtDevicesContext(ctx context.Context) ([]MgmtDev, error) {
+	msgs, err := runVdpaNetlinkCmd(ctx, VdpaCmdMgmtDevGet, syscall.NLM_F_DUMP, nil)
+	if errors.Is(err, ErrGenlFamilyNotFound) {
+		return listVdpaMgmtDevicesSysfs()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -66,6 +91,11 @@ func ListVdpaMgmtDevices() ([]MgmtDev, error) {
 
 // GetVdpaMgmtDevices returns a MgmtDev based on a busName and deviceName
 func GetVdpaMgmtDevices(busName, devName string) (MgmtDev, error) {
+	return GetVdpaMgmtDevicesContext(context.Background(), busName, devName)
+}
+
+// GetVdpaMgmtDevicesContext is GetVdpaMgmtDevices with a context
+func GetVdpaMgmtDevicesContext(ctx context.Context, busName, devName string) (MgmtDev, error) {
 	data := []*nl.RtAttr{}
 	if busName != "" {
 		bus, err := GetNetlinkOps().NewAttribute(VdpaAttrMgmtDevBusName, busName)
@@ -81,7 +111,10 @@ func GetVdpaMgmtDevices(busName, devName string) (MgmtDev, error) {
 	}
 	data = append(data, dev)
 
-	msgs, err := GetNetlinkOps().RunVdpaNetlinkCmd(VdpaCmdMgmtDevGet, 0, data)
+	msgs, err := runVdpaNetlinkCmd(ctx, VdpaCmdMgmtDevGet, 0, data)
+	if errors.Is(err, ErrGenlFamilyNotFound) {
+		return getVdpaMgmtDeviceSysfs(busName, devName)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -90,14 +123,58 @@ func GetVdpaMgmtDevices(busName, devName string) (MgmtDev, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(mgtmDevs) == 0 {
+		return nil, fmt.Errorf("%w: empty response", ErrMalformedMessage)
+	}
 	return mgtmDevs[0], nil
 }
 
+// splitMgmtDevName splits a management device name: [busName/]devName
+func splitMgmtDevName(name string) (string, string, error) {
+	var busName, devName string
+	nameParts := strings.Split(name, "/")
+	switch len(nameParts) {
+	case 1:
+		devName = nameParts[0]
+	case 2:
+		busName, devName = nameParts[0], nameParts[1]
+	default:
+		return "", "", fmt.Errorf("invalid management device name %s", name)
+	}
+	if devName == "" {
+		return "", "", fmt.Errorf("invalid management device name %s", name)
+	}
+	return busName, devName, nil
+}
+
+// mgmtDevNameAttrs returns the netlink attributes that identify a management
+// device by its name: [busName/]devName
+func mgmtDevNameAttrs(name string) ([]*nl.RtAttr, error) {
+	busName, devName, err := splitMgmtDevName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data := []*nl.RtAttr{}
+	if busName != "" {
+		bus, err := GetNetlinkOps().NewAttribute(VdpaAttrMgmtDevBusName, busName)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, bus)
+	}
+	dev, err := GetNetlinkOps().NewAttribute(VdpaAttrMgmtDevDevName, devName)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, dev), nil
+}
+
 func parseDevLinkVdpaMgmtDevList(msgs [][]byte) ([]MgmtDev, error) {
 	devices := make([]MgmtDev, 0, len(msgs))
 
 	for _, m := range msgs {
-		attrs, err := nl.ParseRouteAttr(m[nl.SizeofGenlmsg:])
+		attrs, err := parseGenlAttributes(m)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,159 @@
+package kvdpa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// MaxVdpaDeviceNameLen is the maximum length of a vdpa device name: devices
+// are sysfs directories, whose names cannot exceed NAME_MAX
+const MaxVdpaDeviceNameLen = 255
+
+// DefaultNameTemplate is the template device names are allocated from
+const DefaultNameTemplate = "vdpa{n}"
+
+// maxNameAttempts bounds the number of names tried by AllocateVdpaDevice
+const maxNameAttempts = 1024
+
+// namePlaceholderRe matches the placeholders of a name template
+var namePlaceholderRe = regexp.MustCompile(`\{[^}]*\}`)
+
+var (
+	nameTemplateMu sync.RWMutex
+	nameTemplate   = DefaultNameTemplate
+)
+
+// validateNameTemplate checks that a template only has known placeholders
+// and can give valid names
+func validateNameTemplate(template string) error {
+	for _, placeholder := range namePlaceholderRe.FindAllString(template, -1) {
+		switch placeholder {
+		case "{n}", "{idx}", "{pci}", "{mgmtdev}":
+		default:
+			return fmt.Errorf("unknown placeholder %s in name template %q: %w", placeholder, template, syscall.EINVAL)
+		}
+	}
+	if strings.ContainsAny(namePlaceholderRe.ReplaceAllString(template, ""), "/{}") {
+		return fmt.Errorf("invalid name template %q: %w", template, syscall.EINVAL)
+	}
+	return nil
+}
+
+/*
+SetNameTemplate sets the template AllocateVdpaDevice allocates names from
+(e.g: "vdpa{n}" or "vdpa-{pci}-{idx}"). The placeholders are:
+  - {n} (or {idx}): the lowest number that gives a free name
+  - {pci}: the PCI address of the management device (or of the PCI device
+    it sits on), without separators (e.g: 000065002 for 0000:65:00.2)
+  - {mgmtdev}: the management device name without its bus
+
+An empty template restores DefaultNameTemplate
+*/
+func SetNameTemplate(template string) error {
+	if template == "" {
+		template = DefaultNameTemplate
+	}
+	if err := validateNameTemplate(template); err != nil {
+		return err
+	}
+	nameTemplateMu.Lock()
+	defer nameTemplateMu.Unlock()
+	nameTemplate = template
+	return nil
+}
+
+func getNameTemplate() string {
+	nameTemplateMu.RLock()
+	defer nameTemplateMu.RUnlock()
+	return nameTemplate
+}
+
+// renderName returns the name the template gives for a number
+func renderName(template string, n int, values map[string]string) string {
+	return namePlaceholderRe.ReplaceAllStringFunc(template, func(placeholder string) string {
+		switch placeholder {
+		case "{n}", "{idx}":
+			return strconv.Itoa(n)
+		}
+		return values[placeholder]
+	})
+}
+
+// templateValues returns the values of the management device placeholders
+func templateValues(ctx context.Context, template, mgmtDeviceName string) (map[string]string, error) {
+	busName, devName, err := splitMgmtDevName(mgmtDeviceName)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{"{mgmtdev}": devName}
+	if strings.Contains(template, "{pci}") {
+		mgmtDev, err := GetVdpaMgmtDevicesContext(ctx, busName, devName)
+		if err != nil {
+			return nil, err
+		}
+		pciAddress, err := mgmtDevPCIAddress(mgmtDev)
+		if err != nil {
+			return nil, err
+		}
+		if pciAddress == "" {
+			return nil, fmt.Errorf("management device %s has no PCI address for name template %q: %w",
+				mgmtDeviceName, template, syscall.EINVAL)
+		}
+		values["{pci}"] = strings.NewReplacer(":", "", ".", "").Replace(pciAddress)
+	}
+	return values, nil
+}
+
+/*
+AllocateVdpaDevice creates a vdpa device with a name allocated from the name
+template (see SetNameTemplate) and returns the name. Names already taken are
+skipped; if another process takes a name first, the kernel rejects the
+creation and the next name is tried
+*/
+func AllocateVdpaDevice(mgmtDeviceName string, config *VdpaNetConfig) (string, error) {
+	return AllocateVdpaDeviceContext(context.Background(), mgmtDeviceName, config)
+}
+
+// AllocateVdpaDeviceContext is AllocateVdpaDevice with a context
+func AllocateVdpaDeviceContext(ctx context.Context, mgmtDeviceName string, config *VdpaNetConfig) (string, error) {
+	template := getNameTemplate()
+	values, err := templateValues(ctx, template, mgmtDeviceName)
+	if err != nil {
+		return "", err
+	}
+	taken := map[string]bool{}
+	devs, err := ListVdpaDevicesContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, dev := range devs {
+		taken[dev.Name()] = true
+	}
+
+	counter := strings.Contains(template, "{n}") || strings.Contains(template, "{idx}")
+	for n := 0; n < maxNameAttempts; n++ {
+		name := renderName(template, n, values)
+		if len(name) > MaxVdpaDeviceNameLen {
+			return "", fmt.Errorf("name %q is longer than %d characters: %w", name, MaxVdpaDeviceNameLen, syscall.ENAMETOOLONG)
+		}
+		if !taken[name] {
+			err := AddVdpaDeviceWithConfigContext(ctx, mgmtDeviceName, name, config)
+			if err == nil {
+				return name, nil
+			}
+			if !errors.Is(err, syscall.EEXIST) {
+				return "", err
+			}
+		}
+		if !counter {
+			break
+		}
+	}
+	return "", fmt.Errorf("no free name for name template %q: %w", template, syscall.EEXIST)
+}
@@ -0,0 +1,41 @@
+package kvdpa
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNameTemplate(t *testing.T) {
+	values := map[string]string{"{pci}": "000065002", "{mgmtdev}": "0000:65:00.2"}
+	tests := []struct {
+		template string
+		err      bool
+		name     string
+	}{
+		{template: "vdpa{n}", name: "vdpa3"},
+		{template: "vdpa-{pci}-{idx}", name: "vdpa-000065002-3"},
+		{template: "{mgmtdev}-vdpa", name: "0000:65:00.2-vdpa"},
+		{template: "vdpa{unknown}", err: true},
+		{template: "vdpa/{n}", err: true},
+		{template: "vdpa{n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			err := validateNameTemplate(tt.template)
+			if tt.err {
+				assert.ErrorIs(t, err, syscall.EINVAL)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.name, renderName(tt.template, 3, values))
+		})
+	}
+}
+
+func TestAddVdpaDeviceNameTooLong(t *testing.T) {
+	err := AddVdpaDevice("pci/0000:65:00.2", strings.Repeat("v", MaxVdpaDeviceNameLen+1))
+	assert.ErrorIs(t, err, syscall.ENAMETOOLONG)
+}
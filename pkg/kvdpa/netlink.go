@@ -1,8 +1,13 @@
 package kvdpa
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netlink/nl"
@@ -22,6 +27,8 @@ const (
 	VdpaCmdDevDel
 	VdpaCmdDevGet       /* can dump */
 	VdpaCmdDevConfigGet /* can dump */
+	VdpaCmdDevVstatsGet
+	VdpaCmdDevAttrSet
 )
 
 /* VDPA Netlink Attributes */
@@ -45,6 +52,18 @@ const (
 	VdpaAttrDevNetCfgMaxVqp  /* u16 */
 	VdpaAttrGetNetCfgMTU     /* u16 */
 
+	VdpaAttrDevNegotiatedFeatures /* u64 */
+	VdpaAttrDevMgmtDevMaxVqs      /* u32 */
+	/* virtio features that are supported by the vDPA management device */
+	VdpaAttrDevSupportedFeatures /* u64 */
+
+	VdpaAttrDevQueueIndex      /* u32 */
+	VdpaAttrDevVendorAttrName  /* string */
+	VdpaAttrDevVendorAttrValue /* u64 */
+
+	/* virtio features that are provisioned to the vDPA device */
+	VdpaAttrDevFeatures /* u64 */
+
 	/* new attributes must be added above here */
 	VdpaAttrMax
 )
@@ -53,13 +72,72 @@ var (
 	commonNetlinkFlags = syscall.NLM_F_REQUEST | syscall.NLM_F_ACK
 )
 
+// nlmFDumpIntr is set by the kernel on the messages of a dump that was
+// interrupted by a concurrent change (NLM_F_DUMP_INTR)
+const nlmFDumpIntr = 0x10
+
+// ErrGenlFamilyNotFound is returned when the vdpa generic netlink family
+// cannot be resolved, e.g: because the kernel does not support it
+var ErrGenlFamilyNotFound = errors.New("vdpa generic netlink family not found")
+
+// ErrMalformedMessage is returned when a netlink response cannot be parsed,
+// e.g: because it was truncated
+var ErrMalformedMessage = errors.New("malformed vdpa netlink message")
+
+// ErrDumpInterrupted is returned when a dump was interrupted by a concurrent
+// change, so its result may be inconsistent. The dump can be retried
+var ErrDumpInterrupted = errors.New("vdpa netlink dump interrupted")
+
 // NetlinkOps defines the Netlink Operations
 type NetlinkOps interface {
 	RunVdpaNetlinkCmd(command uint8, flags int, data []*nl.RtAttr) ([][]byte, error)
 	NewAttribute(attrType int, data interface{}) (*nl.RtAttr, error)
 }
 
+// ContextNetlinkOps is implemented by the NetlinkOps whose commands can be
+// cancelled. Commands run through other NetlinkOps only check the context
+// before they start
+type ContextNetlinkOps interface {
+	RunVdpaNetlinkCmdContext(ctx context.Context, command uint8, flags int, data []*nl.RtAttr) ([][]byte, error)
+}
+
+// FamilyNetlinkOps is implemented by the NetlinkOps that can give the vdpa
+// generic netlink family, which tells what the kernel supports (see Capabilities)
+type FamilyNetlinkOps interface {
+	GetVdpaFamily() (*netlink.GenlFamily, error)
+}
+
+// errNoVdpaFamily is returned when the NetlinkOps cannot give the vdpa family
+var errNoVdpaFamily = errors.New("the netlink operations do not give the vdpa family")
+
+// getVdpaFamily returns the vdpa family through ops if they support it
+func getVdpaFamily(ops NetlinkOps) (*netlink.GenlFamily, error) {
+	familyOps, ok := ops.(FamilyNetlinkOps)
+	if !ok {
+		return nil, errNoVdpaFamily
+	}
+	return familyOps.GetVdpaFamily()
+}
+
+// runNetlinkOpsCmd runs a command through ops with the context if they support it
+func runNetlinkOpsCmd(ctx context.Context, ops NetlinkOps, command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctxOps, ok := ops.(ContextNetlinkOps); ok {
+		return ctxOps.RunVdpaNetlinkCmdContext(ctx, command, flags, data)
+	}
+	return ops.RunVdpaNetlinkCmd(command, flags, data)
+}
+
+// netlinkPollInterval is how often a netlink receive checks whether its
+// context is done
+var netlinkPollInterval = 100 * time.Millisecond
+
+// defaultNetlinkOps runs the commands through the kernel. Its commands share
+// a long-lived socket
 type defaultNetlinkOps struct {
+	genl genlClient
 }
 
 var netlinkOps NetlinkOps = &defaultNetlinkOps{}
@@ -74,35 +152,87 @@ func GetNetlinkOps() NetlinkOps {
 	return netlinkOps
 }
 
+// GetVdpaFamily returns the vdpa family. It is only queried from the generic
+// netlink controller the first time and after the vdpa module is reloaded
+func (ops *defaultNetlinkOps) GetVdpaFamily() (*netlink.GenlFamily, error) {
+	return ops.genl.getFamily()
+}
+
 // RunVdpaNerlinkCmd runs a vdpa netlink command and returns the response
-func (defaultNetlinkOps) RunVdpaNetlinkCmd(command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
-	f, err := netlink.GenlFamilyGet(VdpaGenlName)
-	if err != nil {
-		return nil, err
-	}
+func (ops *defaultNetlinkOps) RunVdpaNetlinkCmd(command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	return ops.RunVdpaNetlinkCmdContext(context.Background(), command, flags, data)
+}
 
-	msg := &nl.Genlmsg{
-		Command: command,
-		Version: nl.GENL_CTRL_VERSION,
-	}
-	req := nl.NewNetlinkRequest(int(f.ID), commonNetlinkFlags|flags)
+// RunVdpaNetlinkCmdContext runs a vdpa netlink command and returns the
+// response, unless the context is done first
+func (ops *defaultNetlinkOps) RunVdpaNetlinkCmdContext(ctx context.Context, command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	return ops.genl.request(ctx, command, flags, data)
+}
 
-	req.AddData(msg)
-	for _, d := range data {
-		req.AddData(d)
-	}
+// setNetlinkTap sets the function given the messages sent and received on
+// the socket
+func (ops *defaultNetlinkOps) setNetlinkTap(tap func(outgoing bool, msg []byte)) {
+	ops.genl.setTap(tap)
+}
 
-	msgs, err := req.Execute(syscall.NETLINK_GENERIC, 0)
-	if err != nil {
-		return nil, err
+// netlinkResponse accumulates the messages of a netlink response
+type netlinkResponse struct {
+	seq uint32
+	pid uint32
+	// ack is whether the reply is followed by an ack (NLM_F_ACK is set and
+	// the request is not a dump)
+	ack         bool
+	data        [][]byte
+	done        bool
+	interrupted bool
+}
+
+// add processes the received messages until the response is complete
+func (r *netlinkResponse) add(msgs []syscall.NetlinkMessage) error {
+	for _, m := range msgs {
+		if r.done {
+			return nil
+		}
+		if m.Header.Seq != r.seq {
+			return fmt.Errorf("wrong seq nr %d, expected %d", m.Header.Seq, r.seq)
+		}
+		if m.Header.Pid != r.pid {
+			continue
+		}
+		if m.Header.Flags&nlmFDumpIntr != 0 {
+			r.interrupted = true
+		}
+		switch m.Header.Type {
+		case syscall.NLMSG_DONE:
+			// A dump that failed midway ends with the errno
+			if len(m.Data) >= 4 {
+				if errno := int32(nl.NativeEndian().Uint32(m.Data[0:4])); errno != 0 {
+					return syscall.Errno(-errno)
+				}
+			}
+			r.done = true
+		case syscall.NLMSG_ERROR:
+			if len(m.Data) < 4 {
+				return fmt.Errorf("truncated netlink error message")
+			}
+			if errno := int32(nl.NativeEndian().Uint32(m.Data[0:4])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			r.done = true
+		default:
+			r.data = append(r.data, m.Data)
+			if m.Header.Flags&syscall.NLM_F_MULTI == 0 && !r.ack {
+				r.done = true
+			}
+		}
 	}
-	return msgs, nil
+	return nil
 }
 
 // NewAttribute returns a new netlink attribute based on the provided data
-func (defaultNetlinkOps) NewAttribute(attrType int, data interface{}) (*nl.RtAttr, error) {
+func (*defaultNetlinkOps) NewAttribute(attrType int, data interface{}) (*nl.RtAttr, error) {
 	switch attrType {
-	case VdpaAttrMgmtDevBusName, VdpaAttrMgmtDevDevName, VdpaAttrDevName:
+	case VdpaAttrMgmtDevBusName, VdpaAttrMgmtDevDevName, VdpaAttrDevName, VdpaAttrDevVendorAttrName:
 		strData, ok := data.(string)
 		if !ok {
 			return nil, fmt.Errorf("Attribute type %d requires string data", attrType)
@@ -110,30 +240,156 @@ func (defaultNetlinkOps) NewAttribute(attrType int, data interface{}) (*nl.RtAtt
 		bytes := make([]byte, len(strData)+1)
 		copy(bytes, strData)
 		return nl.NewRtAttr(attrType, bytes), nil
-		/* TODO
-		case:
-		    VdpaAttrMgmtDevBusName          string
-		    VdpaAttrMgmtDevDevName           string
-		    VdpaAttrMgmtDevSupportedClasses  u64
-
-		    VdpaAttrDevName       string
-		    VdpaAttrDevID         u32
-		    VdpaAttrDevVendorID   u32
-		    VdpaAttrDevMaxVqs     u32
-		    VdpaAttrDevMaxVqSize  u16
-		    VdpaAttrDevMinVqSize  u16
-
-		    VdpaAttrDevNetCfgMacAddr  binary
-		    VdpaAttrDevNetStatus      u8
-		    VdpaAttrDevNetCfgMaxVqp   u16
-		    VdpaAttrGetNetCfgMTU      u16
-		*/
+	case VdpaAttrDevID, VdpaAttrDevVendorID, VdpaAttrDevMaxVqs, VdpaAttrDevMgmtDevMaxVqs, VdpaAttrDevQueueIndex:
+		u32Data, ok := data.(uint32)
+		if !ok {
+			return nil, fmt.Errorf("Attribute type %d requires uint32 data", attrType)
+		}
+		return nl.NewRtAttr(attrType, nl.Uint32Attr(u32Data)), nil
+	case VdpaAttrDevMaxVqSize, VdpaAttrDevMinVqSize, VdpaAttrDevNetCfgMaxVqp, VdpaAttrGetNetCfgMTU:
+		u16Data, ok := data.(uint16)
+		if !ok {
+			return nil, fmt.Errorf("Attribute type %d requires uint16 data", attrType)
+		}
+		return nl.NewRtAttr(attrType, nl.Uint16Attr(u16Data)), nil
+	case VdpaAttrMgmtDevSupportedClasses, VdpaAttrDevNegotiatedFeatures, VdpaAttrDevSupportedFeatures,
+		VdpaAttrDevVendorAttrValue, VdpaAttrDevFeatures:
+		u64Data, ok := data.(uint64)
+		if !ok {
+			return nil, fmt.Errorf("Attribute type %d requires uint64 data", attrType)
+		}
+		return nl.NewRtAttr(attrType, nl.Uint64Attr(u64Data)), nil
+	case VdpaAttrDevNetStatus:
+		u8Data, ok := data.(uint8)
+		if !ok {
+			return nil, fmt.Errorf("Attribute type %d requires uint8 data", attrType)
+		}
+		return nl.NewRtAttr(attrType, nl.Uint8Attr(u8Data)), nil
+	case VdpaAttrDevNetCfgMacAddr:
+		binData, ok := data.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("Attribute type %d requires []byte data", attrType)
+		}
+		return nl.NewRtAttr(attrType, binData), nil
 	default:
 		return nil, fmt.Errorf("Invalid attribute type %d", attrType)
 	}
 
 }
 
+// parseGenlAttributes returns the attributes of a generic netlink message
+func parseGenlAttributes(m []byte) ([]syscall.NetlinkRouteAttr, error) {
+	if len(m) < nl.SizeofGenlmsg {
+		return nil, fmt.Errorf("%w: message too short (%d bytes)", ErrMalformedMessage, len(m))
+	}
+	return parseAttrs(m[nl.SizeofGenlmsg:])
+}
+
+// parseAttrs parses a stream of netlink attributes. Unlike nl.ParseRouteAttr,
+// it does not trust the attribute lengths
+func parseAttrs(b []byte) ([]syscall.NetlinkRouteAttr, error) {
+	var attrs []syscall.NetlinkRouteAttr
+	for len(b) > 0 {
+		if len(b) < syscall.SizeofRtAttr {
+			return nil, fmt.Errorf("%w: truncated attribute header", ErrMalformedMessage)
+		}
+		length := int(nl.NativeEndian().Uint16(b[0:2]))
+		if length < syscall.SizeofRtAttr || length > len(b) {
+			return nil, fmt.Errorf("%w: invalid attribute length %d", ErrMalformedMessage, length)
+		}
+		attrs = append(attrs, syscall.NetlinkRouteAttr{
+			Attr: syscall.RtAttr{
+				Len:  uint16(length),
+				Type: nl.NativeEndian().Uint16(b[2:4]),
+			},
+			Value: b[syscall.SizeofRtAttr:length],
+		})
+		// Attributes are 4 byte aligned but the last one may not be padded
+		aligned := (length + syscall.NLA_ALIGNTO - 1) &^ (syscall.NLA_ALIGNTO - 1)
+		if aligned > len(b) {
+			aligned = len(b)
+		}
+		b = b[aligned:]
+	}
+	return attrs, nil
+}
+
+// nlaTypeMask strips the NLA_F_NESTED and NLA_F_NET_BYTEORDER flags from
+// an attribute type
+const nlaTypeMask = 0x3fff
+
+// attrType returns the type of an attribute without its flags
+func attrType(a syscall.NetlinkRouteAttr) uint16 {
+	return a.Attr.Type & nlaTypeMask
+}
+
+// attrString returns the value of a string attribute. The kernel terminates
+// strings with a NUL but the value is not trusted: it ends at the first NUL,
+// if any, and may be empty
+func attrString(value []byte) string {
+	if i := bytes.IndexByte(value, 0); i >= 0 {
+		value = value[:i]
+	}
+	return string(value)
+}
+
+// checkAttrLen returns an error if an attribute is too short for its type
+func checkAttrLen(a syscall.NetlinkRouteAttr, size int, kind string) error {
+	if len(a.Value) < size {
+		return fmt.Errorf("%w: attribute %d too short for %s (%d bytes)",
+			ErrMalformedMessage, attrType(a), kind, len(a.Value))
+	}
+	return nil
+}
+
+// attrUint8 returns the value of a u8 attribute
+func attrUint8(a syscall.NetlinkRouteAttr) (uint8, error) {
+	if err := checkAttrLen(a, 1, "u8"); err != nil {
+		return 0, err
+	}
+	return a.Value[0], nil
+}
+
+// attrUint16 returns the value of a u16 attribute
+func attrUint16(a syscall.NetlinkRouteAttr) (uint16, error) {
+	if err := checkAttrLen(a, 2, "u16"); err != nil {
+		return 0, err
+	}
+	return nl.NativeEndian().Uint16(a.Value), nil
+}
+
+// attrUint32 returns the value of a u32 attribute
+func attrUint32(a syscall.NetlinkRouteAttr) (uint32, error) {
+	if err := checkAttrLen(a, 4, "u32"); err != nil {
+		return 0, err
+	}
+	return nl.NativeEndian().Uint32(a.Value), nil
+}
+
+// attrUint64 returns the value of a u64 attribute
+func attrUint64(a syscall.NetlinkRouteAttr) (uint64, error) {
+	if err := checkAttrLen(a, 8, "u64"); err != nil {
+		return 0, err
+	}
+	return nl.NativeEndian().Uint64(a.Value), nil
+}
+
+// validName returns whether a device name received from the kernel can be
+// used as a sysfs path component
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// addRawAttribute stores a copy of an attribute the parser does not know
+// about. If an attribute type is repeated, the last value is kept
+func addRawAttribute(raw map[uint16][]byte, a syscall.NetlinkRouteAttr) map[uint16][]byte {
+	if raw == nil {
+		raw = map[uint16][]byte{}
+	}
+	raw[attrType(a)] = append([]byte{}, a.Value...)
+	return raw
+}
+
 func newMockSingleMessage(command uint8, attrs []*nl.RtAttr) []byte {
 	b := make([]byte, 0)
 	dataBytes := make([][]byte, len(attrs)+1)
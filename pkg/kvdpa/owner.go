@@ -0,0 +1,131 @@
+package kvdpa
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultOwnerRegistry is the file that records the owners of the vdpa devices
+const DefaultOwnerRegistry = "/run/kvdpa/owners.json"
+
+// ownerRegistryVersion is the version of the owner registry format
+const ownerRegistryVersion = 1
+
+var (
+	ownerMu           sync.RWMutex
+	ownerRegistryPath = DefaultOwnerRegistry
+)
+
+// SetOwnerRegistry sets the file that records the owners and the labels of
+// the vdpa devices. Every process that creates vdpa devices must use the
+// same one. The default one is on a tmpfs: like the devices, the records do
+// not survive a reboot
+func SetOwnerRegistry(path string) {
+	ownerMu.Lock()
+	defer ownerMu.Unlock()
+	ownerRegistryPath = path
+}
+
+func getOwnerRegistry() string {
+	ownerMu.RLock()
+	defer ownerMu.RUnlock()
+	return ownerRegistryPath
+}
+
+// DeviceOwner records who created a vdpa device
+type DeviceOwner struct {
+	// Owner identifies the owner (e.g: a pod UID)
+	Owner string    `json:"owner"`
+	Since time.Time `json:"since"`
+}
+
+// ownerRegistry is the content of the owner registry
+type ownerRegistry struct {
+	Version int                    `json:"version"`
+	Owners  map[string]DeviceOwner `json:"owners"`
+	// Orphans are the devices without owner found by CollectGarbage
+	Orphans map[string]orphanMark `json:"orphanMarks,omitempty"`
+	// Labels are the labels of the devices (see SetVdpaDeviceLabels)
+	Labels map[string]deviceLabels `json:"labels,omitempty"`
+}
+
+// orphanMark records when a device instance was first found orphaned
+type orphanMark struct {
+	Since    time.Time      `json:"since"`
+	Identity DeviceIdentity `json:"identity"`
+}
+
+// deviceLabels are the labels of a vdpa device instance
+type deviceLabels struct {
+	Identity DeviceIdentity    `json:"identity"`
+	Labels   map[string]string `json:"labels"`
+}
+
+// ownerRegistryStore is the store of the owner registry
+var ownerRegistryStore = jsonStore{kind: "owner registry", version: ownerRegistryVersion, lockName: "owners"}
+
+func (r *ownerRegistry) init() {
+	if r.Owners == nil {
+		r.Owners = map[string]DeviceOwner{}
+	}
+	if r.Orphans == nil {
+		r.Orphans = map[string]orphanMark{}
+	}
+	if r.Labels == nil {
+		r.Labels = map[string]deviceLabels{}
+	}
+}
+
+// loadOwnerRegistry reads the registry. A missing file is an empty registry
+func loadOwnerRegistry(path string) (*ownerRegistry, error) {
+	r := &ownerRegistry{Version: ownerRegistryVersion}
+	if err := ownerRegistryStore.load(path, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// updateOwnerRegistry runs update on the registry under the registry lock
+// and saves it unless update fails
+func updateOwnerRegistry(update func(r *ownerRegistry) error) error {
+	r := &ownerRegistry{Version: ownerRegistryVersion}
+	return ownerRegistryStore.update(getOwnerRegistry(), r, func() error { return update(r) })
+}
+
+/*
+SetVdpaDeviceOwner records the owner of a vdpa device. Devices should be
+registered right after their creation: CollectGarbage deletes the devices
+without owner, and forgets the owners of the devices that do not exist
+*/
+func SetVdpaDeviceOwner(name, owner string) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid vdpa device name %q: %w", name, syscall.EINVAL)
+	}
+	if owner == "" {
+		return fmt.Errorf("empty owner of vdpa device %s: %w", name, syscall.EINVAL)
+	}
+	return updateOwnerRegistry(func(r *ownerRegistry) error {
+		r.Owners[name] = DeviceOwner{Owner: owner, Since: time.Now().UTC()}
+		delete(r.Orphans, name)
+		return nil
+	})
+}
+
+// RemoveVdpaDeviceOwner forgets the owner of a vdpa device, if any
+func RemoveVdpaDeviceOwner(name string) error {
+	return updateOwnerRegistry(func(r *ownerRegistry) error {
+		delete(r.Owners, name)
+		return nil
+	})
+}
+
+// GetVdpaDeviceOwners returns the owners of the vdpa devices by device name
+func GetVdpaDeviceOwners() (map[string]DeviceOwner, error) {
+	r, err := loadOwnerRegistry(getOwnerRegistry())
+	if err != nil {
+		return nil, err
+	}
+	return r.Owners, nil
+}
@@ -0,0 +1,266 @@
+package kvdpa
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// PcapEnvVar is the environment variable of EnablePcapFromEnv: the path of
+// the pcap file kvdpa writes its netlink traffic to
+const PcapEnvVar = "KVDPA_PCAP"
+
+const (
+	// linktypeNetlink is the pcap link type of the messages captured by nlmon
+	linktypeNetlink = 253
+	// arphrdNetlink is the hardware type of the netlink cooked header
+	arphrdNetlink = 824
+	// Packet types of the netlink cooked header
+	packetHost     = 0
+	packetOutgoing = 4
+
+	pcapSnapLen       = 262144
+	sizeofCookedHdr   = 16
+	sizeofPcapRecHdr  = 16
+	sizeofNlmsgErrHdr = 4
+)
+
+// EnablePcapFromEnv enables the export to the file of PcapEnvVar, if set,
+// like EnablePcap. The returned function is nil if it is not set
+func EnablePcapFromEnv() (func() error, error) {
+	path := os.Getenv(PcapEnvVar)
+	if path == "" {
+		return nil, nil
+	}
+	return EnablePcap(path)
+}
+
+// EnablePcap makes kvdpa write the netlink requests it sends and the
+// responses it receives to a pcap file that Wireshark can decode. The
+// returned function stops the export and closes the file; the caller owns it
+func EnablePcap(path string) (func() error, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	ops, err := NewPcapNetlinkOps(GetNetlinkOps(), file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	SetNetlinkOps(ops)
+	return func() error {
+		SetNetlinkOps(ops.ops)
+		ops.Close()
+		return file.Close()
+	}, nil
+}
+
+// netlinkTapper is implemented by the NetlinkOps that can give the messages
+// they send and receive on their socket
+type netlinkTapper interface {
+	setNetlinkTap(tap func(outgoing bool, msg []byte))
+}
+
+/*
+PcapNetlinkOps is a NetlinkOps that writes the commands it forwards, and
+their responses, to a pcap stream with the Linux netlink link type (as
+captured by nlmon).
+
+With the NetlinkOps of this package, the messages are captured on the socket
+as they are sent and received. Other NetlinkOps (e.g: a simulator) have no
+messages: they are rebuilt from the commands and their responses, with
+sequence numbers of the capture. Their errors are only written as netlink
+errors if they are errnos
+*/
+type PcapNetlinkOps struct {
+	ops    NetlinkOps
+	tapper netlinkTapper
+
+	mu       sync.Mutex
+	w        io.Writer
+	seq      uint32
+	familyID uint16
+}
+
+// NewPcapNetlinkOps returns a PcapNetlinkOps that forwards the commands to
+// ops and writes them to w
+func NewPcapNetlinkOps(ops NetlinkOps, w io.Writer) (*PcapNetlinkOps, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:24], linktypeNetlink)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	p := &PcapNetlinkOps{ops: ops, w: w}
+	if tapper, ok := ops.(netlinkTapper); ok {
+		p.tapper = tapper
+		tapper.setNetlinkTap(p.tap)
+	}
+	return p, nil
+}
+
+// Close stops capturing the messages of the socket. It does not close the
+// writer
+func (p *PcapNetlinkOps) Close() {
+	if p.tapper != nil {
+		p.tapper.setNetlinkTap(nil)
+	}
+}
+
+// tap writes a message sent or received on the socket
+func (p *PcapNetlinkOps) tap(outgoing bool, msg []byte) {
+	pktType := uint16(packetHost)
+	if outgoing {
+		pktType = packetOutgoing
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.writePacket(time.Now(), pktType, msg)
+}
+
+// GetVdpaFamily forwards the request if the NetlinkOps support it
+func (p *PcapNetlinkOps) GetVdpaFamily() (*netlink.GenlFamily, error) {
+	return getVdpaFamily(p.ops)
+}
+
+// NewAttribute forwards the request
+func (p *PcapNetlinkOps) NewAttribute(attrType int, data interface{}) (*nl.RtAttr, error) {
+	return p.ops.NewAttribute(attrType, data)
+}
+
+// RunVdpaNetlinkCmd forwards the command and writes the request and the
+// response. Failures to write the capture do not make the command fail
+func (p *PcapNetlinkOps) RunVdpaNetlinkCmd(command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	return p.RunVdpaNetlinkCmdContext(context.Background(), command, flags, data)
+}
+
+// RunVdpaNetlinkCmdContext is RunVdpaNetlinkCmd with a context
+func (p *PcapNetlinkOps) RunVdpaNetlinkCmdContext(ctx context.Context, command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	if p.tapper != nil {
+		return runNetlinkOpsCmd(ctx, p.ops, command, flags, data)
+	}
+
+	p.mu.Lock()
+	if p.familyID == 0 {
+		if family, err := getVdpaFamily(p.ops); err == nil {
+			p.familyID = family.ID
+		}
+	}
+	p.seq++
+	seq, familyID := p.seq, p.familyID
+	p.mu.Unlock()
+
+	genlmsg := &nl.Genlmsg{Command: command, Version: nl.GENL_CTRL_VERSION}
+	payload := genlmsg.Serialize()
+	for _, attr := range data {
+		payload = append(payload, attr.Serialize()...)
+	}
+	request := nlmsg(familyID, uint16(commonNetlinkFlags|flags), seq, payload)
+	sent := time.Now()
+
+	msgs, err := runNetlinkOpsCmd(ctx, p.ops, command, flags, data)
+	if errors.Is(err, ErrGenlFamilyNotFound) {
+		// Nothing was sent
+		return msgs, err
+	}
+	var errno syscall.Errno
+	if err != nil && !errors.As(err, &errno) && !errors.Is(err, ErrDumpInterrupted) {
+		// The failure did not come from the kernel (e.g: ErrMalformedMessage
+		// or a context done): only the request is written
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		_ = p.writePacket(sent, packetOutgoing, request)
+		return msgs, err
+	}
+
+	packets := [][]byte{}
+	dump := flags&syscall.NLM_F_DUMP != 0
+	for _, m := range msgs {
+		var msgFlags uint16
+		if dump {
+			msgFlags = syscall.NLM_F_MULTI
+		}
+		packets = append(packets, nlmsg(familyID, msgFlags, seq, m))
+	}
+	switch {
+	case errors.Is(err, ErrDumpInterrupted):
+		packets = append(packets, nlmsg(syscall.NLMSG_DONE, syscall.NLM_F_MULTI|nlmFDumpIntr, seq, make([]byte, 4)))
+	case err != nil:
+		packets = append(packets, nlmsgError(errno, request))
+	case dump:
+		packets = append(packets, nlmsg(syscall.NLMSG_DONE, syscall.NLM_F_MULTI, seq, make([]byte, 4)))
+	default:
+		packets = append(packets, nlmsgError(0, request))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.writePacket(sent, packetOutgoing, request)
+	received := time.Now()
+	for _, packet := range packets {
+		if werr := p.writePacket(received, packetHost, packet); werr != nil {
+			break
+		}
+	}
+	return msgs, err
+}
+
+// writePacket writes a pcap record with the netlink cooked header
+func (p *PcapNetlinkOps) writePacket(ts time.Time, pktType uint16, msg []byte) error {
+	record := make([]byte, sizeofPcapRecHdr+sizeofCookedHdr, sizeofPcapRecHdr+sizeofCookedHdr+len(msg))
+	length := uint32(sizeofCookedHdr + len(msg))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:12], length)
+	binary.LittleEndian.PutUint32(record[12:16], length)
+
+	// The cooked header fields are in network byte order
+	cooked := record[sizeofPcapRecHdr:]
+	binary.BigEndian.PutUint16(cooked[0:2], pktType)
+	binary.BigEndian.PutUint16(cooked[2:4], arphrdNetlink)
+	binary.BigEndian.PutUint16(cooked[14:16], syscall.NETLINK_GENERIC)
+
+	_, err := p.w.Write(append(record, msg...))
+	return err
+}
+
+// nlmsg returns a netlink message (in host byte order) with the payload
+func nlmsg(msgType, flags uint16, seq uint32, payload []byte) []byte {
+	hdr := syscall.NlMsghdr{
+		Len:   uint32(syscall.NLMSG_HDRLEN + len(payload)),
+		Type:  msgType,
+		Flags: flags,
+		Seq:   seq,
+	}
+	b := make([]byte, syscall.NLMSG_HDRLEN, int(hdr.Len))
+	native := nl.NativeEndian()
+	native.PutUint32(b[0:4], hdr.Len)
+	native.PutUint16(b[4:6], hdr.Type)
+	native.PutUint16(b[6:8], hdr.Flags)
+	native.PutUint32(b[8:12], hdr.Seq)
+	native.PutUint32(b[12:16], hdr.Pid)
+	return append(b, payload...)
+}
+
+// nlmsgError returns the NLMSG_ERROR message the kernel answers a request
+// with: an acknowledgement if errno is 0
+func nlmsgError(errno syscall.Errno, request []byte) []byte {
+	payload := make([]byte, sizeofNlmsgErrHdr, sizeofNlmsgErrHdr+syscall.NLMSG_HDRLEN)
+	nl.NativeEndian().PutUint32(payload[0:4], uint32(-int32(errno)))
+	// Like the kernel, only the header of the request is echoed back
+	payload = append(payload, request[:syscall.NLMSG_HDRLEN]...)
+	seq := nl.NativeEndian().Uint32(request[8:12])
+	return nlmsg(syscall.NLMSG_ERROR, 0, seq, payload)
+}
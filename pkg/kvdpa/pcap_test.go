@@ -0,0 +1,213 @@
+package kvdpa
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/mocks"
+)
+
+// pcapPacket is a packet read back from a pcap stream
+type pcapPacket struct {
+	pktType  uint16
+	protocol uint16
+	header   syscall.NlMsghdr
+	payload  []byte
+}
+
+func readPcap(t *testing.T, b []byte) []pcapPacket {
+	require.GreaterOrEqual(t, len(b), 24)
+	assert.Equal(t, uint32(0xa1b2c3d4), binary.LittleEndian.Uint32(b[0:4]))
+	assert.Equal(t, uint32(linktypeNetlink), binary.LittleEndian.Uint32(b[20:24]))
+	b = b[24:]
+
+	packets := []pcapPacket{}
+	for len(b) > 0 {
+		require.GreaterOrEqual(t, len(b), sizeofPcapRecHdr)
+		length := int(binary.LittleEndian.Uint32(b[8:12]))
+		require.Equal(t, length, int(binary.LittleEndian.Uint32(b[12:16])))
+		data := b[sizeofPcapRecHdr : sizeofPcapRecHdr+length]
+		b = b[sizeofPcapRecHdr+length:]
+
+		assert.Equal(t, uint16(arphrdNetlink), binary.BigEndian.Uint16(data[2:4]))
+		msgs, err := syscall.ParseNetlinkMessage(data[sizeofCookedHdr:])
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		packets = append(packets, pcapPacket{
+			pktType:  binary.BigEndian.Uint16(data[0:2]),
+			protocol: binary.BigEndian.Uint16(data[14:16]),
+			header:   msgs[0].Header,
+			payload:  msgs[0].Data,
+		})
+	}
+	return packets
+}
+
+func TestPcap(t *testing.T) {
+	fixture, err := LoadFixture("testdata/simulator/sim-pci-auxiliary.json")
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	ops, err := NewPcapNetlinkOps(NewReplayNetlinkOps(fixture), &buf)
+	require.NoError(t, err)
+	SetNetlinkOps(ops)
+	defer SetNetlinkOps(&defaultNetlinkOps{})
+
+	// A dump, a get and an error
+	mgmtDevs, err := ListVdpaMgmtDevices()
+	require.NoError(t, err)
+	require.Len(t, mgmtDevs, 2)
+	_, err = GetVdpaMgmtDevices("pci", "0000:65:00.2")
+	require.NoError(t, err)
+	_, err = GetVdpaDevice("missing")
+	require.ErrorIs(t, err, syscall.ENODEV)
+
+	packets := readPcap(t, buf.Bytes())
+	familyID := fixture.Family.ID
+	expected := []struct {
+		pktType uint16
+		msgType uint16
+		flags   uint16
+		seq     uint32
+	}{
+		{packetOutgoing, familyID, syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | syscall.NLM_F_DUMP, 1},
+		{packetHost, familyID, syscall.NLM_F_MULTI, 1},
+		{packetHost, familyID, syscall.NLM_F_MULTI, 1},
+		{packetHost, syscall.NLMSG_DONE, syscall.NLM_F_MULTI, 1},
+		{packetOutgoing, familyID, syscall.NLM_F_REQUEST | syscall.NLM_F_ACK, 2},
+		{packetHost, familyID, 0, 2},
+		{packetHost, syscall.NLMSG_ERROR, 0, 2},
+		{packetOutgoing, familyID, syscall.NLM_F_REQUEST | syscall.NLM_F_ACK, 3},
+		{packetHost, syscall.NLMSG_ERROR, 0, 3},
+	}
+	require.Len(t, packets, len(expected))
+	for i, e := range expected {
+		assert.Equal(t, e.pktType, packets[i].pktType, "packet %d", i)
+		assert.Equal(t, uint16(syscall.NETLINK_GENERIC), packets[i].protocol, "packet %d", i)
+		assert.Equal(t, e.msgType, packets[i].header.Type, "packet %d", i)
+		assert.Equal(t, e.flags, packets[i].header.Flags, "packet %d", i)
+		assert.Equal(t, e.seq, packets[i].header.Seq, "packet %d", i)
+	}
+
+	// The request carries the generic netlink header and the attributes
+	request := packets[4].payload
+	assert.Equal(t, VdpaCmdMgmtDevGet, request[0])
+	attrs, err := parseGenlAttributes(request)
+	require.NoError(t, err)
+	assert.Len(t, attrs, 2)
+
+	// The get is acknowledged and the error carries the errno
+	assert.Equal(t, int32(0), int32(nl.NativeEndian().Uint32(packets[6].payload[0:4])))
+	assert.Equal(t, -int32(syscall.ENODEV), int32(nl.NativeEndian().Uint32(packets[8].payload[0:4])))
+}
+
+func TestEnablePcap(t *testing.T) {
+	fixture, err := LoadFixture("testdata/simulator/sim-vdpasim.json")
+	require.NoError(t, err)
+	replay := NewReplayNetlinkOps(fixture)
+	SetNetlinkOps(replay)
+	defer SetNetlinkOps(&defaultNetlinkOps{})
+
+	path := filepath.Join(t.TempDir(), "vdpa.pcap")
+	stop, err := EnablePcap(path)
+	require.NoError(t, err)
+	_, err = ListVdpaMgmtDevices()
+	require.NoError(t, err)
+	require.NoError(t, stop())
+	assert.Equal(t, replay, GetNetlinkOps())
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	packets := readPcap(t, content)
+	require.NotEmpty(t, packets)
+	assert.Equal(t, uint16(packetOutgoing), packets[0].pktType)
+	assert.Equal(t, uint16(syscall.NLMSG_DONE), packets[len(packets)-1].header.Type)
+
+	// The environment variable only enables the export on request
+	t.Setenv(PcapEnvVar, "")
+	stop, err = EnablePcapFromEnv()
+	require.NoError(t, err)
+	assert.Nil(t, stop)
+	t.Setenv(PcapEnvVar, path)
+	stop, err = EnablePcapFromEnv()
+	require.NoError(t, err)
+	assert.NotEqual(t, replay, GetNetlinkOps())
+	require.NoError(t, stop())
+	assert.Equal(t, replay, GetNetlinkOps())
+}
+
+func TestPcapSocket(t *testing.T) {
+	if _, err := netlink.GenlFamilyGet(nl.GENL_CTRL_NAME); err != nil {
+		t.Skipf("generic netlink is not available: %v", err)
+	}
+	ops := &defaultNetlinkOps{genl: genlClient{name: nl.GENL_CTRL_NAME}}
+	t.Cleanup(ops.genl.close)
+	var buf bytes.Buffer
+	p, err := NewPcapNetlinkOps(ops, &buf)
+	require.NoError(t, err)
+
+	// The messages of the socket are written as they are
+	getFamily := func(name string) error {
+		attr := nl.NewRtAttr(nl.GENL_CTRL_ATTR_FAMILY_NAME, nl.ZeroTerminated(name))
+		_, err := p.RunVdpaNetlinkCmd(nl.GENL_CTRL_CMD_GETFAMILY, 0, []*nl.RtAttr{attr})
+		return err
+	}
+	require.NoError(t, getFamily(nl.GENL_CTRL_NAME))
+	assert.ErrorIs(t, getFamily("kvdpa-none"), syscall.ENOENT)
+	packets := readPcap(t, buf.Bytes())
+	require.Len(t, packets, 5)
+	expected := []struct {
+		pktType uint16
+		msgType uint16
+	}{
+		{packetOutgoing, nl.GENL_ID_CTRL},
+		{packetHost, nl.GENL_ID_CTRL},
+		{packetHost, syscall.NLMSG_ERROR},
+		{packetOutgoing, nl.GENL_ID_CTRL},
+		{packetHost, syscall.NLMSG_ERROR},
+	}
+	for i, e := range expected {
+		assert.Equal(t, e.pktType, packets[i].pktType, "packet %d", i)
+		assert.Equal(t, e.msgType, packets[i].header.Type, "packet %d", i)
+		if e.pktType == packetHost {
+			assert.Equal(t, ops.genl.pid, packets[i].header.Pid, "packet %d", i)
+		}
+	}
+	assert.Equal(t, packets[0].header.Seq, packets[1].header.Seq)
+	assert.Equal(t, packets[0].header.Seq, packets[2].header.Seq)
+	assert.Equal(t, packets[3].header.Seq, packets[4].header.Seq)
+	assert.Equal(t, int32(0), int32(nl.NativeEndian().Uint32(packets[2].payload[0:4])))
+	assert.Equal(t, -int32(syscall.ENOENT), int32(nl.NativeEndian().Uint32(packets[4].payload[0:4])))
+
+	// Nothing is written once closed
+	p.Close()
+	length := buf.Len()
+	require.NoError(t, getFamily(nl.GENL_CTRL_NAME))
+	assert.Equal(t, length, buf.Len())
+}
+
+func TestPcapLocalError(t *testing.T) {
+	netLinkMock := &mocks.NetlinkOps{}
+	netLinkMock.On("GetVdpaFamily").Return(&netlink.GenlFamily{ID: 0x20}, nil)
+	netLinkMock.On("RunVdpaNetlinkCmd", mock.AnythingOfType("uint8"), mock.AnythingOfType("int"), mock.Anything).
+		Return(nil, ErrMalformedMessage)
+	var buf bytes.Buffer
+	p, err := NewPcapNetlinkOps(familyMock{netLinkMock}, &buf)
+	require.NoError(t, err)
+
+	// The failure is not written as a kernel error
+	_, err = p.RunVdpaNetlinkCmd(VdpaCmdDevGet, 0, nil)
+	assert.ErrorIs(t, err, ErrMalformedMessage)
+	packets := readPcap(t, buf.Bytes())
+	require.Len(t, packets, 1)
+	assert.Equal(t, uint16(packetOutgoing), packets[0].pktType)
+}
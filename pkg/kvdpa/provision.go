@@ -0,0 +1,259 @@
+package kvdpa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+/*
+AddVdpaDevice creates a vdpa device on the given management device.
+The management device name has the form [busName/]devName
+*/
+func AddVdpaDevice(mgmtDeviceName, vdpaDeviceName string) error {
+	return AddVdpaDeviceWithConfigContext(context.Background(), mgmtDeviceName, vdpaDeviceName, nil)
+}
+
+/*AddVdpaDeviceContext is AddVdpaDevice with a context */
+func AddVdpaDeviceContext(ctx context.Context, mgmtDeviceName, vdpaDeviceName string) error {
+	return AddVdpaDeviceWithConfigContext(ctx, mgmtDeviceName, vdpaDeviceName, nil)
+}
+
+/*
+AddVdpaDeviceWithConfig creates a vdpa device on the given management device
+with a virtio net configuration. A nil configuration leaves it to the
+management device defaults
+*/
+func AddVdpaDeviceWithConfig(mgmtDeviceName, vdpaDeviceName string, config *VdpaNetConfig) error {
+	return AddVdpaDeviceWithConfigContext(context.Background(), mgmtDeviceName, vdpaDeviceName, config)
+}
+
+/*AddVdpaDeviceWithConfigContext is AddVdpaDeviceWithConfig with a context */
+func AddVdpaDeviceWithConfigContext(ctx context.Context, mgmtDeviceName, vdpaDeviceName string, config *VdpaNetConfig) error {
+	if !validName(vdpaDeviceName) {
+		return fmt.Errorf("invalid vdpa device name %q: %w", vdpaDeviceName, syscall.EINVAL)
+	}
+	if len(vdpaDeviceName) > MaxVdpaDeviceNameLen {
+		return fmt.Errorf("vdpa device name %q is too long: %w", vdpaDeviceName, syscall.ENAMETOOLONG)
+	}
+	data, err := mgmtDevNameAttrs(mgmtDeviceName)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockForOperation(ctx, vdpaDeviceName, mgmtDeviceName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	nameAttr, err := GetNetlinkOps().NewAttribute(VdpaAttrDevName, vdpaDeviceName)
+	if err != nil {
+		return err
+	}
+	data = append(data, nameAttr)
+	if config != nil {
+		configAttrs, err := config.attributes()
+		if err != nil {
+			return err
+		}
+		data = append(data, configAttrs...)
+	}
+	if getDryRun(ctx) != nil {
+		// Check what the kernel would otherwise reject
+		busName, devName, _ := splitMgmtDevName(mgmtDeviceName)
+		if _, err := GetVdpaMgmtDevicesContext(ctx, busName, devName); err != nil {
+			return err
+		}
+		if _, err := GetVdpaDeviceContext(ctx, vdpaDeviceName); err == nil {
+			return syscall.EEXIST
+		} else if !errors.Is(err, syscall.ENODEV) {
+			return err
+		}
+	}
+	return runMutatingCmd(ctx, VdpaCmdDevNew, 0, data)
+}
+
+/*
+DeleteVdpaDevice deletes a vdpa device by name. It fails with ErrDeviceInUse
+if processes hold the device open (see GetVdpaDeviceUsers)
+*/
+func DeleteVdpaDevice(name string) error {
+	return deleteVdpaDevice(context.Background(), name, false)
+}
+
+/*DeleteVdpaDeviceContext is DeleteVdpaDevice with a context */
+func DeleteVdpaDeviceContext(ctx context.Context, name string) error {
+	return deleteVdpaDevice(ctx, name, false)
+}
+
+/*
+ForceDeleteVdpaDevice deletes a vdpa device even if processes hold it open.
+The kernel then waits for them to release it
+*/
+func ForceDeleteVdpaDevice(name string) error {
+	return deleteVdpaDevice(context.Background(), name, true)
+}
+
+/*ForceDeleteVdpaDeviceContext is ForceDeleteVdpaDevice with a context */
+func ForceDeleteVdpaDeviceContext(ctx context.Context, name string) error {
+	return deleteVdpaDevice(ctx, name, true)
+}
+
+func deleteVdpaDevice(ctx context.Context, name string, force bool) error {
+	if err := removeVdpaDevice(ctx, name, force); err != nil {
+		return err
+	}
+	if getDryRun(ctx) != nil {
+		return nil
+	}
+	if err := forgetLabels(name); err != nil {
+		return fmt.Errorf("vdpa device %s deleted, removing its labels: %w", name, err)
+	}
+	return nil
+}
+
+// removeVdpaDevice deletes a vdpa device, leaving its records in the owner
+// registry to the caller
+func removeVdpaDevice(ctx context.Context, name string, force bool) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid vdpa device name %q: %w", name, syscall.EINVAL)
+	}
+	unlock, err := lockForOperation(ctx, name, "")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if !force {
+		if err := checkNotInUse(ctx, name); err != nil {
+			return err
+		}
+	}
+	nameAttr, err := GetNetlinkOps().NewAttribute(VdpaAttrDevName, name)
+	if err != nil {
+		return err
+	}
+	if getDryRun(ctx) != nil {
+		if _, err := GetVdpaDeviceContext(ctx, name); err != nil {
+			return err
+		}
+	}
+	return runMutatingCmd(ctx, VdpaCmdDevDel, 0, []*nl.RtAttr{nameAttr})
+}
+
+/*SetVdpaDeviceMacAddr sets the MAC address of a vdpa net device */
+func SetVdpaDeviceMacAddr(name string, mac net.HardwareAddr) error {
+	return SetVdpaDeviceMacAddrContext(context.Background(), name, mac)
+}
+
+/*SetVdpaDeviceMacAddrContext is SetVdpaDeviceMacAddr with a context */
+func SetVdpaDeviceMacAddrContext(ctx context.Context, name string, mac net.HardwareAddr) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid vdpa device name %q: %w", name, syscall.EINVAL)
+	}
+	if len(mac) != 6 {
+		return fmt.Errorf("invalid MAC address %q: %w", mac, syscall.EINVAL)
+	}
+	unlock, err := lockForOperation(ctx, name, "")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	nameAttr, err := GetNetlinkOps().NewAttribute(VdpaAttrDevName, name)
+	if err != nil {
+		return err
+	}
+	macAttr, err := GetNetlinkOps().NewAttribute(VdpaAttrDevNetCfgMacAddr, []byte(mac))
+	if err != nil {
+		return err
+	}
+	if getDryRun(ctx) != nil {
+		if _, err := GetVdpaDeviceContext(ctx, name); err != nil {
+			return err
+		}
+	}
+	return runMutatingCmd(ctx, VdpaCmdDevAttrSet, 0, []*nl.RtAttr{nameAttr, macAttr})
+}
+
+/*BindVdpaDevice binds a vdpa device to a vdpa bus driver (e.g: VhostVdpaDriver) */
+func BindVdpaDevice(name, driver string) error {
+	return BindVdpaDeviceContext(context.Background(), name, driver)
+}
+
+/*BindVdpaDeviceContext is BindVdpaDevice with a context */
+func BindVdpaDeviceContext(ctx context.Context, name, driver string) error {
+	if !validName(name) || !validName(driver) {
+		return fmt.Errorf("invalid vdpa device %q or driver %q: %w", name, driver, syscall.EINVAL)
+	}
+	unlock, err := lockForOperation(ctx, name, "")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(filepath.Join(vdpaBusDevDir, name)); err != nil {
+		if os.IsNotExist(err) {
+			return syscall.ENODEV
+		}
+		return err
+	}
+	bindPath := filepath.Join(vdpaBusDrvDir, driver, "bind")
+	if getDryRun(ctx) != nil {
+		if _, err := os.Stat(bindPath); err != nil {
+			return err
+		}
+	}
+	return writeSysfs(ctx, bindPath, name)
+}
+
+/*
+UnbindVdpaDevice unbinds a vdpa device from its driver, if any. It fails with
+ErrDeviceInUse if processes hold the device open (see GetVdpaDeviceUsers)
+*/
+func UnbindVdpaDevice(name string) error {
+	return unbindVdpaDevice(context.Background(), name, false)
+}
+
+/*UnbindVdpaDeviceContext is UnbindVdpaDevice with a context */
+func UnbindVdpaDeviceContext(ctx context.Context, name string) error {
+	return unbindVdpaDevice(ctx, name, false)
+}
+
+/*ForceUnbindVdpaDevice unbinds a vdpa device even if processes hold it open */
+func ForceUnbindVdpaDevice(name string) error {
+	return unbindVdpaDevice(context.Background(), name, true)
+}
+
+/*ForceUnbindVdpaDeviceContext is ForceUnbindVdpaDevice with a context */
+func ForceUnbindVdpaDeviceContext(ctx context.Context, name string) error {
+	return unbindVdpaDevice(ctx, name, true)
+}
+
+func unbindVdpaDevice(ctx context.Context, name string, force bool) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid vdpa device name %q: %w", name, syscall.EINVAL)
+	}
+	unlock, err := lockForOperation(ctx, name, "")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	driverLink, err := os.Readlink(filepath.Join(vdpaBusDevDir, name, "driver"))
+	if err != nil {
+		if _, statErr := os.Stat(filepath.Join(vdpaBusDevDir, name)); os.IsNotExist(statErr) {
+			return syscall.ENODEV
+		}
+		// The device is not bound to any driver
+		return nil
+	}
+	driver := filepath.Base(driverLink)
+	if driver == VhostVdpaDriver && !force {
+		if err := checkNotInUse(ctx, name); err != nil {
+			return err
+		}
+	}
+	return writeSysfs(ctx, filepath.Join(vdpaBusDrvDir, driver, "unbind"), name)
+}
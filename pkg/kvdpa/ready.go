@@ -0,0 +1,132 @@
+package kvdpa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// readyPollInterval is how often WaitReady checks the device between uevents
+var readyPollInterval = 100 * time.Millisecond
+
+// ReadyOptions configures WaitReadyWithOptions
+type ReadyOptions struct {
+	// Driver is the driver the device has to be bound to (any if empty)
+	Driver string
+	// NetDevUp requires the netdev of a virtio_vdpa device to be up
+	NetDevUp bool
+}
+
+/*
+WaitReady blocks until a vdpa device is bound to a driver and its endpoint
+exists: the vhost-vdpa device node for vhost_vdpa, the netdev for
+virtio_vdpa. It returns an error wrapping the context's one if the context
+is done first
+*/
+func WaitReady(ctx context.Context, name string) error {
+	return WaitReadyWithOptions(ctx, name, ReadyOptions{})
+}
+
+/*
+WaitReadyWithOptions is WaitReady with further conditions. The device is
+checked again on every uevent and, since netdev state changes have none and
+uevents may not be available, periodically
+*/
+func WaitReadyWithOptions(ctx context.Context, name string, opts ReadyOptions) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid vdpa device name %q: %w", name, syscall.EINVAL)
+	}
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Listen before the first check not to miss the uevents in between
+	events, err := ueventSource(watchCtx)
+	if err != nil {
+		events = nil
+	}
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+
+	for {
+		notReady := checkReady(name, opts)
+		if notReady == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("vdpa device %s is not ready (%v): %w", name, notReady, ctx.Err())
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkReady returns why a device is not ready, or nil if it is
+func checkReady(name string, opts ReadyOptions) error {
+	if _, err := os.Stat(filepath.Join(vdpaBusDevDir, name)); err != nil {
+		if os.IsNotExist(err) {
+			return syscall.ENODEV
+		}
+		return err
+	}
+	dev := &vdpaDev{name: name}
+	if err := dev.getBusInfo(); err != nil {
+		return err
+	}
+	if dev.driver == "" {
+		return errors.New("not bound to any driver")
+	}
+	if opts.Driver != "" && dev.driver != opts.Driver {
+		return fmt.Errorf("bound to %s instead of %s", dev.driver, opts.Driver)
+	}
+	if dev.driver != VirtioVdpaDriver {
+		return nil
+	}
+	netDev := dev.virtioNet.NetDev()
+	if netDev == "" {
+		return errors.New("no netdev")
+	}
+	if opts.NetDevUp {
+		up, err := netDevUp(filepath.Join(virtioDevDir, dev.virtioNet.Name(), "net", netDev))
+		if err != nil {
+			return err
+		}
+		if !up {
+			return fmt.Errorf("netdev %s is not up", netDev)
+		}
+	}
+	return nil
+}
+
+// netDevUp returns whether a netdev is operationally up. Drivers that do not
+// track the state report it as unknown: the administrative state is used then
+func netDevUp(path string) (bool, error) {
+	content, err := ioutil.ReadFile(filepath.Join(path, "operstate"))
+	if err != nil {
+		return false, err
+	}
+	switch strings.TrimSpace(string(content)) {
+	case "up":
+		return true, nil
+	case "unknown":
+		flags, err := ioutil.ReadFile(filepath.Join(path, "flags"))
+		if err != nil {
+			return false, err
+		}
+		value, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(flags)), "0x"), 16, 32)
+		if err != nil {
+			return false, err
+		}
+		return value&syscall.IFF_UP != 0, nil
+	}
+	return false, nil
+}
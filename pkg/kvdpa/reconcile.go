@@ -0,0 +1,376 @@
+package kvdpa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// DesiredState is a declarative description of the vdpa devices of a host
+type DesiredState struct {
+	Devices []DesiredDevice `json:"devices"`
+	// Prune makes the reconciler delete the devices that are not listed
+	Prune bool `json:"prune,omitempty"`
+}
+
+// DesiredDevice is the desired state of a vdpa device. The zero fields
+// (but the name and the management device) are not managed
+type DesiredDevice struct {
+	Name string `json:"name"`
+	// MgmtDev is the management device name: [busName/]devName, as
+	// returned by MgmtDev.Name()
+	MgmtDev    string `json:"mgmtdev"`
+	MAC        string `json:"mac,omitempty"`
+	MTU        uint16 `json:"mtu,omitempty"`
+	QueuePairs uint16 `json:"queuePairs,omitempty"`
+	// Features are the virtio features provisioned to the device
+	Features uint64 `json:"features,omitempty"`
+	// Driver is the vdpa bus driver (e.g: VhostVdpaDriver)
+	Driver string `json:"driver,omitempty"`
+}
+
+// LoadDesiredState reads a desired state document
+func LoadDesiredState(path string) (*DesiredState, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &DesiredState{}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("invalid desired state %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// validate checks the desired state before anything is planned
+func (s *DesiredState) validate() error {
+	names := map[string]bool{}
+	for _, d := range s.Devices {
+		if !validName(d.Name) {
+			return fmt.Errorf("invalid vdpa device name %q: %w", d.Name, syscall.EINVAL)
+		}
+		if names[d.Name] {
+			return fmt.Errorf("duplicate vdpa device %s: %w", d.Name, syscall.EINVAL)
+		}
+		names[d.Name] = true
+		if _, _, err := splitMgmtDevName(d.MgmtDev); err != nil {
+			return fmt.Errorf("device %s: %w", d.Name, err)
+		}
+		if _, err := d.macAddr(); err != nil {
+			return fmt.Errorf("device %s: %w", d.Name, err)
+		}
+		if d.Driver != "" && d.Driver != VhostVdpaDriver && d.Driver != VirtioVdpaDriver {
+			return fmt.Errorf("device %s: unknown driver %s: %w", d.Name, d.Driver, syscall.EINVAL)
+		}
+	}
+	return nil
+}
+
+func (d *DesiredDevice) macAddr() (net.HardwareAddr, error) {
+	if d.MAC == "" {
+		return nil, nil
+	}
+	mac, err := net.ParseMAC(d.MAC)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %q: %w", d.MAC, syscall.EINVAL)
+	}
+	return mac, nil
+}
+
+// config returns the configuration the device is created with
+func (d *DesiredDevice) config() *VdpaNetConfig {
+	mac, _ := d.macAddr()
+	return &VdpaNetConfig{MacAddr: mac, MTU: d.MTU, MaxVqp: d.QueuePairs, Features: d.Features}
+}
+
+// StepAction is what a plan step does
+type StepAction int
+
+const (
+	// StepDelete deletes a device
+	StepDelete StepAction = iota
+	// StepCreate creates a device with its configuration
+	StepCreate
+	// StepAttrSet sets the MAC address of an existing device
+	StepAttrSet
+	// StepRebind binds a device to its driver, unbinding it first if needed
+	StepRebind
+)
+
+func (a StepAction) String() string {
+	switch a {
+	case StepDelete:
+		return "delete"
+	case StepCreate:
+		return "create"
+	case StepAttrSet:
+		return "attr-set"
+	case StepRebind:
+		return "rebind"
+	}
+	return fmt.Sprintf("StepAction(%d)", int(a))
+}
+
+// PlanStep is a step of a reconciliation plan
+type PlanStep struct {
+	Action StepAction
+	Device string
+	// Desired is the desired state of the device, nil for devices that are
+	// deleted because they are not listed
+	Desired *DesiredDevice
+	// Reason tells why the step is needed
+	Reason string
+}
+
+func (s PlanStep) String() string {
+	return fmt.Sprintf("%s %s: %s", s.Action, s.Device, s.Reason)
+}
+
+// Plan is the ordered list of steps that bring the devices to the desired
+// state: deletes, then creates, attr-sets and rebinds
+type Plan struct {
+	Steps []PlanStep
+}
+
+// String returns the steps, one per line
+func (p *Plan) String() string {
+	var b strings.Builder
+	for _, step := range p.Steps {
+		b.WriteString(step.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// ErrStepSkipped is the error of the steps that were not applied because a
+// previous step on the same device failed
+var ErrStepSkipped = errors.New("skipped after a previous step failed")
+
+// StepResult is the result of applying a plan step
+type StepResult struct {
+	Step PlanStep
+	// Changed is false if the device already was in the desired state
+	Changed bool
+	Err     error
+}
+
+// deviceDiff is the difference between a device and its desired state
+type deviceDiff struct {
+	recreate string
+	attrSet  string
+	rebind   string
+}
+
+// diffDevice compares an existing device with its desired state
+func diffDevice(ctx context.Context, dev VdpaDevice, desired *DesiredDevice) (deviceDiff, error) {
+	diff := deviceDiff{}
+	// The management device is unknown with the sysfs fallback: it is not
+	// taken as different
+	if mgmtDev := dev.MgmtDev(); mgmtDev != nil && mgmtDev.Name() != desired.MgmtDev {
+		diff.recreate = fmt.Sprintf("management device is %s instead of %s", mgmtDev.Name(), desired.MgmtDev)
+	} else if desired.MAC != "" || desired.MTU != 0 || desired.QueuePairs != 0 || desired.Features != 0 {
+		config, err := GetVdpaDeviceConfigContext(ctx, dev.Name())
+		if err != nil {
+			return diff, err
+		}
+		mac, _ := desired.macAddr()
+		switch {
+		case desired.MTU != 0 && config.MTU != desired.MTU:
+			diff.recreate = fmt.Sprintf("MTU is %d instead of %d", config.MTU, desired.MTU)
+		case desired.QueuePairs != 0 && config.MaxVqp != desired.QueuePairs:
+			diff.recreate = fmt.Sprintf("queue pairs are %d instead of %d", config.MaxVqp, desired.QueuePairs)
+		case desired.Features != 0 && config.Features != desired.Features:
+			diff.recreate = fmt.Sprintf("features are %#x instead of %#x", config.Features, desired.Features)
+		case mac != nil && !bytes.Equal(config.MacAddr, mac):
+			diff.attrSet = fmt.Sprintf("MAC address is %q instead of %s", config.MacAddr.String(), mac)
+		}
+	}
+	if desired.Driver != "" && (diff.recreate != "" || dev.Driver() != desired.Driver) {
+		diff.rebind = fmt.Sprintf("driver is %q instead of %s", dev.Driver(), desired.Driver)
+	}
+	return diff, nil
+}
+
+// PlanReconcile compares the devices with the desired state and returns the
+// plan that reconciles them
+func PlanReconcile(desired *DesiredState) (*Plan, error) {
+	return PlanReconcileContext(context.Background(), desired)
+}
+
+// PlanReconcileContext is PlanReconcile with a context
+func PlanReconcileContext(ctx context.Context, desired *DesiredState) (*Plan, error) {
+	if err := desired.validate(); err != nil {
+		return nil, err
+	}
+	devs, err := ListVdpaDevicesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	current := map[string]VdpaDevice{}
+	for _, dev := range devs {
+		current[dev.Name()] = dev
+	}
+
+	var deletes, creates, attrSets, rebinds []PlanStep
+	if desired.Prune {
+		listed := map[string]bool{}
+		for _, d := range desired.Devices {
+			listed[d.Name] = true
+		}
+		for _, dev := range devs {
+			if !listed[dev.Name()] {
+				deletes = append(deletes, PlanStep{Action: StepDelete, Device: dev.Name(), Reason: "not in the desired state"})
+			}
+		}
+	}
+	for i := range desired.Devices {
+		d := &desired.Devices[i]
+		dev, ok := current[d.Name]
+		if !ok {
+			creates = append(creates, PlanStep{Action: StepCreate, Device: d.Name, Desired: d, Reason: "does not exist"})
+			if d.Driver != "" {
+				rebinds = append(rebinds, PlanStep{Action: StepRebind, Device: d.Name, Desired: d, Reason: "new device"})
+			}
+			continue
+		}
+		diff, err := diffDevice(ctx, dev, d)
+		if err != nil {
+			return nil, fmt.Errorf("device %s: %w", d.Name, err)
+		}
+		if diff.recreate != "" {
+			deletes = append(deletes, PlanStep{Action: StepDelete, Device: d.Name, Desired: d, Reason: diff.recreate})
+			creates = append(creates, PlanStep{Action: StepCreate, Device: d.Name, Desired: d, Reason: diff.recreate})
+		}
+		if diff.attrSet != "" {
+			attrSets = append(attrSets, PlanStep{Action: StepAttrSet, Device: d.Name, Desired: d, Reason: diff.attrSet})
+		}
+		if diff.rebind != "" {
+			rebinds = append(rebinds, PlanStep{Action: StepRebind, Device: d.Name, Desired: d, Reason: diff.rebind})
+		}
+	}
+
+	plan := &Plan{Steps: []PlanStep{}}
+	for _, steps := range [][]PlanStep{deletes, creates, attrSets, rebinds} {
+		plan.Steps = append(plan.Steps, steps...)
+	}
+	return plan, nil
+}
+
+// ApplyPlan applies the steps of a plan in order. Each step checks the
+// current state first, so applying a plan again does not change anything.
+// Once a step on a device fails, the following steps on that device are
+// skipped
+func ApplyPlan(plan *Plan) []StepResult {
+	return ApplyPlanContext(context.Background(), plan)
+}
+
+// ApplyPlanContext is ApplyPlan with a context. Once the context is done,
+// the remaining steps fail with its error
+func ApplyPlanContext(ctx context.Context, plan *Plan) []StepResult {
+	results := make([]StepResult, 0, len(plan.Steps))
+	failed := map[string]bool{}
+	for _, step := range plan.Steps {
+		result := StepResult{Step: step}
+		if failed[step.Device] {
+			result.Err = ErrStepSkipped
+		} else if err := ctx.Err(); err != nil {
+			result.Err = err
+		} else {
+			result.Changed, result.Err = applyStep(ctx, step)
+		}
+		if result.Err != nil {
+			failed[step.Device] = true
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Reconcile plans and applies the reconciliation of the devices with the
+// desired state
+func Reconcile(desired *DesiredState) ([]StepResult, error) {
+	return ReconcileContext(context.Background(), desired)
+}
+
+// ReconcileContext is Reconcile with a context
+func ReconcileContext(ctx context.Context, desired *DesiredState) ([]StepResult, error) {
+	plan, err := PlanReconcileContext(ctx, desired)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyPlanContext(ctx, plan), nil
+}
+
+// applyStep applies a step and returns whether it changed anything
+func applyStep(ctx context.Context, step PlanStep) (bool, error) {
+	dev, err := GetVdpaDeviceContext(ctx, step.Device)
+	exists := err == nil
+	if err != nil && !errors.Is(err, syscall.ENODEV) {
+		return false, err
+	}
+
+	switch step.Action {
+	case StepDelete:
+		if !exists {
+			return false, nil
+		}
+		if step.Desired != nil {
+			// The device is recreated: it may have been already
+			diff, err := diffDevice(ctx, dev, step.Desired)
+			if err != nil {
+				return false, err
+			}
+			if diff.recreate == "" {
+				return false, nil
+			}
+		}
+		return true, DeleteVdpaDeviceContext(ctx, step.Device)
+	case StepCreate:
+		if exists {
+			if dev.MgmtDev() != nil && dev.MgmtDev().Name() != step.Desired.MgmtDev {
+				return false, syscall.EEXIST
+			}
+			return false, nil
+		}
+		return true, AddVdpaDeviceWithConfigContext(ctx, step.Desired.MgmtDev, step.Device, step.Desired.config())
+	case StepAttrSet:
+		if !exists {
+			return false, syscall.ENODEV
+		}
+		mac, _ := step.Desired.macAddr()
+		config, err := GetVdpaDeviceConfigContext(ctx, step.Device)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(config.MacAddr, mac) {
+			return false, nil
+		}
+		return true, SetVdpaDeviceMacAddrContext(ctx, step.Device, mac)
+	case StepRebind:
+		if !exists {
+			return false, syscall.ENODEV
+		}
+		return rebindVdpaDevice(ctx, dev, step.Desired.Driver)
+	}
+	return false, fmt.Errorf("unknown plan step %s", step.Action)
+}
+
+// rebindVdpaDevice binds a device to a driver, unbinding it first if it is
+// bound to another one, and returns whether it changed anything
+func rebindVdpaDevice(ctx context.Context, dev VdpaDevice, driver string) (bool, error) {
+	if dev.Driver() == driver {
+		return false, nil
+	}
+	if dev.Driver() != "" {
+		if err := UnbindVdpaDeviceContext(ctx, dev.Name()); err != nil {
+			return true, err
+		}
+	}
+	return true, BindVdpaDeviceContext(ctx, dev.Name(), driver)
+}
@@ -0,0 +1,317 @@
+package kvdpa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// FixtureVersion is the version of the netlink session fixture format
+const FixtureVersion = 1
+
+// Fixture is a recorded netlink session: the vdpa family and the commands
+// that were run, with their requests and responses
+type Fixture struct {
+	Version int `json:"version"`
+	// Description tells where the session was recorded (hardware, driver...)
+	Description string `json:"description,omitempty"`
+	// Kernel is the release of the kernel the session was recorded on
+	Kernel    string            `json:"kernel,omitempty"`
+	Family    *FixtureFamily    `json:"family,omitempty"`
+	Exchanges []FixtureExchange `json:"exchanges"`
+}
+
+// FixtureFamily is a recorded vdpa generic netlink family
+type FixtureFamily struct {
+	ID       uint16   `json:"id"`
+	Version  uint32   `json:"version"`
+	MaxAttr  uint32   `json:"maxAttr"`
+	Commands []uint32 `json:"commands"`
+	// Error is set if the family could not be resolved
+	Error string `json:"error,omitempty"`
+}
+
+// FixtureAttr is a recorded netlink attribute
+type FixtureAttr struct {
+	Type uint16 `json:"type"`
+	Data []byte `json:"data"`
+}
+
+// FixtureExchange is a recorded netlink command
+type FixtureExchange struct {
+	Command  uint8         `json:"command"`
+	Flags    int           `json:"flags"`
+	Request  []FixtureAttr `json:"request,omitempty"`
+	Response [][]byte      `json:"response,omitempty"`
+	// Errno or Error are set if the command failed
+	Errno syscall.Errno `json:"errno,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// LoadFixture reads a netlink session fixture file
+func LoadFixture(path string) (*Fixture, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fixture := &Fixture{}
+	if err := json.Unmarshal(content, fixture); err != nil {
+		return nil, fmt.Errorf("invalid fixture %s: %v", path, err)
+	}
+	if fixture.Version < 1 || fixture.Version > FixtureVersion {
+		return nil, fmt.Errorf("unsupported fixture version %d in %s", fixture.Version, path)
+	}
+	return fixture, nil
+}
+
+// Save writes the fixture to a file
+func (f *Fixture) Save(path string) error {
+	content, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(content, '\n'), 0644)
+}
+
+// knownErrors are the errors that are recorded by value rather than by message
+var knownErrors = []error{ErrGenlFamilyNotFound, ErrDumpInterrupted, ErrMalformedMessage}
+
+func encodeError(err error) (syscall.Errno, string) {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno, ""
+	}
+	return 0, err.Error()
+}
+
+func decodeError(errno syscall.Errno, msg string) error {
+	if errno != 0 {
+		return errno
+	}
+	if msg == "" {
+		return nil
+	}
+	for _, known := range knownErrors {
+		if msg == known.Error() || strings.HasPrefix(msg, known.Error()+":") {
+			return fmt.Errorf("%w%s", known, msg[len(known.Error()):])
+		}
+	}
+	return errors.New(msg)
+}
+
+func encodeAttrs(data []*nl.RtAttr) []FixtureAttr {
+	if len(data) == 0 {
+		return nil
+	}
+	attrs := make([]FixtureAttr, 0, len(data))
+	for _, attr := range data {
+		attrs = append(attrs, FixtureAttr{Type: attr.Type, Data: attr.Data})
+	}
+	return attrs
+}
+
+// RecordingNetlinkOps is a NetlinkOps that records the commands it forwards
+// so that they can be replayed with ReplayNetlinkOps, e.g: in unit tests
+type RecordingNetlinkOps struct {
+	ops     NetlinkOps
+	mu      sync.Mutex
+	fixture Fixture
+}
+
+// NewRecordingNetlinkOps returns a RecordingNetlinkOps that forwards the commands to ops
+func NewRecordingNetlinkOps(ops NetlinkOps, description string) *RecordingNetlinkOps {
+	r := &RecordingNetlinkOps{
+		ops: ops,
+		fixture: Fixture{
+			Version:     FixtureVersion,
+			Description: description,
+			Exchanges:   []FixtureExchange{},
+		},
+	}
+	var uname syscall.Utsname
+	if err := syscall.Uname(&uname); err == nil {
+		release := make([]byte, 0, len(uname.Release))
+		for _, c := range uname.Release {
+			if c == 0 {
+				break
+			}
+			release = append(release, byte(c))
+		}
+		r.fixture.Kernel = string(release)
+	}
+	return r
+}
+
+// Fixture returns the session recorded so far
+func (r *RecordingNetlinkOps) Fixture() *Fixture {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fixture := r.fixture
+	fixture.Exchanges = append([]FixtureExchange{}, r.fixture.Exchanges...)
+	return &fixture
+}
+
+// GetVdpaFamily forwards and records the request if the NetlinkOps support it
+func (r *RecordingNetlinkOps) GetVdpaFamily() (*netlink.GenlFamily, error) {
+	family, err := getVdpaFamily(r.ops)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		_, msg := encodeError(err)
+		r.fixture.Family = &FixtureFamily{Error: msg}
+		return nil, err
+	}
+	r.fixture.Family = &FixtureFamily{
+		ID:       family.ID,
+		Version:  family.Version,
+		MaxAttr:  family.MaxAttr,
+		Commands: make([]uint32, 0, len(family.Ops)),
+	}
+	for _, op := range family.Ops {
+		r.fixture.Family.Commands = append(r.fixture.Family.Commands, op.ID)
+	}
+	return family, nil
+}
+
+// RunVdpaNetlinkCmd forwards and records the command
+func (r *RecordingNetlinkOps) RunVdpaNetlinkCmd(command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	return r.RunVdpaNetlinkCmdContext(context.Background(), command, flags, data)
+}
+
+// RunVdpaNetlinkCmdContext is RunVdpaNetlinkCmd with a context
+func (r *RecordingNetlinkOps) RunVdpaNetlinkCmdContext(ctx context.Context, command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	// Commands resolve the family on their own, so it is recorded beforehand
+	r.mu.Lock()
+	familyRecorded := r.fixture.Family != nil
+	r.mu.Unlock()
+	if !familyRecorded {
+		_, _ = r.GetVdpaFamily()
+	}
+
+	msgs, err := runNetlinkOpsCmd(ctx, r.ops, command, flags, data)
+	// Cancelled commands are not part of the session
+	if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return nil, err
+	}
+
+	exchange := FixtureExchange{
+		Command:  command,
+		Flags:    flags,
+		Request:  encodeAttrs(data),
+		Response: msgs,
+	}
+	if err != nil {
+		exchange.Errno, exchange.Error = encodeError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fixture.Exchanges = append(r.fixture.Exchanges, exchange)
+	return msgs, err
+}
+
+// NewAttribute forwards the request
+func (r *RecordingNetlinkOps) NewAttribute(attrType int, data interface{}) (*nl.RtAttr, error) {
+	return r.ops.NewAttribute(attrType, data)
+}
+
+// ReplayNetlinkOps is a NetlinkOps that serves a recorded session.
+// Each command is answered with the first unused recorded exchange with
+// the same command, flags and request. Once all of them have been used,
+// the last one is served again
+type ReplayNetlinkOps struct {
+	fixture *Fixture
+	mu      sync.Mutex
+	used    []bool
+}
+
+// NewReplayNetlinkOps returns a ReplayNetlinkOps that serves the fixture
+func NewReplayNetlinkOps(fixture *Fixture) *ReplayNetlinkOps {
+	return &ReplayNetlinkOps{
+		fixture: fixture,
+		used:    make([]bool, len(fixture.Exchanges)),
+	}
+}
+
+// GetVdpaFamily returns the recorded vdpa family
+func (r *ReplayNetlinkOps) GetVdpaFamily() (*netlink.GenlFamily, error) {
+	recorded := r.fixture.Family
+	if recorded == nil {
+		return nil, fmt.Errorf("%w: not recorded", ErrGenlFamilyNotFound)
+	}
+	if recorded.Error != "" {
+		return nil, decodeError(0, recorded.Error)
+	}
+	family := &netlink.GenlFamily{
+		ID:      recorded.ID,
+		Name:    VdpaGenlName,
+		Version: recorded.Version,
+		MaxAttr: recorded.MaxAttr,
+	}
+	for _, cmd := range recorded.Commands {
+		family.Ops = append(family.Ops, netlink.GenlOp{ID: cmd})
+	}
+	return family, nil
+}
+
+// RunVdpaNetlinkCmd returns the recorded response to the command
+func (r *ReplayNetlinkOps) RunVdpaNetlinkCmd(command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	return r.RunVdpaNetlinkCmdContext(context.Background(), command, flags, data)
+}
+
+// RunVdpaNetlinkCmdContext is RunVdpaNetlinkCmd with a context, which is
+// only checked before the response is served
+func (r *ReplayNetlinkOps) RunVdpaNetlinkCmdContext(ctx context.Context, command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	request := encodeAttrs(data)
+	match := -1
+	for i, exchange := range r.fixture.Exchanges {
+		if exchange.Command != command || exchange.Flags != flags || !sameAttrs(exchange.Request, request) {
+			continue
+		}
+		match = i
+		if !r.used[i] {
+			break
+		}
+	}
+	if match < 0 {
+		return nil, fmt.Errorf("no recorded response to command %d with flags %#x", command, flags)
+	}
+	r.used[match] = true
+	exchange := r.fixture.Exchanges[match]
+	if err := decodeError(exchange.Errno, exchange.Error); err != nil {
+		return nil, err
+	}
+	return exchange.Response, nil
+}
+
+// NewAttribute returns a new netlink attribute as the default NetlinkOps does
+func (r *ReplayNetlinkOps) NewAttribute(attrType int, data interface{}) (*nl.RtAttr, error) {
+	return (&defaultNetlinkOps{}).NewAttribute(attrType, data)
+}
+
+func sameAttrs(a, b []FixtureAttr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type != b[i].Type || !bytes.Equal(a[i].Data, b[i].Data) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package kvdpa
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// RetryPolicy defines how netlink commands that fail with a transient error
+// (an interrupted dump, EAGAIN, EBUSY or EINTR) are retried.
+// Only commands that do not modify the devices (e.g: VdpaCmdDevGet) are
+// retried since a failed modification may have been partially applied
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one.
+	// A value lower than 2 disables retries
+	MaxAttempts int
+	// Backoff is the delay before the first retry. It doubles on every
+	// retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used unless SetRetryPolicy is called
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Backoff:     10 * time.Millisecond,
+	MaxBackoff:  500 * time.Millisecond,
+}
+
+var retryPolicy = DefaultRetryPolicy
+
+// SetRetryPolicy sets the policy used to retry transient netlink errors
+func SetRetryPolicy(policy RetryPolicy) {
+	retryPolicy = policy
+}
+
+// IsTransientError returns whether a netlink command failed with an error
+// that may not happen if the command is retried
+func IsTransientError(err error) bool {
+	return errors.Is(err, ErrDumpInterrupted) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EBUSY) ||
+		errors.Is(err, syscall.EINTR)
+}
+
+// readOnlyCommand returns whether a vdpa command does not modify any device
+func readOnlyCommand(command uint8) bool {
+	switch command {
+	case VdpaCmdMgmtDevGet, VdpaCmdDevGet, VdpaCmdDevConfigGet, VdpaCmdDevVstatsGet:
+		return true
+	}
+	return false
+}
+
+// runVdpaNetlinkCmd runs a vdpa netlink command, retrying transient errors
+// according to the retry policy until the context is done
+func runVdpaNetlinkCmd(ctx context.Context, command uint8, flags int, data []*nl.RtAttr) ([][]byte, error) {
+	policy := retryPolicy
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		msgs, err := runNetlinkOpsCmd(ctx, GetNetlinkOps(), command, flags, data)
+		if err == nil || !IsTransientError(err) || !readOnlyCommand(command) ||
+			attempt >= policy.MaxAttempts {
+			return msgs, err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
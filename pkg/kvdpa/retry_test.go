@@ -0,0 +1,207 @@
+package kvdpa
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/mocks"
+)
+
+func TestRetry(t *testing.T) {
+	mgmtDevs := mgmtDevToNlMessage(t, &mgmtDev{devName: "vdpasim_net"})
+	tests := []struct {
+		name    string
+		command uint8
+		errs    []error
+		calls   int
+		err     error
+	}{
+		{
+			name:    "No error",
+			command: VdpaCmdMgmtDevGet,
+			calls:   1,
+		},
+		{
+			name:    "Interrupted dump",
+			command: VdpaCmdMgmtDevGet,
+			errs:    []error{ErrDumpInterrupted, ErrDumpInterrupted},
+			calls:   3,
+		},
+		{
+			name:    "Transient errors",
+			command: VdpaCmdMgmtDevGet,
+			errs:    []error{syscall.EAGAIN, syscall.EINTR},
+			calls:   3,
+		},
+		{
+			name:    "Too many transient errors",
+			command: VdpaCmdMgmtDevGet,
+			errs:    []error{syscall.EBUSY, syscall.EBUSY, syscall.EBUSY, syscall.EBUSY},
+			calls:   3,
+			err:     syscall.EBUSY,
+		},
+		{
+			name:    "Permanent error",
+			command: VdpaCmdMgmtDevGet,
+			errs:    []error{syscall.EPERM},
+			calls:   1,
+			err:     syscall.EPERM,
+		},
+		{
+			name:    "Modifications are not retried",
+			command: VdpaCmdDevDel,
+			errs:    []error{syscall.EBUSY},
+			calls:   1,
+			err:     syscall.EBUSY,
+		},
+	}
+
+	SetRetryPolicy(RetryPolicy{MaxAttempts: 3})
+	defer SetRetryPolicy(DefaultRetryPolicy)
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s_%s", "TestRetry", tt.name), func(t *testing.T) {
+			netLinkMock := &mocks.NetlinkOps{}
+			SetNetlinkOps(netLinkMock)
+			for _, err := range tt.errs {
+				netLinkMock.On("RunVdpaNetlinkCmd", tt.command, mock.Anything, mock.Anything).
+					Return(nil, err).Once()
+			}
+			netLinkMock.On("RunVdpaNetlinkCmd", tt.command, mock.Anything, mock.Anything).
+				Return(mgmtDevs, nil)
+
+			_, err := runVdpaNetlinkCmd(context.Background(), tt.command, 0, nil)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			netLinkMock.AssertNumberOfCalls(t, "RunVdpaNetlinkCmd", tt.calls)
+		})
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	SetRetryPolicy(RetryPolicy{MaxAttempts: 5, Backoff: time.Hour, MaxBackoff: time.Hour})
+	defer SetRetryPolicy(DefaultRetryPolicy)
+	netLinkMock := &mocks.NetlinkOps{}
+	SetNetlinkOps(netLinkMock)
+	defer SetNetlinkOps(&defaultNetlinkOps{})
+	netLinkMock.On("RunVdpaNetlinkCmd", uint8(VdpaCmdDevGet), mock.Anything, mock.Anything).
+		Return(nil, syscall.EBUSY)
+
+	// The backoff is interrupted
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := runVdpaNetlinkCmd(ctx, VdpaCmdDevGet, 0, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	netLinkMock.AssertNumberOfCalls(t, "RunVdpaNetlinkCmd", 1)
+
+	// No command is run with a done context
+	_, err = runVdpaNetlinkCmd(ctx, VdpaCmdDevGet, 0, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	netLinkMock.AssertNumberOfCalls(t, "RunVdpaNetlinkCmd", 1)
+}
+
+func TestNetlinkResponse(t *testing.T) {
+	const seq, pid = 10, 1000
+	message := func(msgType uint16, flags uint16, data []byte) syscall.NetlinkMessage {
+		return syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: msgType, Flags: flags, Seq: seq, Pid: pid},
+			Data:   data,
+		}
+	}
+	errnoData := func(errno syscall.Errno) []byte {
+		return nl.Uint32Attr(uint32(-int32(errno)))
+	}
+	errMessage := func(errno syscall.Errno) syscall.NetlinkMessage {
+		return message(syscall.NLMSG_ERROR, 0, errnoData(errno))
+	}
+	tests := []struct {
+		name        string
+		batches     [][]syscall.NetlinkMessage
+		ack         bool
+		data        int
+		interrupted bool
+		err         error
+	}{
+		{
+			name:    "Single message",
+			batches: [][]syscall.NetlinkMessage{{message(0x1c, 0, []byte{1})}},
+			data:    1,
+		},
+		{
+			name: "Reply and ack",
+			batches: [][]syscall.NetlinkMessage{
+				{message(0x1c, 0, []byte{1})},
+				{errMessage(0)},
+			},
+			ack:  true,
+			data: 1,
+		},
+		{
+			name: "Dump",
+			batches: [][]syscall.NetlinkMessage{
+				{message(0x1c, syscall.NLM_F_MULTI, []byte{1}), message(0x1c, syscall.NLM_F_MULTI, []byte{2})},
+				{message(0x1c, syscall.NLM_F_MULTI, []byte{3}), message(syscall.NLMSG_DONE, syscall.NLM_F_MULTI, nil)},
+			},
+			data: 3,
+		},
+		{
+			name: "Interrupted dump",
+			batches: [][]syscall.NetlinkMessage{
+				{message(0x1c, syscall.NLM_F_MULTI, []byte{1})},
+				{message(0x1c, syscall.NLM_F_MULTI|nlmFDumpIntr, []byte{2})},
+				{message(syscall.NLMSG_DONE, syscall.NLM_F_MULTI|nlmFDumpIntr, nil)},
+			},
+			data:        2,
+			interrupted: true,
+		},
+		{
+			name: "Failed dump",
+			batches: [][]syscall.NetlinkMessage{
+				{message(0x1c, syscall.NLM_F_MULTI, []byte{1})},
+				{message(syscall.NLMSG_DONE, syscall.NLM_F_MULTI, errnoData(syscall.EMSGSIZE))},
+			},
+			data: 1,
+			err:  syscall.EMSGSIZE,
+		},
+		{
+			name:    "Error",
+			batches: [][]syscall.NetlinkMessage{{errMessage(syscall.ENODEV)}},
+			err:     syscall.ENODEV,
+		},
+		{
+			name:    "Ack",
+			batches: [][]syscall.NetlinkMessage{{errMessage(0)}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s_%s", "TestNetlinkResponse", tt.name), func(t *testing.T) {
+			resp := &netlinkResponse{seq: seq, pid: pid, ack: tt.ack}
+			var err error
+			for _, batch := range tt.batches {
+				assert.False(t, resp.done)
+				if err = resp.add(batch); err != nil {
+					break
+				}
+			}
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, resp.done)
+			assert.Len(t, resp.data, tt.data)
+			assert.Equal(t, tt.interrupted, resp.interrupted)
+		})
+	}
+}
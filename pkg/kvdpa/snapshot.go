@@ -0,0 +1,320 @@
+package kvdpa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot format
+const SnapshotVersion = 1
+
+// Snapshot is a serialisable view of the vdpa state of a host. Management
+// devices and devices are sorted by name so that the JSON encoding of the
+// same state is always the same
+type Snapshot struct {
+	Version  int               `json:"version"`
+	Time     time.Time         `json:"time"`
+	MgmtDevs []SnapshotMgmtDev `json:"mgmtdevs"`
+	Devices  []SnapshotDevice  `json:"devices"`
+}
+
+// SnapshotMgmtDev is a management device of a snapshot
+type SnapshotMgmtDev struct {
+	Name       string `json:"name"`
+	PCIAddress string `json:"pciAddress,omitempty"`
+}
+
+// SnapshotDevice is a vdpa device of a snapshot
+type SnapshotDevice struct {
+	Name     string `json:"name"`
+	MgmtDev  string `json:"mgmtdev"`
+	DeviceID uint32 `json:"deviceID"`
+	VendorID uint32 `json:"vendorID"`
+	// Parent is the path of the parent device relative to /sys/devices
+	Parent           string `json:"parent,omitempty"`
+	ParentPCIAddress string `json:"parentPCIAddress,omitempty"`
+	Driver           string `json:"driver,omitempty"`
+	// VhostPath is the vhost-vdpa character device of vhost_vdpa devices
+	VhostPath string `json:"vhostPath,omitempty"`
+	// VirtioName and NetDev are the virtio device and its netdev for
+	// virtio_vdpa devices
+	VirtioName string          `json:"virtioName,omitempty"`
+	NetDev     string          `json:"netdev,omitempty"`
+	Config     *SnapshotConfig `json:"config,omitempty"`
+}
+
+// SnapshotConfig is the virtio net configuration of a device of a snapshot
+type SnapshotConfig struct {
+	MAC                string `json:"mac,omitempty"`
+	MTU                uint16 `json:"mtu"`
+	MaxVqp             uint16 `json:"maxVqp"`
+	Status             uint8  `json:"status"`
+	Features           uint64 `json:"features"`
+	NegotiatedFeatures uint64 `json:"negotiatedFeatures"`
+}
+
+// TakeSnapshot returns a snapshot of the current vdpa state. The device
+// configuration is only included if the kernel supports retrieving it
+func TakeSnapshot() (*Snapshot, error) {
+	return TakeSnapshotContext(context.Background())
+}
+
+// TakeSnapshotContext is TakeSnapshot with a context
+func TakeSnapshotContext(ctx context.Context) (*Snapshot, error) {
+	mgmtDevs, err := ListVdpaMgmtDevicesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	devs, err := ListVdpaDevicesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	configGet := false
+	if caps, err := CapabilitiesContext(ctx); err == nil {
+		configGet = caps.ConfigGet
+	}
+
+	snapshot := &Snapshot{
+		Version:  SnapshotVersion,
+		Time:     time.Now().UTC(),
+		MgmtDevs: make([]SnapshotMgmtDev, 0, len(mgmtDevs)),
+		Devices:  make([]SnapshotDevice, 0, len(devs)),
+	}
+	for _, m := range mgmtDevs {
+		pciAddress, err := mgmtDevPCIAddress(m)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.MgmtDevs = append(snapshot.MgmtDevs, SnapshotMgmtDev{Name: m.Name(), PCIAddress: pciAddress})
+	}
+	for _, dev := range devs {
+		s, err := snapshotDevice(ctx, dev, configGet)
+		if err != nil {
+			return nil, fmt.Errorf("device %s: %w", dev.Name(), err)
+		}
+		snapshot.Devices = append(snapshot.Devices, s)
+	}
+	snapshot.sort()
+	return snapshot, nil
+}
+
+func snapshotDevice(ctx context.Context, dev VdpaDevice, configGet bool) (SnapshotDevice, error) {
+	s := SnapshotDevice{
+		Name:     dev.Name(),
+		DeviceID: dev.DeviceID(),
+		VendorID: dev.VendorID(),
+		Driver:   dev.Driver(),
+	}
+	if dev.MgmtDev() != nil {
+		s.MgmtDev = dev.MgmtDev().Name()
+	}
+	if parent, err := dev.ParentDevicePath(); err == nil {
+		if rel, err := filepath.Rel(rootDevDir, parent); err == nil {
+			s.Parent = rel
+		}
+		s.ParentPCIAddress = pciAddressInPath(parent)
+	}
+	if vhost := dev.VhostVdpa(); vhost != nil {
+		s.VhostPath = vhost.Path()
+	}
+	if virtio := dev.VirtioNet(); virtio != nil {
+		s.VirtioName = virtio.Name()
+		s.NetDev = virtio.NetDev()
+	}
+	if configGet && dev.DeviceID() == VirtioIDNet {
+		config, err := GetVdpaDeviceConfigContext(ctx, dev.Name())
+		if err != nil {
+			return s, err
+		}
+		s.Config = &SnapshotConfig{
+			MTU:                config.MTU,
+			MaxVqp:             config.MaxVqp,
+			Status:             config.Status,
+			Features:           config.Features,
+			NegotiatedFeatures: config.NegotiatedFeatures,
+		}
+		if len(config.MacAddr) > 0 {
+			s.Config.MAC = config.MacAddr.String()
+		}
+	}
+	return s, nil
+}
+
+func (s *Snapshot) sort() {
+	sort.Slice(s.MgmtDevs, func(i, j int) bool { return s.MgmtDevs[i].Name < s.MgmtDevs[j].Name })
+	sort.Slice(s.Devices, func(i, j int) bool { return s.Devices[i].Name < s.Devices[j].Name })
+}
+
+// LoadSnapshot reads a snapshot file
+func LoadSnapshot(path string) (*Snapshot, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(content, snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %v", path, err)
+	}
+	if snapshot.Version < 1 || snapshot.Version > SnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d in %s", snapshot.Version, path)
+	}
+	snapshot.sort()
+	return snapshot, nil
+}
+
+// Save writes the snapshot to a file
+func (s *Snapshot) Save(path string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(content, '\n'), 0644)
+}
+
+// FieldChange is a field of a device that changed between two snapshots
+type FieldChange struct {
+	Field  string
+	Before string
+	After  string
+}
+
+// DeviceChange lists the fields of a device that changed between two snapshots
+type DeviceChange struct {
+	Name   string
+	Fields []FieldChange
+}
+
+// SnapshotDiff is the difference between two snapshots
+type SnapshotDiff struct {
+	AddedMgmtDevs   []string
+	RemovedMgmtDevs []string
+	Added           []string
+	Removed         []string
+	Changed         []DeviceChange
+}
+
+// Empty returns whether the snapshots describe the same state
+func (d *SnapshotDiff) Empty() bool {
+	return len(d.AddedMgmtDevs) == 0 && len(d.RemovedMgmtDevs) == 0 &&
+		len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// String returns a printable form of the difference
+func (d *SnapshotDiff) String() string {
+	var b strings.Builder
+	for _, name := range d.AddedMgmtDevs {
+		fmt.Fprintf(&b, "+ mgmtdev %s\n", name)
+	}
+	for _, name := range d.RemovedMgmtDevs {
+		fmt.Fprintf(&b, "- mgmtdev %s\n", name)
+	}
+	for _, name := range d.Added {
+		fmt.Fprintf(&b, "+ device %s\n", name)
+	}
+	for _, name := range d.Removed {
+		fmt.Fprintf(&b, "- device %s\n", name)
+	}
+	for _, change := range d.Changed {
+		fmt.Fprintf(&b, "~ device %s\n", change.Name)
+		for _, f := range change.Fields {
+			fmt.Fprintf(&b, "    %s: %q -> %q\n", f.Field, f.Before, f.After)
+		}
+	}
+	return b.String()
+}
+
+// fields returns the comparable fields of a device, in a stable order
+func (d *SnapshotDevice) fields() [][2]string {
+	fields := [][2]string{
+		{"mgmtdev", d.MgmtDev},
+		{"deviceID", fmt.Sprint(d.DeviceID)},
+		{"vendorID", fmt.Sprintf("%#x", d.VendorID)},
+		{"parent", d.Parent},
+		{"parentPCIAddress", d.ParentPCIAddress},
+		{"driver", d.Driver},
+		{"vhostPath", d.VhostPath},
+		{"virtioName", d.VirtioName},
+		{"netdev", d.NetDev},
+	}
+	config := d.Config
+	if config == nil {
+		config = &SnapshotConfig{}
+	}
+	return append(fields, [][2]string{
+		{"config.mac", config.MAC},
+		{"config.mtu", fmt.Sprint(config.MTU)},
+		{"config.maxVqp", fmt.Sprint(config.MaxVqp)},
+		{"config.status", fmt.Sprintf("%#x", config.Status)},
+		{"config.features", fmt.Sprintf("%#x", config.Features)},
+		{"config.negotiatedFeatures", fmt.Sprintf("%#x", config.NegotiatedFeatures)},
+	}...)
+}
+
+// DiffSnapshots returns the management devices and devices that were added
+// or removed between two snapshots, and the fields of the devices that changed
+func DiffSnapshots(before, after *Snapshot) *SnapshotDiff {
+	diff := &SnapshotDiff{}
+
+	beforeMgmtDevs := map[string]bool{}
+	for _, m := range before.MgmtDevs {
+		beforeMgmtDevs[m.Name] = true
+	}
+	afterMgmtDevs := map[string]bool{}
+	for _, m := range after.MgmtDevs {
+		afterMgmtDevs[m.Name] = true
+		if !beforeMgmtDevs[m.Name] {
+			diff.AddedMgmtDevs = append(diff.AddedMgmtDevs, m.Name)
+		}
+	}
+	for _, m := range before.MgmtDevs {
+		if !afterMgmtDevs[m.Name] {
+			diff.RemovedMgmtDevs = append(diff.RemovedMgmtDevs, m.Name)
+		}
+	}
+
+	beforeDevs := map[string]*SnapshotDevice{}
+	for i := range before.Devices {
+		beforeDevs[before.Devices[i].Name] = &before.Devices[i]
+	}
+	afterDevs := map[string]bool{}
+	for i := range after.Devices {
+		dev := &after.Devices[i]
+		afterDevs[dev.Name] = true
+		old, ok := beforeDevs[dev.Name]
+		if !ok {
+			diff.Added = append(diff.Added, dev.Name)
+			continue
+		}
+		change := DeviceChange{Name: dev.Name}
+		oldFields, newFields := old.fields(), dev.fields()
+		for j := range newFields {
+			if oldFields[j][1] != newFields[j][1] {
+				change.Fields = append(change.Fields, FieldChange{
+					Field:  newFields[j][0],
+					Before: oldFields[j][1],
+					After:  newFields[j][1],
+				})
+			}
+		}
+		if len(change.Fields) > 0 {
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+	for _, dev := range before.Devices {
+		if !afterDevs[dev.Name] {
+			diff.Removed = append(diff.Removed, dev.Name)
+		}
+	}
+	sort.Strings(diff.AddedMgmtDevs)
+	sort.Strings(diff.RemovedMgmtDevs)
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Name < diff.Changed[j].Name })
+	return diff
+}
@@ -0,0 +1,106 @@
+package kvdpa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// storeLockTimeout is how long an update waits for the lock of a store
+const storeLockTimeout = 10 * time.Second
+
+// storeContent is the content of a jsonStore
+type storeContent interface {
+	// init fills what a missing or empty store lacks (e.g: nil maps)
+	init()
+}
+
+// jsonStore is a versioned JSON file shared by the processes of a host
+// (e.g: the owner registry). Updates are serialized by a lock and the file is
+// replaced atomically, so it is read without the lock
+type jsonStore struct {
+	// kind names the store in errors (e.g: "owner registry")
+	kind    string
+	version int
+	// lockName is the name of the lock of the updates
+	lockName string
+}
+
+// load reads the store into content. A missing file is an empty store
+func (s jsonStore) load(path string, content storeContent) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		header := struct {
+			Version int `json:"version"`
+		}{}
+		if err := json.Unmarshal(data, &header); err != nil {
+			return fmt.Errorf("invalid %s %s: %v", s.kind, path, err)
+		}
+		if header.Version != s.version {
+			return fmt.Errorf("unsupported %s version %d in %s", s.kind, header.Version, path)
+		}
+		if err := json.Unmarshal(data, content); err != nil {
+			return fmt.Errorf("invalid %s %s: %v", s.kind, path, err)
+		}
+	}
+	content.init()
+	return nil
+}
+
+// update loads the store into content under the store lock, runs update and
+// saves the store unless update fails
+func (s jsonStore) update(path string, content storeContent, update func() error) error {
+	l, err := lock(context.Background(), s.lockName, time.Now().Add(storeLockTimeout))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = l.Unlock() }()
+	if err := s.load(path, content); err != nil {
+		return err
+	}
+	if err := update(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// writeFileAtomic writes a file through a temporary file renamed over it:
+// readers see either the old or the new content
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
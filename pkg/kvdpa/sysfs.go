@@ -0,0 +1,201 @@
+package kvdpa
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/* The sysfs fallback is used when the vdpa generic netlink family is not
+available. It can only provide the information that is exposed in sysfs:
+ - The management devices are the parents of the existing vdpa devices, so
+   management devices without any vdpa device are not listed.
+ - The management device of the devices whose parent is the root device is unknown.
+ - The device and vendor IDs are only known for devices bound to virtio_vdpa.
+The fields a device lacks are reported by its UnavailableFields method.
+*/
+
+// listVdpaDevicesSysfs returns the vdpa devices found in sysfs
+func listVdpaDevicesSysfs(filters ...VdpaDeviceFilter) ([]VdpaDevice, error) {
+	entries, err := os.ReadDir(vdpaBusDevDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []VdpaDevice{}, nil
+		}
+		return nil, err
+	}
+
+	devices := make([]*vdpaDev, 0, len(entries))
+	for _, entry := range entries {
+		dev, err := newVdpaDevSysfs(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, dev)
+	}
+
+	// The device and vendor IDs are only known once the bus information
+	// is resolved so all filters are applied afterwards
+	resolved, err := resolveBusInfo(devices, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]VdpaDevice, 0, len(resolved))
+	for _, d := range resolved {
+		dev := d.(*vdpaDev)
+		if err := dev.getVirtioIDs(); err != nil {
+			return nil, err
+		}
+		if !matchAttributes(dev, filters) {
+			continue
+		}
+		match, err := matchBusInfo(dev, filters)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			result = append(result, dev)
+		}
+	}
+	return result, nil
+}
+
+// getVdpaDeviceSysfs returns a vdpa device found in sysfs
+func getVdpaDeviceSysfs(name string) (VdpaDevice, error) {
+	dev, err := newVdpaDevSysfs(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := dev.getBusInfo(); err != nil {
+		return nil, err
+	}
+	if err := dev.getVirtioIDs(); err != nil {
+		return nil, err
+	}
+	return dev, nil
+}
+
+// listVdpaMgmtDevicesSysfs returns the management devices of the vdpa devices
+// found in sysfs
+func listVdpaMgmtDevicesSysfs() ([]MgmtDev, error) {
+	entries, err := os.ReadDir(vdpaBusDevDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []MgmtDev{}, nil
+		}
+		return nil, err
+	}
+
+	mgmtDevs := []MgmtDev{}
+	found := map[string]bool{}
+	for _, entry := range entries {
+		dev, err := newVdpaDevSysfs(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if dev.mgmtDev == nil || found[dev.mgmtDev.Name()] {
+			continue
+		}
+		found[dev.mgmtDev.Name()] = true
+		mgmtDevs = append(mgmtDevs, dev.mgmtDev)
+	}
+	return mgmtDevs, nil
+}
+
+// getVdpaMgmtDeviceSysfs returns a management device of the vdpa devices
+// found in sysfs
+func getVdpaMgmtDeviceSysfs(busName, devName string) (MgmtDev, error) {
+	mgmtDevs, err := listVdpaMgmtDevicesSysfs()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mgmtDevs {
+		if m.BusName() == busName && m.DevName() == devName {
+			return m, nil
+		}
+	}
+	return nil, syscall.ENODEV
+}
+
+// newVdpaDevSysfs returns a vdpa device with the information that can be
+// inferred from its sysfs path: its name and management device
+func newVdpaDevSysfs(name string) (*vdpaDev, error) {
+	devicePath, err := filepath.EvalSymlinks(filepath.Join(vdpaBusDevDir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, syscall.ENODEV
+		}
+		return nil, err
+	}
+
+	dev := &vdpaDev{
+		name:        name,
+		unavailable: []string{"DeviceID", "VendorID"},
+	}
+	parentPath := filepath.Dir(devicePath)
+	if parentPath == rootDevDir {
+		dev.unavailable = append(dev.unavailable, "MgmtDev")
+		return dev, nil
+	}
+
+	// The management device is the parent device, whose bus is its subsystem
+	dev.mgmtDev = &mgmtDev{
+		devName: filepath.Base(parentPath),
+	}
+	if subsystem, err := os.Readlink(filepath.Join(parentPath, "subsystem")); err == nil {
+		dev.mgmtDev.busName = filepath.Base(subsystem)
+	}
+	return dev, nil
+}
+
+// getVirtioIDs populates the device and vendor IDs of a device bound to
+// the virtio_vdpa driver from its virtio device
+func (vd *vdpaDev) getVirtioIDs() error {
+	if vd.virtioNet == nil {
+		return nil
+	}
+	virtioPath := filepath.Join(virtioDevDir, vd.virtioNet.Name())
+	deviceID, err := readSysfsUint32(filepath.Join(virtioPath, "device"))
+	if err != nil {
+		return err
+	}
+	vendorID, err := readSysfsUint32(filepath.Join(virtioPath, "vendor"))
+	if err != nil {
+		return err
+	}
+	vd.deviceID, vd.vendorID = deviceID, vendorID
+
+	var unavailable []string
+	for _, field := range vd.unavailable {
+		if field != "DeviceID" && field != "VendorID" {
+			unavailable = append(unavailable, field)
+		}
+	}
+	vd.unavailable = unavailable
+	return nil
+}
+
+// readSysfsUint64 reads a sysfs file holding a number (e.g: a counter)
+func readSysfsUint64(path string) (uint64, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(content)), 0, 64)
+}
+
+// readSysfsUint32 reads a sysfs file holding a (usually hexadecimal) number
+func readSysfsUint32(path string) (uint32, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(content)), 0, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(value), nil
+}
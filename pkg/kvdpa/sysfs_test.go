@@ -0,0 +1,274 @@
+package kvdpa
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/mocks"
+)
+
+// fakeSysfs is a fake sysfs and devfs tree. Creating it points the package's
+// paths to it until the test finishes.
+type fakeSysfs struct {
+	root string
+}
+
+func newFakeSysfs(tb testing.TB) *fakeSysfs {
+	root, err := filepath.EvalSymlinks(tb.TempDir())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	f := &fakeSysfs{root: root}
+	for _, dir := range []string{
+		"sys/devices",
+		"sys/bus/vdpa/devices",
+		"sys/bus/vdpa/drivers/" + VhostVdpaDriver,
+		"sys/bus/vdpa/drivers/" + VirtioVdpaDriver,
+		"sys/bus/virtio/devices",
+		"sys/bus/pci/devices",
+		"sys/bus/auxiliary/devices",
+		"dev",
+	} {
+		f.mkdir(tb, dir)
+	}
+
+	setRootDirs(f.path("sys"), f.path("dev"))
+	tb.Cleanup(func() {
+		setRootDirs("/sys", "/dev")
+	})
+	return f
+}
+
+func (f *fakeSysfs) path(elem ...string) string {
+	return filepath.Join(append([]string{f.root}, elem...)...)
+}
+
+func (f *fakeSysfs) mkdir(tb testing.TB, elem ...string) string {
+	path := f.path(elem...)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+func (f *fakeSysfs) symlink(tb testing.TB, target string, elem ...string) {
+	if err := os.Symlink(target, f.path(elem...)); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func (f *fakeSysfs) writeFile(tb testing.TB, content string, elem ...string) {
+	if err := os.WriteFile(f.path(elem...), []byte(content), 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// addPCIDevice adds a PCI device and returns its path
+func (f *fakeSysfs) addPCIDevice(tb testing.TB, address string, numaNode int) string {
+	path := f.mkdir(tb, "sys/devices/pci0000:00", address)
+	f.writeFile(tb, fmt.Sprintf("%d\n", numaNode), "sys/devices/pci0000:00", address, "numa_node")
+	f.symlink(tb, path, "sys/bus/pci/devices", address)
+	f.symlink(tb, f.path("sys/bus/pci"), "sys/devices/pci0000:00", address, "subsystem")
+	return path
+}
+
+// addAuxiliaryDevice adds an auxiliary device (e.g: a SF) inside the parent
+// path and returns its path
+func (f *fakeSysfs) addAuxiliaryDevice(tb testing.TB, parentPath, name string) string {
+	path := f.addDevice(tb, parentPath, name)
+	f.symlink(tb, path, "sys/bus/auxiliary/devices", name)
+	if err := os.Symlink(f.path("sys/bus/auxiliary"), filepath.Join(path, "subsystem")); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+// addDevice adds a generic device inside the parent path and returns its path
+func (f *fakeSysfs) addDevice(tb testing.TB, parentPath, name string) string {
+	path := filepath.Join(parentPath, name)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+// addVdpaDevice adds a vdpa device inside the parent path (rootDevDir if empty)
+// and binds it to the provided driver (if any)
+func (f *fakeSysfs) addVdpaDevice(tb testing.TB, parentPath, name, driver string, index int) {
+	if parentPath == "" {
+		parentPath = rootDevDir
+	}
+	path := f.addDevice(tb, parentPath, name)
+	f.symlink(tb, path, "sys/bus/vdpa/devices", name)
+	if driver != "" {
+		f.bindVdpaDevice(tb, name, driver, index)
+	}
+}
+
+// bindVdpaDevice binds a vdpa device to a driver. The index is used to name
+// the vhost-vdpa or virtio device. Since tests cannot create device nodes, the
+// vhost-vdpa device node is a symlink to /dev/null
+func (f *fakeSysfs) bindVdpaDevice(tb testing.TB, name, driver string, index int) {
+	path, err := filepath.EvalSymlinks(f.path("sys/bus/vdpa/devices", name))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	switch driver {
+	case VhostVdpaDriver:
+		vhostName := fmt.Sprintf("vhost-vdpa-%d", index)
+		f.addDevice(tb, path, vhostName)
+		f.symlink(tb, "/dev/null", "dev", vhostName)
+	case VirtioVdpaDriver:
+		// virtio devices are created in the vdpa device's parent, if any
+		parentPath := filepath.Dir(path)
+		if parentPath == rootDevDir {
+			parentPath = path
+		}
+		virtioName := fmt.Sprintf("virtio%d", index)
+		virtioPath := f.addDevice(tb, parentPath, virtioName)
+		f.addDevice(tb, virtioPath, fmt.Sprintf("net/eth%d", index))
+		f.symlink(tb, virtioPath, "sys/bus/virtio/devices", virtioName)
+		f.writeFile(tb, "0x0001\n", "sys/bus/virtio/devices", virtioName, "device")
+		f.writeFile(tb, "0x15b3\n", "sys/bus/virtio/devices", virtioName, "vendor")
+	}
+	if err := os.Symlink(f.path("sys/bus/vdpa/drivers", driver), filepath.Join(path, "driver")); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// newNoFamilyMock returns a NetlinkOps of a kernel without the vdpa generic
+// netlink family
+func newNoFamilyMock() NetlinkOps {
+	netLinkMock := &mocks.NetlinkOps{}
+	netLinkMock.On("NewAttribute", mock.AnythingOfType("int"), mock.Anything).
+		Return(&nl.RtAttr{}, nil)
+	netLinkMock.On("RunVdpaNetlinkCmd",
+		mock.AnythingOfType("uint8"),
+		mock.AnythingOfType("int"),
+		mock.Anything).
+		Return(nil, fmt.Errorf("%w: %v", ErrGenlFamilyNotFound, syscall.ENOENT))
+	netLinkMock.On("GetVdpaFamily").
+		Return(nil, fmt.Errorf("%w: %v", ErrGenlFamilyNotFound, syscall.ENOENT))
+	return familyMock{netLinkMock}
+}
+
+func TestSysfsFallback(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	pf := sysfs.addPCIDevice(t, "0000:65:00.0", 0)
+	vf := sysfs.addPCIDevice(t, "0000:65:00.2", 0)
+	sf := sysfs.addAuxiliaryDevice(t, pf, "mlx5_core.sf.2")
+	sysfs.addVdpaDevice(t, vf, "vdpa0", VhostVdpaDriver, 0)
+	sysfs.addVdpaDevice(t, sf, "vdpa1", VirtioVdpaDriver, 1)
+	sysfs.addVdpaDevice(t, sf, "vdpa2", "", 2)
+	sysfs.addVdpaDevice(t, "", "vdpa3", "", 3)
+
+	SetNetlinkOps(newNoFamilyMock())
+
+	devs, err := ListVdpaDevices()
+	assert.Nil(t, err)
+	assert.Len(t, devs, 4)
+
+	expected := []struct {
+		name        string
+		driver      string
+		mgmtDev     string
+		deviceID    uint32
+		unavailable []string
+	}{
+		{"vdpa0", VhostVdpaDriver, "pci/0000:65:00.2", 0, []string{"DeviceID", "VendorID"}},
+		{"vdpa1", VirtioVdpaDriver, "auxiliary/mlx5_core.sf.2", VirtioIDNet, nil},
+		{"vdpa2", "", "auxiliary/mlx5_core.sf.2", 0, []string{"DeviceID", "VendorID"}},
+		{"vdpa3", "", "", 0, []string{"DeviceID", "VendorID", "MgmtDev"}},
+	}
+	for i, exp := range expected {
+		dev := devs[i]
+		assert.Equal(t, exp.name, dev.Name())
+		assert.Equal(t, exp.driver, dev.Driver())
+		assert.Equal(t, exp.deviceID, dev.DeviceID())
+		assert.Equal(t, exp.unavailable, dev.UnavailableFields())
+		if exp.mgmtDev == "" {
+			assert.Nil(t, dev.MgmtDev())
+		} else if assert.NotNil(t, dev.MgmtDev()) {
+			assert.Equal(t, exp.mgmtDev, dev.MgmtDev().Name())
+		}
+	}
+	assert.Equal(t, "eth1", devs[1].VirtioNet().NetDev())
+	assert.Equal(t, uint32(0x15b3), devs[1].VendorID())
+
+	devs, err = GetVdpaDevicesByMgmtDev("auxiliary", "mlx5_core.sf.2")
+	assert.Nil(t, err)
+	assert.Len(t, devs, 2)
+
+	devs, err = ListVdpaDevices(VdpaDeviceFilter{DeviceID: VirtioIDNet})
+	assert.Nil(t, err)
+	if assert.Len(t, devs, 1) {
+		assert.Equal(t, "vdpa1", devs[0].Name())
+	}
+
+	dev, err := GetVdpaDevice("vdpa1")
+	assert.Nil(t, err)
+	assert.Equal(t, "virtio1", dev.VirtioNet().Name())
+	_, err = GetVdpaDevice("vdpa9")
+	assert.Equal(t, syscall.ENODEV, err)
+
+	mgmtDevs, err := ListVdpaMgmtDevices()
+	assert.Nil(t, err)
+	assert.Equal(t, []MgmtDev{
+		&mgmtDev{busName: "pci", devName: "0000:65:00.2"},
+		&mgmtDev{busName: "auxiliary", devName: "mlx5_core.sf.2"},
+	}, mgmtDevs)
+
+	mgmtDev, err := GetVdpaMgmtDevices("pci", "0000:65:00.2")
+	assert.Nil(t, err)
+	assert.Equal(t, "pci/0000:65:00.2", mgmtDev.Name())
+	_, err = GetVdpaMgmtDevices("pci", "0000:65:00.3")
+	assert.Equal(t, syscall.ENODEV, err)
+}
+
+func TestReconcileSysfsFallback(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	sysfs.addVdpaDevice(t, "", "vdpa0", VhostVdpaDriver, 0)
+
+	SetNetlinkOps(newNoFamilyMock())
+
+	// The management device of vdpa0 is unknown: it is not taken as different
+	desired := DesiredDevice{Name: "vdpa0", MgmtDev: "vdpasim_net", Driver: VirtioVdpaDriver}
+	plan, err := PlanReconcile(&DesiredState{Devices: []DesiredDevice{desired}})
+	assert.Nil(t, err)
+	assert.Equal(t, "rebind vdpa0: driver is \"vhost_vdpa\" instead of virtio_vdpa\n", plan.String())
+
+	results := ApplyPlan(&Plan{Steps: []PlanStep{
+		{Action: StepDelete, Device: "vdpa0", Desired: &desired},
+		{Action: StepCreate, Device: "vdpa0", Desired: &desired},
+	}})
+	for _, result := range results {
+		assert.Nil(t, result.Err, result.Step.String())
+		assert.False(t, result.Changed, result.Step.String())
+	}
+}
+
+func TestExportTopologySysfsFallback(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	vf := sysfs.addPCIDevice(t, "0000:65:00.2", 0)
+	sysfs.addVdpaDevice(t, vf, "vdpa0", VhostVdpaDriver, 0)
+	SetNetlinkOps(newNoFamilyMock())
+
+	topology, err := ExportTopology()
+	assert.Nil(t, err)
+	assert.Equal(t, []TopologyDevice{{Name: "vdpa0", MgmtDev: "pci/0000:65:00.2", Driver: VhostVdpaDriver}},
+		topology.Devices)
+
+	// The management device of vdpa1 is unknown
+	sysfs.addVdpaDevice(t, "", "vdpa1", "", 1)
+	_, err = ExportTopology()
+	if assert.ErrorIs(t, err, ErrMgmtDevNotFound) {
+		assert.Contains(t, err.Error(), "vdpa1")
+	}
+}
@@ -0,0 +1,309 @@
+package kvdpa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// TopologyVersion is the version of the topology file format
+const TopologyVersion = 1
+
+// Topology is a snapshot of the vdpa devices of a host that can be saved
+// and restored, e.g: after a reboot
+type Topology struct {
+	Version  int               `json:"version"`
+	MgmtDevs []TopologyMgmtDev `json:"mgmtdevs"`
+	Devices  []TopologyDevice  `json:"devices"`
+}
+
+// TopologyMgmtDev is an exported management device
+type TopologyMgmtDev struct {
+	// Name is the management device name: [busName/]devName
+	Name string `json:"name"`
+	// PCIAddress is the address of the PCI device the management device is
+	// (or sits on, e.g: for SFs), if any. It identifies the management
+	// device if its name changes
+	PCIAddress string `json:"pciAddress,omitempty"`
+}
+
+// TopologyDevice is an exported vdpa device
+type TopologyDevice struct {
+	Name    string `json:"name"`
+	MgmtDev string `json:"mgmtdev"`
+	// The configuration is only exported for net devices if the kernel
+	// supports retrieving it, and only where it differs from the defaults
+	MAC      string `json:"mac,omitempty"`
+	MTU      uint16 `json:"mtu,omitempty"`
+	MaxVqp   uint16 `json:"maxVqp,omitempty"`
+	Features uint64 `json:"features,omitempty"`
+	Driver   string `json:"driver,omitempty"`
+}
+
+// LoadTopology reads a topology file
+func LoadTopology(path string) (*Topology, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	topology := &Topology{}
+	if err := json.Unmarshal(content, topology); err != nil {
+		return nil, fmt.Errorf("invalid topology %s: %v", path, err)
+	}
+	if topology.Version < 1 || topology.Version > TopologyVersion {
+		return nil, fmt.Errorf("unsupported topology version %d in %s", topology.Version, path)
+	}
+	return topology, nil
+}
+
+// Save writes the topology to a file atomically: a crash leaves either the
+// previous file or the new one
+func (t *Topology) Save(path string) error {
+	content, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(content, '\n'), 0644)
+}
+
+// mgmtDevPCIAddress returns the address of the PCI device a management
+// device is or sits on, or an empty string if there is none (e.g: vdpasim)
+func mgmtDevPCIAddress(m MgmtDev) (string, error) {
+	path := filepath.Join(rootDevDir, m.DevName())
+	if m.BusName() != "" {
+		path = filepath.Join(sysfsRoot, "bus", m.BusName(), "devices", m.DevName())
+	}
+	devicePath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return pciAddressInPath(devicePath), nil
+}
+
+// ExportTopology returns the current topology: the management devices, the
+// devices with their configuration and their driver. It fails with
+// ErrMgmtDevNotFound if the management device of a device is unknown (see
+// the sysfs fallback)
+func ExportTopology() (*Topology, error) {
+	return ExportTopologyContext(context.Background())
+}
+
+// ExportTopologyContext is ExportTopology with a context
+func ExportTopologyContext(ctx context.Context) (*Topology, error) {
+	mgmtDevs, err := ListVdpaMgmtDevicesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	devs, err := ListVdpaDevicesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	configGet := false
+	if caps, err := CapabilitiesContext(ctx); err == nil {
+		configGet = caps.ConfigGet
+	}
+
+	topology := &Topology{
+		Version:  TopologyVersion,
+		MgmtDevs: make([]TopologyMgmtDev, 0, len(mgmtDevs)),
+		Devices:  make([]TopologyDevice, 0, len(devs)),
+	}
+	mgmtDevsByName := map[string]MgmtDev{}
+	for _, m := range mgmtDevs {
+		mgmtDevsByName[m.Name()] = m
+		pciAddress, err := mgmtDevPCIAddress(m)
+		if err != nil {
+			return nil, err
+		}
+		topology.MgmtDevs = append(topology.MgmtDevs, TopologyMgmtDev{Name: m.Name(), PCIAddress: pciAddress})
+	}
+	for _, dev := range devs {
+		// The management device is unknown with the sysfs fallback
+		if dev.MgmtDev() == nil {
+			return nil, fmt.Errorf("device %s: %w", dev.Name(), ErrMgmtDevNotFound)
+		}
+		exported := TopologyDevice{Name: dev.Name(), MgmtDev: dev.MgmtDev().Name(), Driver: dev.Driver()}
+		if configGet && dev.DeviceID() == VirtioIDNet {
+			config, err := GetVdpaDeviceConfigContext(ctx, dev.Name())
+			if err != nil {
+				return nil, fmt.Errorf("device %s: %w", dev.Name(), err)
+			}
+			exportConfig(&exported, config, mgmtDevsByName[exported.MgmtDev])
+		}
+		topology.Devices = append(topology.Devices, exported)
+	}
+	return topology, nil
+}
+
+// The defaults of the net device configuration
+const (
+	defaultNetMTU    = 1500
+	defaultNetMaxVqp = 1
+)
+
+// exportConfig sets the configuration of a net device that differs from the
+// defaults. Restoring a default would fail on the management devices that
+// cannot provision it, which the kernel does not report: the features are
+// only exported if the management device reports the ones it supports,
+// which are the default ones
+func exportConfig(exported *TopologyDevice, config *VdpaNetConfig, m MgmtDev) {
+	for _, b := range config.MacAddr {
+		if b != 0 {
+			exported.MAC = config.MacAddr.String()
+			break
+		}
+	}
+	if config.MTU != 0 && config.MTU != defaultNetMTU {
+		exported.MTU = config.MTU
+	}
+	if config.MaxVqp > defaultNetMaxVqp {
+		exported.MaxVqp = config.MaxVqp
+	}
+	if m == nil {
+		return
+	}
+	supported, ok := m.RawAttributes()[VdpaAttrDevSupportedFeatures]
+	if ok && len(supported) == 8 && config.Features != nl.NativeEndian().Uint64(supported) {
+		exported.Features = config.Features
+	}
+}
+
+// RestoreReport is the result of restoring a topology
+type RestoreReport struct {
+	// MgmtDevs maps the exported management device names to the current ones
+	MgmtDevs map[string]string
+	// Steps are the results of the steps that were applied
+	Steps []StepResult
+	// Failures holds the devices that could not be restored, with the reason
+	Failures map[string]error
+}
+
+// ErrMgmtDevNotFound is the failure of the devices whose management device
+// cannot be found, or cannot be told apart from others
+var ErrMgmtDevNotFound = errors.New("management device not found")
+
+// matchMgmtDevs maps the exported management devices to the current ones:
+// by name if it still exists or else by PCI address, provided a single
+// management device of the same bus matches it
+func matchMgmtDevs(ctx context.Context, exported []TopologyMgmtDev) (map[string]string, map[string]error, error) {
+	mgmtDevs, err := ListVdpaMgmtDevicesContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	byName := map[string]bool{}
+	byPCIAddress := map[string][]MgmtDev{}
+	for _, m := range mgmtDevs {
+		byName[m.Name()] = true
+		pciAddress, err := mgmtDevPCIAddress(m)
+		if err != nil {
+			return nil, nil, err
+		}
+		if pciAddress != "" {
+			byPCIAddress[pciAddress] = append(byPCIAddress[pciAddress], m)
+		}
+	}
+
+	matches := map[string]string{}
+	failures := map[string]error{}
+	for _, e := range exported {
+		if byName[e.Name] {
+			matches[e.Name] = e.Name
+			continue
+		}
+		busName, _, err := splitMgmtDevName(e.Name)
+		if err != nil {
+			failures[e.Name] = err
+			continue
+		}
+		candidates := []string{}
+		if e.PCIAddress != "" {
+			for _, m := range byPCIAddress[e.PCIAddress] {
+				if m.BusName() == busName {
+					candidates = append(candidates, m.Name())
+				}
+			}
+		}
+		switch len(candidates) {
+		case 0:
+			failures[e.Name] = ErrMgmtDevNotFound
+		case 1:
+			matches[e.Name] = candidates[0]
+		default:
+			failures[e.Name] = fmt.Errorf("%w: PCI address %s matches %v", ErrMgmtDevNotFound, e.PCIAddress, candidates)
+		}
+	}
+	return matches, failures, nil
+}
+
+// RestoreTopology recreates the devices of a topology that do not exist and
+// reconciles the configuration and the driver of the ones that do. Other
+// devices are left untouched. Features are only restored if the kernel
+// supports provisioning them
+func RestoreTopology(topology *Topology) (*RestoreReport, error) {
+	return RestoreTopologyContext(context.Background(), topology)
+}
+
+// RestoreTopologyContext is RestoreTopology with a context
+func RestoreTopologyContext(ctx context.Context, topology *Topology) (*RestoreReport, error) {
+	mgmtDevs, mgmtDevFailures, err := matchMgmtDevs(ctx, topology.MgmtDevs)
+	if err != nil {
+		return nil, err
+	}
+	featureProvisioning := false
+	if caps, err := CapabilitiesContext(ctx); err == nil {
+		featureProvisioning = caps.FeatureProvisioning
+	}
+
+	report := &RestoreReport{MgmtDevs: mgmtDevs, Failures: map[string]error{}}
+	desired := &DesiredState{}
+	for _, dev := range topology.Devices {
+		mgmtDev, ok := mgmtDevs[dev.MgmtDev]
+		if !ok {
+			err := mgmtDevFailures[dev.MgmtDev]
+			if err == nil {
+				// The management device was not exported
+				err = ErrMgmtDevNotFound
+			}
+			report.Failures[dev.Name] = fmt.Errorf("management device %s: %w", dev.MgmtDev, err)
+			continue
+		}
+		d := DesiredDevice{
+			Name:       dev.Name,
+			MgmtDev:    mgmtDev,
+			MAC:        dev.MAC,
+			MTU:        dev.MTU,
+			QueuePairs: dev.MaxVqp,
+			Driver:     dev.Driver,
+		}
+		if featureProvisioning {
+			d.Features = dev.Features
+		}
+		// An invalid entry must not prevent the others from being restored
+		if err := (&DesiredState{Devices: []DesiredDevice{d}}).validate(); err != nil {
+			report.Failures[dev.Name] = err
+			continue
+		}
+		desired.Devices = append(desired.Devices, d)
+	}
+
+	plan, err := PlanReconcileContext(ctx, desired)
+	if err != nil {
+		return nil, err
+	}
+	report.Steps = ApplyPlanContext(ctx, plan)
+	for _, result := range report.Steps {
+		if result.Err != nil && !errors.Is(result.Err, ErrStepSkipped) {
+			report.Failures[result.Step.Device] = fmt.Errorf("%s: %w", result.Step.Action, result.Err)
+		}
+	}
+	return report, nil
+}
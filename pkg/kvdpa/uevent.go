@@ -0,0 +1,109 @@
+package kvdpa
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/k8snetworkplumbingwg/govdpa/pkg/kvdpa/internal/hooks"
+)
+
+// ueventPollInterval is how often the uevent listener checks whether it has
+// been cancelled while no uevents are received
+var ueventPollInterval = time.Second
+
+// uevent is a kernel object event
+type uevent = hooks.UEvent
+
+// ueventSource is where the uevents come from: the simulator of kvdpa/fake
+// replaces the kernel uevent socket
+var ueventSource hooks.UEventSource = listenUEvents
+
+func init() {
+	hooks.SetUEventSource = setUEventSource
+}
+
+// setUEventSource replaces the kernel uevent socket as the source of uevents.
+// A nil source restores the kernel uevent socket
+func setUEventSource(source hooks.UEventSource) {
+	if source == nil {
+		source = listenUEvents
+	}
+	ueventSource = source
+}
+
+// parseUEvent parses a kernel uevent message. Messages are a "action@devpath"
+// header followed by NUL-separated KEY=VALUE fields (ACTION, DEVPATH, SUBSYSTEM...)
+func parseUEvent(msg []byte) (uevent, bool) {
+	fields := bytes.Split(msg, []byte{0})
+	if len(fields) < 2 || !bytes.Contains(fields[0], []byte("@")) {
+		// Not a kernel uevent (e.g: a libudev message)
+		return uevent{}, false
+	}
+	ev := uevent{Env: map[string]string{}}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(string(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		ev.Env[kv[0]] = kv[1]
+	}
+	ev.Action = ev.Env["ACTION"]
+	ev.DevPath = ev.Env["DEVPATH"]
+	ev.Subsystem = ev.Env["SUBSYSTEM"]
+	if ev.Action == "" || ev.DevPath == "" {
+		return uevent{}, false
+	}
+	return ev, true
+}
+
+// listenUEvents listens to the kernel uevents until the context is cancelled
+// or an unrecoverable error happens, in which case the returned channel is closed
+func listenUEvents(ctx context.Context) (<-chan uevent, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC,
+		syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, err
+	}
+	// Group 1 carries the kernel uevents
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	timeout := syscall.NsecToTimeval(ueventPollInterval.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	events := make(chan uevent)
+	go func() {
+		defer close(events)
+		defer syscall.Close(fd)
+		buf := make([]byte, 64*1024)
+		for ctx.Err() == nil {
+			var ev uevent
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			switch {
+			case err == syscall.EAGAIN || err == syscall.EINTR:
+				continue
+			case err == syscall.ENOBUFS:
+				ev = uevent{Overrun: true}
+			case err != nil:
+				return
+			default:
+				var ok bool
+				if ev, ok = parseUEvent(buf[:n]); !ok {
+					continue
+				}
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return events, nil
+}
@@ -31,17 +31,12 @@ func (v *vhostVdpa) Path() string {
 
 // GetVhostVdpaDevInPath returns the VhostVdpa found in the provided parent device's path
 func GetVhostVdpaDevInPath(parentPath string) (VhostVdpa, error) {
-	fd, err := os.Open(parentPath)
+	// os.ReadDir does not stat every entry, which matters on big parent devices
+	entries, err := os.ReadDir(parentPath)
 	if err != nil {
 		return nil, err
 	}
-	defer fd.Close()
-
-	fileInfos, err := fd.Readdir(-1)
-	if err != nil {
-		return nil, err
-	}
-	for _, file := range fileInfos {
+	for _, file := range entries {
 		if strings.Contains(file.Name(), "vhost-vdpa") &&
 			file.IsDir() {
 			devicePath := filepath.Join(vdpaVhostDevDir, file.Name())
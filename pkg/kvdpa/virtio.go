@@ -1,27 +1,130 @@
 package kvdpa
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
-const (
+var (
 	virtioDevDir = "/sys/bus/virtio/devices"
 )
 
-// VirtioNet is the virtio-net device information
+// virtioFeatureNames are the kernel names of the virtio-net device features
+// and of the transport features, by bit
+var virtioFeatureNames = map[uint]string{
+	0:  "VIRTIO_NET_F_CSUM",
+	1:  "VIRTIO_NET_F_GUEST_CSUM",
+	2:  "VIRTIO_NET_F_CTRL_GUEST_OFFLOADS",
+	3:  "VIRTIO_NET_F_MTU",
+	5:  "VIRTIO_NET_F_MAC",
+	6:  "VIRTIO_NET_F_GSO",
+	7:  "VIRTIO_NET_F_GUEST_TSO4",
+	8:  "VIRTIO_NET_F_GUEST_TSO6",
+	9:  "VIRTIO_NET_F_GUEST_ECN",
+	10: "VIRTIO_NET_F_GUEST_UFO",
+	11: "VIRTIO_NET_F_HOST_TSO4",
+	12: "VIRTIO_NET_F_HOST_TSO6",
+	13: "VIRTIO_NET_F_HOST_ECN",
+	14: "VIRTIO_NET_F_HOST_UFO",
+	15: "VIRTIO_NET_F_MRG_RXBUF",
+	16: "VIRTIO_NET_F_STATUS",
+	17: "VIRTIO_NET_F_CTRL_VQ",
+	18: "VIRTIO_NET_F_CTRL_RX",
+	19: "VIRTIO_NET_F_CTRL_VLAN",
+	20: "VIRTIO_NET_F_CTRL_RX_EXTRA",
+	21: "VIRTIO_NET_F_GUEST_ANNOUNCE",
+	22: "VIRTIO_NET_F_MQ",
+	23: "VIRTIO_NET_F_CTRL_MAC_ADDR",
+	24: "VIRTIO_F_NOTIFY_ON_EMPTY",
+	27: "VIRTIO_F_ANY_LAYOUT",
+	28: "VIRTIO_RING_F_INDIRECT_DESC",
+	29: "VIRTIO_RING_F_EVENT_IDX",
+	32: "VIRTIO_F_VERSION_1",
+	33: "VIRTIO_F_ACCESS_PLATFORM",
+	34: "VIRTIO_F_RING_PACKED",
+	35: "VIRTIO_F_IN_ORDER",
+	36: "VIRTIO_F_ORDER_PLATFORM",
+	37: "VIRTIO_F_SR_IOV",
+	38: "VIRTIO_F_NOTIFICATION_DATA",
+	40: "VIRTIO_F_RING_RESET",
+	52: "VIRTIO_NET_F_VQ_NOTF_COAL",
+	53: "VIRTIO_NET_F_NOTF_COAL",
+	54: "VIRTIO_NET_F_GUEST_USO4",
+	55: "VIRTIO_NET_F_GUEST_USO6",
+	56: "VIRTIO_NET_F_HOST_USO",
+	57: "VIRTIO_NET_F_HASH_REPORT",
+	59: "VIRTIO_NET_F_GUEST_HDRLEN",
+	60: "VIRTIO_NET_F_RSS",
+	61: "VIRTIO_NET_F_RSC_EXT",
+	62: "VIRTIO_NET_F_STANDBY",
+	63: "VIRTIO_NET_F_SPEED_DUPLEX",
+}
+
+// VirtioNetFeatureNames returns the kernel names of the virtio-net features
+// set in a feature bitmask (e.g: VIRTIO_NET_F_MAC). Unknown features are
+// named after their bit (e.g: "bit 26")
+func VirtioNetFeatureNames(features uint64) []string {
+	names := []string{}
+	for bit := uint(0); bit < 64; bit++ {
+		if features&(1<<bit) == 0 {
+			continue
+		}
+		name, ok := virtioFeatureNames[bit]
+		if !ok {
+			name = fmt.Sprintf("bit %d", bit)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// NetDevStats are the statistics of a netdev
+type NetDevStats struct {
+	RxBytes   uint64
+	RxPackets uint64
+	RxErrors  uint64
+	RxDropped uint64
+	TxBytes   uint64
+	TxPackets uint64
+	TxErrors  uint64
+	TxDropped uint64
+}
+
+// VirtioNet is the virtio-net device information. The netdev information
+// (empty if the device has no netdev) is read with the device, the
+// statistics on every Stats call
 type VirtioNet interface {
 	Name() string
 	NetDev() string
+	MAC() net.HardwareAddr
+	MTU() int
+	// OperState is the operational state of the netdev (RFC 2863): "up",
+	// "down", "unknown"...
+	OperState() string
+	Carrier() bool
+	// Features are the features negotiated by the virtio driver
+	Features() uint64
+	// FeatureNames are the names of the negotiated features
+	FeatureNames() []string
+	Stats() (*NetDevStats, error)
 }
 
 // virtioNet implements VirtioNet interface
 type virtioNet struct {
-	name   string
-	netDev string
+	name      string
+	netDev    string
+	mac       net.HardwareAddr
+	mtu       int
+	operState string
+	carrier   bool
+	features  uint64
 }
 
 // Name returns the virtio device's name (as appears in the virtio bus)
@@ -34,36 +137,158 @@ func (v *virtioNet) NetDev() string {
 	return v.netDev
 }
 
-// GetVirtioNetInPath returns the VirtioNet found in the provided parent device's path
-func GetVirtioNetInPath(parentPath string) (VirtioNet, error) {
-	fd, err := os.Open(parentPath)
-	if err != nil {
-		return nil, err
+// MAC returns the MAC address of the netdev
+func (v *virtioNet) MAC() net.HardwareAddr {
+	return v.mac
+}
+
+// MTU returns the MTU of the netdev
+func (v *virtioNet) MTU() int {
+	return v.mtu
+}
+
+// OperState returns the operational state of the netdev
+func (v *virtioNet) OperState() string {
+	return v.operState
+}
+
+// Carrier returns whether the netdev has a carrier
+func (v *virtioNet) Carrier() bool {
+	return v.carrier
+}
+
+// Features returns the negotiated virtio features
+func (v *virtioNet) Features() uint64 {
+	return v.features
+}
+
+// FeatureNames returns the names of the negotiated virtio features
+func (v *virtioNet) FeatureNames() []string {
+	return VirtioNetFeatureNames(v.features)
+}
+
+// Stats reads the current statistics of the netdev
+func (v *virtioNet) Stats() (*NetDevStats, error) {
+	if v.netDev == "" {
+		return nil, fmt.Errorf("virtio device %s has no netdev: %w", v.name, syscall.ENODEV)
+	}
+	dir := filepath.Join(virtioDevDir, v.name, "net", v.netDev, "statistics")
+	stats := &NetDevStats{}
+	files := map[string]*uint64{
+		"rx_bytes":   &stats.RxBytes,
+		"rx_packets": &stats.RxPackets,
+		"rx_errors":  &stats.RxErrors,
+		"rx_dropped": &stats.RxDropped,
+		"tx_bytes":   &stats.TxBytes,
+		"tx_packets": &stats.TxPackets,
+		"tx_errors":  &stats.TxErrors,
+		"tx_dropped": &stats.TxDropped,
+	}
+	for name, value := range files {
+		var err error
+		if *value, err = readSysfsUint64(filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
 	}
-	defer fd.Close()
+	return stats, nil
+}
 
-	fileInfos, err := fd.Readdir(-1)
+// GetVirtioNetInPath returns the VirtioNet found in the provided parent device's path
+func GetVirtioNetInPath(parentPath string) (VirtioNet, error) {
+	// os.ReadDir does not stat every entry, which matters on big parent devices
+	entries, err := os.ReadDir(parentPath)
 	if err != nil {
 		return nil, err
 	}
-	for _, file := range fileInfos {
+	for _, file := range entries {
 		if strings.Contains(file.Name(), "virtio") &&
 			file.IsDir() {
 			virtioDevPath := filepath.Join(virtioDevDir, file.Name())
 			if _, err := os.Stat(virtioDevPath); os.IsNotExist(err) {
 				return nil, fmt.Errorf("virtio device %s does not exist", virtioDevPath)
 			}
-			var netdev string
+			v := &virtioNet{name: file.Name()}
+			if v.features, err = readVirtioFeatures(filepath.Join(virtioDevPath, "features")); err != nil {
+				return nil, err
+			}
 			// Read the "net" directory in the virtio device path
 			netDeviceFiles, err := ioutil.ReadDir(filepath.Join(virtioDevPath, "net"))
 			if err == nil && len(netDeviceFiles) == 1 {
-				netdev = strings.TrimSpace(netDeviceFiles[0].Name())
+				v.netDev = strings.TrimSpace(netDeviceFiles[0].Name())
+				if err := v.readNetDev(filepath.Join(virtioDevPath, "net", v.netDev)); err != nil {
+					return nil, err
+				}
 			}
-			return &virtioNet{
-				name:   file.Name(),
-				netDev: netdev,
-			}, nil
+			return v, nil
 		}
 	}
 	return nil, fmt.Errorf("no VirtioNet device found in path %s", parentPath)
 }
+
+// readNetDev reads the netdev attributes. The netdev may be being removed so
+// missing attributes are left empty
+func (v *virtioNet) readNetDev(path string) error {
+	read := func(name string) (string, error) {
+		content, err := ioutil.ReadFile(filepath.Join(path, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "", nil
+			}
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	address, err := read("address")
+	if err != nil {
+		return err
+	}
+	if address != "" {
+		if v.mac, err = net.ParseMAC(address); err != nil {
+			return fmt.Errorf("invalid address of netdev %s: %v", v.netDev, err)
+		}
+	}
+	mtu, err := read("mtu")
+	if err != nil {
+		return err
+	}
+	if mtu != "" {
+		if v.mtu, err = strconv.Atoi(mtu); err != nil {
+			return fmt.Errorf("invalid mtu of netdev %s: %v", v.netDev, err)
+		}
+	}
+	if v.operState, err = read("operstate"); err != nil {
+		return err
+	}
+	// Reading the carrier of a netdev that is administratively down fails
+	// with EINVAL
+	carrier, err := read("carrier")
+	if err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	v.carrier = carrier == "1"
+	return nil
+}
+
+// readVirtioFeatures parses a virtio "features" sysfs file: one character
+// per feature bit, starting with bit 0. A missing file is no features
+func readVirtioFeatures(path string) (uint64, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var features uint64
+	for bit, c := range strings.TrimSpace(string(content)) {
+		switch {
+		case c == '0':
+		case c != '1':
+			return 0, fmt.Errorf("invalid virtio features %s: %q", path, content)
+		case bit < 64:
+			features |= 1 << uint(bit)
+		}
+	}
+	return features, nil
+}